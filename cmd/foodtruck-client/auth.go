@@ -67,7 +67,39 @@ func (p *chefServerAuthProviderFactory) UnmarshalJSON(b []byte) error {
 	p.KeyPath = params.Key
 
 	if p.KeyPath == "" {
-		return fmt.Errorf("%w: must provide \"key\"", ErrMissingParameters)
+		return fmt.Errorf("%w: must provide \"key_path\"", ErrMissingParameters)
+	}
+	return nil
+}
+
+type mutualTLSAuthProviderFactory struct {
+	// CertPath is the path to the client certificate
+	CertPath string `json:"cert_path"`
+	// KeyPath is the path to the private key for the client certificate
+	KeyPath string `json:"key_path"`
+}
+
+func (p *mutualTLSAuthProviderFactory) InitializeAuthProvider(nodeName string) (foodtruckhttp.AuthProvider, error) {
+	return foodtruckhttp.NewMutualTLSAuthProvider(p.CertPath, p.KeyPath)
+}
+
+func (p *mutualTLSAuthProviderFactory) UnmarshalJSON(b []byte) error {
+	params := struct {
+		CertPath string `json:"cert_path"`
+		KeyPath  string `json:"key_path"`
+	}{}
+	if err := json.Unmarshal(b, &params); err != nil {
+		return err
+	}
+
+	p.CertPath = params.CertPath
+	p.KeyPath = params.KeyPath
+
+	if p.CertPath == "" {
+		return fmt.Errorf("%w: must provide \"cert_path\"", ErrMissingParameters)
+	}
+	if p.KeyPath == "" {
+		return fmt.Errorf("%w: must provide \"key_path\"", ErrMissingParameters)
 	}
 	return nil
 }
@@ -99,6 +131,12 @@ func (ac *AuthConfig) UnmarshalJSON(b []byte) error {
 			return err
 		}
 		ac.AuthProvider = &p
+	case "mutualTLS":
+		p := mutualTLSAuthProviderFactory{}
+		if err := json.Unmarshal(b, &p); err != nil {
+			return err
+		}
+		ac.AuthProvider = &p
 	default:
 		return fmt.Errorf("%w: %q", ErrInvalidAuthProvider, providerType.Type)
 	}
@@ -50,7 +50,29 @@ func TestChefServerApiKey(t *testing.T) {
 
 	t.Run("key in json", func(t *testing.T) {
 		ac := AuthConfig{}
-		err := unmarshal(`{"type": "chefServer", "key": "/path/to/key.pem"}`, &ac)
+		err := unmarshal(`{"type": "chefServer", "key_path": "/path/to/key.pem"}`, &ac)
+		require.NoError(t, err)
+	})
+}
+
+func TestMutualTLSAuthConfig(t *testing.T) {
+	t.Run("missing cert_path parameter", func(t *testing.T) {
+		ac := AuthConfig{}
+		err := unmarshal(`{"type": "mutualTLS", "key_path": "/path/to/key.pem"}`, &ac)
+		require.Error(t, err)
+		require.True(t, errors.Is(err, ErrMissingParameters))
+	})
+
+	t.Run("missing key_path parameter", func(t *testing.T) {
+		ac := AuthConfig{}
+		err := unmarshal(`{"type": "mutualTLS", "cert_path": "/path/to/cert.pem"}`, &ac)
+		require.Error(t, err)
+		require.True(t, errors.Is(err, ErrMissingParameters))
+	})
+
+	t.Run("cert and key in json", func(t *testing.T) {
+		ac := AuthConfig{}
+		err := unmarshal(`{"type": "mutualTLS", "cert_path": "/path/to/cert.pem", "key_path": "/path/to/key.pem"}`, &ac)
 		require.NoError(t, err)
 	})
 }
@@ -2,18 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/chef/foodtruck/pkg/foodtruckhttp"
 	"github.com/chef/foodtruck/pkg/models"
 	"github.com/chef/foodtruck/pkg/provider"
+	"github.com/chef/foodtruck/pkg/secrets"
+	"github.com/chef/foodtruck/pkg/signing"
 )
 
 type Duration time.Duration
@@ -37,12 +46,172 @@ func (d Duration) MarshalJSON() (b []byte, err error) {
 	return []byte(fmt.Sprintf(`"%s"`, time.Duration(d).String())), nil
 }
 
+type TLSConfig struct {
+	// CABundlePath is a PEM file of CAs used to verify the server instead of
+	// the system roots
+	CABundlePath       string `json:"ca_bundle_path"`
+	MinVersion         string `json:"min_version"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type ProxyConfig struct {
+	HTTPProxy  string `json:"http_proxy"`
+	HTTPSProxy string `json:"https_proxy"`
+	NoProxy    string `json:"no_proxy"`
+}
+
+type TimeoutsConfig struct {
+	Dial         Duration `json:"dial"`
+	TLSHandshake Duration `json:"tls_handshake"`
+	Request      Duration `json:"request"`
+}
+
+type ExecutionConfig struct {
+	// EnvPassthrough are the variables of the client's environment passed
+	// to providers. If not set, a default list is used.
+	EnvPassthrough []string `json:"env_passthrough"`
+	// WorkdirBase is where the working directory of each task is created
+	WorkdirBase string `json:"workdir_base"`
+	// User and Group are who providers run as by default
+	User  string `json:"user"`
+	Group string `json:"group"`
+	// AllowedUsers and AllowedGroups are who tasks may ask to be run as
+	AllowedUsers  []string `json:"allowed_users"`
+	AllowedGroups []string `json:"allowed_groups"`
+}
+
+type ConcurrencyConfig struct {
+	// MaxTasks is how many tasks the client runs at the same time
+	MaxTasks int `json:"max_tasks"`
+	// Providers caps how many tasks of a provider run at the same time
+	Providers map[string]int `json:"providers"`
+}
+
+type LimitsConfig struct {
+	models.ResourceLimits
+	// CgroupParent is a cgroup v2 directory a group is created in for each
+	// task
+	CgroupParent string `json:"cgroup_parent"`
+}
+
 type Config struct {
-	Node          models.Node `json:"node"`
-	AuthConfig    AuthConfig  `json:"auth"`
-	BaseURL       string      `json:"base_url"`
-	ProvidersPath string      `json:"providers_path"`
-	Interval      Duration    `json:"interval"`
+	Node          models.Node    `json:"node"`
+	AuthConfig    AuthConfig     `json:"auth"`
+	BaseURL       string         `json:"base_url"`
+	ProvidersPath string         `json:"providers_path"`
+	Interval      Duration       `json:"interval"`
+	MinInterval   Duration       `json:"min_interval"`
+	MaxInterval   Duration       `json:"max_interval"`
+	TLS           TLSConfig      `json:"tls"`
+	Proxy         ProxyConfig    `json:"proxy"`
+	Timeouts      TimeoutsConfig `json:"timeouts"`
+	// TrustStorePath is a directory of public keys tasks must be signed
+	// with. If set, unsigned tasks are refused.
+	TrustStorePath string `json:"trust_store_path"`
+	// AllowedProviders is the list of providers the node will run.
+	// Provider executables must always be listed. If empty, only the
+	// builtin providers other than shell and script are allowed.
+	AllowedProviders []string `json:"allowed_providers"`
+	// ProviderChecksums pins provider executables to their sha256
+	ProviderChecksums map[string]string `json:"provider_checksums"`
+	// CachePath is where builtin providers keep files across runs
+	CachePath string `json:"cache_path"`
+	// FileRoots are the directories the builtin file and file-download
+	// providers may write files in
+	FileRoots []string        `json:"file_roots"`
+	Execution ExecutionConfig `json:"execution"`
+	// Infra is how the builtin infra provider runs chef-client
+	Infra provider.InfraConfig `json:"infra"`
+	// Limits are the resource limits providers run with on Linux
+	Limits LimitsConfig `json:"limits"`
+	// Concurrency is how many tasks the client runs at the same time
+	Concurrency ConcurrencyConfig `json:"concurrency"`
+	// LongPoll is how long the server may hold a request for the next task
+	// until one is available. Servers that do not support it are polled on
+	// Interval.
+	LongPoll Duration `json:"long_poll"`
+	// Push keeps a connection to the server open, over which it lets the
+	// client know right away when tasks are available or cancelled. Long
+	// polling is used instead if the server does not support it.
+	Push bool `json:"push"`
+	// StatePath is where the client keeps the state it needs across
+	// restarts, such as its task journal and the status updates waiting to
+	// be sent
+	StatePath string `json:"state_path"`
+	// ShutdownTimeout is how long a running task may take to finish after
+	// the client is asked to stop before it is terminated
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+// RunnerOpts returns the options for the provider runners described by the
+// config
+func (c Config) RunnerOpts() []provider.ExecRunnerOpt {
+	return []provider.ExecRunnerOpt{
+		provider.WithProvidersPath(c.ProvidersPath),
+		provider.WithAllowedProviders(c.AllowedProviders),
+		provider.WithChecksums(c.ProviderChecksums),
+		provider.WithCachePath(c.CachePath),
+		provider.WithFileRoots(c.FileRoots),
+		provider.WithEnvPassthrough(c.Execution.EnvPassthrough),
+		provider.WithWorkdirBase(c.Execution.WorkdirBase),
+		provider.WithRunAs(c.Execution.User, c.Execution.Group),
+		provider.WithAllowedRunAs(c.Execution.AllowedUsers, c.Execution.AllowedGroups),
+		provider.WithLimits(c.Limits.ResourceLimits),
+		provider.WithCgroupParent(c.Limits.CgroupParent),
+		provider.WithInfraConfig(c.Infra),
+	}
+}
+
+// StateDir returns the state path, falling back to the user's config
+// directory
+func (c Config) StateDir() (string, error) {
+	if c.StatePath != "" {
+		return c.StatePath, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("state_path must be set: %w", err)
+	}
+	return filepath.Join(configDir, "foodtruck"), nil
+}
+
+// HTTPClientOpts returns the options for the foodtruck http client described
+// by the config
+func (c Config) HTTPClientOpts() ([]foodtruckhttp.ClientOpt, error) {
+	opts := []foodtruckhttp.ClientOpt{
+		foodtruckhttp.WithInsecureSkipVerify(c.TLS.InsecureSkipVerify || os.Getenv("SSL_NO_VERIFY") == "true"),
+		foodtruckhttp.WithTimeouts(time.Duration(c.Timeouts.Dial), time.Duration(c.Timeouts.TLSHandshake),
+			time.Duration(c.Timeouts.Request)),
+	}
+
+	if c.TLS.CABundlePath != "" {
+		pool, err := foodtruckhttp.LoadCABundle(c.TLS.CABundlePath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, foodtruckhttp.WithRootCAs(pool))
+	}
+
+	if c.TLS.MinVersion != "" {
+		version, ok := tlsVersions[c.TLS.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls min_version %q", c.TLS.MinVersion)
+		}
+		opts = append(opts, foodtruckhttp.WithMinTLSVersion(version))
+	}
+
+	if c.Proxy != (ProxyConfig{}) {
+		opts = append(opts, foodtruckhttp.WithProxy(c.Proxy.HTTPProxy, c.Proxy.HTTPSProxy, c.Proxy.NoProxy))
+	}
+
+	return opts, nil
 }
 
 func (c Config) Validate() {
@@ -62,6 +231,33 @@ func (c Config) Validate() {
 		fail = true
 	}
 
+	if _, ok := tlsVersions[c.TLS.MinVersion]; c.TLS.MinVersion != "" && !ok {
+		fmt.Fprintf(os.Stderr, "TLS min version must be one of 1.0, 1.1, 1.2 or 1.3\n")
+		fail = true
+	}
+
+	if c.MinInterval > c.MaxInterval {
+		fmt.Fprintf(os.Stderr, "Min interval must not be longer than max interval\n")
+		fail = true
+	}
+
+	if c.LongPoll != 0 && time.Duration(c.LongPoll) < time.Second {
+		fmt.Fprintf(os.Stderr, "Long poll must be 0 or at least 1s\n")
+		fail = true
+	}
+
+	if c.Concurrency.MaxTasks < 1 {
+		fmt.Fprintf(os.Stderr, "Concurrency max_tasks must be at least 1\n")
+		fail = true
+	}
+
+	for provider, limit := range c.Concurrency.Providers {
+		if limit < 1 {
+			fmt.Fprintf(os.Stderr, "Concurrency limit of provider %s must be at least 1\n", provider)
+			fail = true
+		}
+	}
+
 	if fail {
 		os.Exit(1)
 	}
@@ -71,6 +267,12 @@ func loadConfig(confPath string) Config {
 	config := Config{
 		BaseURL:  "http://localhost:1323",
 		Interval: Duration(time.Second * 5),
+		LongPoll: Duration(time.Second * 30),
+		Concurrency: ConcurrencyConfig{
+			MaxTasks: 1,
+		},
+		MinInterval: Duration(time.Second),
+		MaxInterval: Duration(time.Hour),
 	}
 
 	if confPath != "" {
@@ -90,18 +292,36 @@ func loadConfig(confPath string) Config {
 	return config
 }
 
+const usage = `[usage]: foodtruck-client [run-once] [--dry-run] conf.json
+
+  run-once   Run the next task if there is one, then exit with its exit code
+  --dry-run  Print the next task without running or dequeuing it
+`
+
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "[usage]: foodtruck-client conf.json\n")
+	args := os.Args[1:]
+	runOnce := false
+	if len(args) > 0 && args[0] == "run-once" {
+		runOnce = true
+		args = args[1:]
+	}
+	flags := flag.NewFlagSet("foodtruck-client", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	dryRun := flags.Bool("dry-run", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
 		os.Exit(1)
 	}
 
-	config := loadConfig(os.Args[1])
+	config := loadConfig(flags.Arg(0))
+
+	// ctx is cancelled to stop polling for tasks, and taskCtx to terminate
+	// the running task
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-
-	fmt.Fprintf(os.Stderr, "Node %s checking into %s on interval %s\n", config.Node, config.BaseURL,
-		time.Duration(config.Interval).String())
+	taskCtx, terminate := context.WithCancel(context.Background())
+	defer terminate()
+	go handleSignals(cancel, terminate, time.Duration(config.ShutdownTimeout))
 
 	authProvider, err := config.AuthConfig.AuthProvider.InitializeAuthProvider(config.Node.Name)
 	if err != nil {
@@ -109,58 +329,562 @@ func main() {
 		os.Exit(1)
 	}
 
-	sslNoVerify := os.Getenv("SSL_NO_VERIFY") == "true"
+	clientOpts, err := config.HTTPClientOpts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure http client: %v\n", err)
+		os.Exit(1)
+	}
+
+	var trustStore *signing.TrustStore
+	if config.TrustStorePath != "" {
+		trustStore, err = signing.LoadTrustStore(config.TrustStorePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load trust store: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	stateDir, err := config.StateDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open journal: %v\n", err)
+		os.Exit(1)
+	}
+	journal, err := openJournal(filepath.Join(stateDir, "journal.json"))
+	if err == nil && !*dryRun {
+		err = journal.recover()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open journal: %v\n", err)
+		os.Exit(1)
+	}
+
+	client := foodtruckhttp.NewClient(config.BaseURL, config.Node, authProvider, clientOpts...)
+	outbox, err := openOutbox(filepath.Join(stateDir, "outbox.json"), client.UpdateNodeTaskStatus)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open outbox: %v\n", err)
+		os.Exit(1)
+	}
+
+	if runtime.GOOS != "linux" && (config.Limits.ResourceLimits != models.ResourceLimits{} || config.Limits.CgroupParent != "") {
+		fmt.Fprintf(os.Stderr, "[Warning]: resource limits are only supported on linux and will not be applied\n")
+	}
+
+	runnerOpts := append(config.RunnerOpts(),
+		provider.WithHTTPClient(foodtruckhttp.NewDownloadClient(clientOpts...)))
+	tr := &taskRunner{
+		node:   config.Node,
+		client: client,
+		runner: provider.NewChainRunner(
+			provider.NewBuiltinRunner(runnerOpts...),
+			provider.NewExecRunner(runnerOpts...),
+		),
+		trustStore: trustStore,
+		journal:    journal,
+		outbox:     outbox,
+		scheduler:  newScheduler(config.Concurrency.MaxTasks, config.Concurrency.Providers),
+		longPoll:   time.Duration(config.LongPoll),
+		wake:       make(chan struct{}, 1),
+	}
+
+	if *dryRun {
+		if err := tr.dryRun(ctx, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "[Error]: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	tr.start()
+
+	if runOnce {
+		status, err := tr.runNext(ctx, taskCtx)
+		tr.stop()
+		if errors.Is(err, models.ErrNoTasks) {
+			fmt.Fprintln(os.Stderr, "No tasks available")
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[Error]: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(exitCode(status))
+	}
+
+	fmt.Fprintf(os.Stderr, "Node %s checking into %s on interval %s\n", config.Node, config.BaseURL,
+		time.Duration(config.Interval).String())
+
+	if config.Push {
+		// The server says when to ask for tasks, so requests are not held
+		tr.longPoll = 0
+		go tr.watchEvents(ctx, time.Duration(config.LongPoll))
+	}
+
+	poll := pollTimer{
+		interval:    time.Duration(config.Interval),
+		minInterval: time.Duration(config.MinInterval),
+		maxInterval: time.Duration(config.MaxInterval),
+	}
+	result, retryAfter := pullEmpty, time.Duration(0)
+	for tr.waitToPull(ctx, result, poll.next(retryAfter)) {
+		var err error
+		result, retryAfter, err = tr.pull(ctx, taskCtx)
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "[Error]: %s\n", err)
+		}
+	}
+	tr.running.Wait()
+	tr.stop()
+	fmt.Fprintln(os.Stderr, "Stopped")
+}
+
+// handleSignals stops polling for tasks when the client is asked to exit with
+// SIGINT or SIGTERM. A running task is given shutdownTimeout to finish before
+// it is terminated, or is terminated right away on a second signal.
+func handleSignals(stopPolling func(), terminate func(), shutdownTimeout time.Duration) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-sigs
+	fmt.Fprintf(os.Stderr, "Received %s, shutting down\n", sig)
+	stopPolling()
+
+	select {
+	case <-sigs:
+	case <-time.After(shutdownTimeout):
+	}
+	terminate()
+}
+
+// taskRunner fetches the tasks of a node from the server, runs them and
+// reports their status
+type taskRunner struct {
+	node       models.Node
+	client     *foodtruckhttp.Client
+	runner     *provider.ChainRunner
+	trustStore *signing.TrustStore
+	journal    *journal
+	outbox     *outbox
+	scheduler  *scheduler
+	// longPoll is how long the server may hold a request for the next task
+	longPoll time.Duration
+	// running tracks the tasks started by pull
+	running sync.WaitGroup
+	// wake is signalled when the server lets the client know tasks are
+	// available
+	wake chan struct{}
+
+	mu sync.Mutex
+	// tasks are the tasks received and not finished yet, so they can be
+	// cancelled
+	tasks map[models.JobID]*runningTask
+
+	stopOutbox func()
+	outboxDone chan struct{}
+}
+
+// outboxDrainTimeout is how long the client keeps trying to send the status
+// updates waiting in the outbox when it exits. Updates that could not be
+// sent are sent when it starts again.
+const outboxDrainTimeout = 30 * time.Second
 
-	client := foodtruckhttp.NewClient(config.BaseURL, config.Node, authProvider, sslNoVerify)
-	runner := provider.NewExecRunner()
+// start starts delivering status updates, beginning with the final statuses
+// in the journal the server never acknowledged
+func (r *taskRunner) start() {
+	r.outbox.onDone = func(status models.NodeTaskStatus) {
+		if !status.Status.IsFinal() {
+			return
+		}
+		if err := r.journal.record(status.JobID, journalAcknowledged, nil); err != nil {
+			fmt.Printf("[Error] failed to write journal: %s\n", err)
+		}
+	}
+	for _, status := range r.journal.unreported() {
+		fmt.Printf("Reporting the %s status of task %s\n", status.Status, status.JobID)
+		r.report(status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stopOutbox = cancel
+	r.outboxDone = make(chan struct{})
+	go func() {
+		defer close(r.outboxDone)
+		r.outbox.run(ctx)
+	}()
+}
+
+// stop stops delivering status updates in the background, and then tries to
+// send the ones still waiting for up to outboxDrainTimeout
+func (r *taskRunner) stop() {
+	r.stopOutbox()
+	<-r.outboxDone
+
+	if r.outbox.pending() == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), outboxDrainTimeout)
+	defer cancel()
+	if !r.outbox.deliver(ctx) {
+		fmt.Printf("[Error] %d status updates could not be sent, they will be sent when the client starts again\n",
+			r.outbox.pending())
+	}
+}
+
+func (r *taskRunner) nextTaskRequest() (models.NextTaskRequest, error) {
+	providers, err := r.runner.Providers()
+	if err != nil {
+		return models.NextTaskRequest{}, fmt.Errorf("failed to list providers: %w", err)
+	}
+	return models.NextTaskRequest{Providers: providers}, nil
+}
+
+// checkTask makes sure the client will run task, and returns its spec with
+// the secrets unwrapped. If the task must be refused, the reason is returned
+// as an error.
+func (r *taskRunner) checkTask(task models.NodeTask) (json.RawMessage, error) {
+	if r.trustStore != nil {
+		if err := r.trustStore.Verify(task); err != nil {
+			return nil, fmt.Errorf("signature verification failed: %s", err)
+		}
+	}
+
+	if err := models.ValidateTaskEnv(task.Env); err != nil {
+		return nil, err
+	}
+
+	spec, err := secrets.Unwrap(task.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secrets in spec: %s", err)
+	}
+	return spec, nil
+}
+
+// pullResult is why pull stopped asking for tasks
+type pullResult int
+
+const (
+	// pullEmpty means the server had no task for the node
+	pullEmpty pullResult = iota
+	// pullWaited means the server had no task for the node after holding
+	// the request, so it can be asked again right away
+	pullWaited
+	// pullFull means the client has no free slot, and more tasks may be
+	// waiting
+	pullFull
+)
+
+// pull fetches the node's tasks and starts running them in the background
+// for as long as the client has free slots and the server has tasks. It also
+// returns how long the server asked the client to wait before asking again,
+// if it did.
+func (r *taskRunner) pull(ctx context.Context, taskCtx context.Context) (pullResult, time.Duration, error) {
 	for {
-		select {
-		case <-ctx.Done():
-			break
-		case <-time.After(time.Duration(config.Interval)):
-			task, err := client.GetNextTask(ctx)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "[Error]: %s\n", err)
-				continue
-			}
-			fmt.Println("Running task")
-			err = client.UpdateNodeTaskStatus(ctx, models.NodeTaskStatus{
-				JobID:  task.JobID,
-				Status: models.TaskStatusRunning,
-			})
-			if err != nil {
-				fmt.Printf("[Error] %s\n", err)
-			}
+		busy, ok := r.scheduler.free()
+		if !ok {
+			return pullFull, 0, nil
+		}
+		req, err := r.nextTaskRequest()
+		if err != nil {
+			return pullEmpty, 0, err
+		}
+		req.BusyProviders = busy
 
-			taskStatus := models.NodeTaskStatus{
-				JobID:  task.JobID,
-				Result: &models.NodeTaskStatusResult{},
-			}
-			if err := runner.Run(ctx, task.Provider, task.Spec); err != nil {
-				fmt.Printf("[Error] %s\n", err)
-				taskStatus.Status = models.TaskStatusFailed
-				exitErr := &exec.ExitError{}
-				if errors.As(err, &exitErr) {
-					taskStatus.Result.Reason = "exit error"
-					taskStatus.Result.ExitCode = -1
-					if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-						taskStatus.Result.ExitCode = status.ExitStatus()
-					}
-				} else {
-					taskStatus.Result.Reason = err.Error()
-					taskStatus.Result.ExitCode = -1
-				}
-			} else {
-				fmt.Println("Task complete")
-				taskStatus.Status = models.TaskStatusSuccess
-				taskStatus.Result.ExitCode = 0
+		var task models.NodeTask
+		longPoll := false
+		// Waiting for a task would hold back the tasks of busy providers
+		// once they are free again
+		if wait := r.longPollWait(); wait > 0 && len(busy) == 0 {
+			task, longPoll, err = r.client.WaitForNextTask(ctx, req, wait)
+		} else {
+			task, err = r.client.GetNextTask(ctx, req)
+		}
+		retryAfter := retryAfter(err)
+		if errors.Is(err, models.ErrNoTasks) {
+			// The server may ask a client that waited to wait some more
+			if longPoll && retryAfter == 0 {
+				return pullWaited, 0, nil
 			}
+			return pullEmpty, retryAfter, nil
+		}
+		if err != nil {
+			return pullEmpty, retryAfter, err
+		}
+
+		sl := r.scheduler.admit(task)
+		r.running.Add(1)
+		go func() {
+			defer r.running.Done()
+			r.runTask(ctx, taskCtx, task, sl)
+		}()
+	}
+}
+
+// waitToPull waits until the client should ask for tasks again after pull
+// returned result: after wait, right away if the server held the last
+// request, as soon as a task finishes if the client had no free slot, or when
+// the server pushes that tasks are available. It returns false once ctx is
+// done.
+func (r *taskRunner) waitToPull(ctx context.Context, result pullResult, wait time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var released <-chan struct{}
+	switch result {
+	case pullWaited:
+		return true
+	case pullFull:
+		released = r.scheduler.releasedChan()
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait):
+	case <-released:
+	case <-r.wake:
+	}
+	return true
+}
+
+// runNext runs the next task of the node and returns the final status
+// reported for it. models.ErrNoTasks is returned if there is no task to run.
+func (r *taskRunner) runNext(ctx context.Context, taskCtx context.Context) (models.NodeTaskStatus, error) {
+	req, err := r.nextTaskRequest()
+	if err != nil {
+		return models.NodeTaskStatus{}, err
+	}
+	task, err := r.client.GetNextTask(ctx, req)
+	if err != nil {
+		return models.NodeTaskStatus{}, err
+	}
+	return r.runTask(ctx, taskCtx, task, r.scheduler.admit(task)), nil
+}
+
+// runTask runs a task once its slot lets it start, and returns the final
+// status reported for it. The task waits for its slot with ctx and runs with
+// taskCtx, so the client can stop taking tasks without interrupting the ones
+// that are running. If either is done before the task finishes, it is
+// reported as interrupted. If the server cancels the task first, it is
+// stopped and reported as cancelled.
+func (r *taskRunner) runTask(ctx context.Context, taskCtx context.Context, task models.NodeTask,
+	sl *slot) models.NodeTaskStatus {
+	defer sl.release()
+
+	waitCtx, cancelWait := context.WithCancel(ctx)
+	defer cancelWait()
+	runCtx, cancelRun := context.WithCancel(taskCtx)
+	defer cancelRun()
+	rt := r.track(task.JobID, func() {
+		cancelWait()
+		cancelRun()
+	})
+	defer r.untrack(task.JobID)
 
-			err = client.UpdateNodeTaskStatus(ctx, taskStatus)
-			if err != nil {
-				fmt.Printf("[Error] %s\n", err)
+	if entry, ok := r.journal.get(task.JobID); ok {
+		fmt.Printf("[Warning] Task %s was already received, not running it again\n", task.JobID)
+		if entry.Status != nil {
+			r.report(*entry.Status)
+			return *entry.Status
+		}
+		return models.NodeTaskStatus{JobID: task.JobID, Status: models.TaskStatusRunning}
+	}
+	if err := r.journal.record(task.JobID, journalReceived, nil); err != nil {
+		return r.finish(refuseTask(task, fmt.Sprintf("failed to write journal: %s", err)))
+	}
+
+	spec, err := r.checkTask(task)
+	if err != nil {
+		return r.finish(refuseTask(task, err.Error()))
+	}
+
+	if err := sl.start(waitCtx); err != nil {
+		if rt.isCancelled() {
+			fmt.Printf("Task %s was cancelled before it started\n", task.JobID)
+			return r.finish(cancelledStatus(task))
+		}
+		fmt.Printf("[Warning] Task %s was not started before the client stopped\n", task.JobID)
+		return r.finish(models.NodeTaskStatus{
+			JobID:  task.JobID,
+			Status: models.TaskStatusInterrupted,
+			Result: &models.NodeTaskStatusResult{
+				ExitCode: -1,
+				Reason:   models.ReasonClientShutdown,
+			},
+		})
+	}
+
+	if err := r.journal.record(task.JobID, journalStarted, nil); err != nil {
+		return r.finish(refuseTask(task, fmt.Sprintf("failed to write journal: %s", err)))
+	}
+
+	fmt.Printf("Running task %s\n", task.JobID)
+	r.report(models.NodeTaskStatus{
+		JobID:  task.JobID,
+		Status: models.TaskStatusRunning,
+	})
+
+	taskStatus := models.NodeTaskStatus{
+		JobID:  task.JobID,
+		Result: &models.NodeTaskStatusResult{},
+	}
+	outputs, err := r.runner.Run(runCtx, task.Provider, spec,
+		provider.WithProgressFunc(progressReporter(r, task.JobID)),
+		provider.WithEnv(taskEnv(r.node, task)),
+		provider.WithTaskRunAs(task.RunAs),
+		provider.WithTaskLimits(task.Limits))
+	outputs.Apply(taskStatus.Result)
+	if err != nil {
+		fmt.Printf("[Error] %s\n", err)
+		taskStatus.Status = models.TaskStatusFailed
+		exitErr := &exec.ExitError{}
+		limitErr := &provider.LimitError{}
+		if rt.isCancelled() {
+			fmt.Printf("Task %s cancelled\n", task.JobID)
+			taskStatus.Status = models.TaskStatusCancelled
+			taskStatus.Result.ExitCode = -1
+		} else if taskCtx.Err() != nil {
+			taskStatus.Status = models.TaskStatusInterrupted
+			taskStatus.Result.Reason = models.ReasonClientShutdown
+			taskStatus.Result.ExitCode = -1
+		} else if errors.As(err, &limitErr) {
+			taskStatus.Result.Reason = limitErr.Reason
+			taskStatus.Result.ExitCode = -1
+		} else if errors.As(err, &exitErr) {
+			taskStatus.Result.Reason = "exit error"
+			taskStatus.Result.ExitCode = -1
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				taskStatus.Result.ExitCode = status.ExitStatus()
 			}
+		} else if errors.Is(err, provider.ErrProviderNotFound) {
+			taskStatus.Result.Reason = models.ReasonProviderMissing
+			taskStatus.Result.ExitCode = -1
+		} else {
+			taskStatus.Result.Reason = err.Error()
+			taskStatus.Result.ExitCode = -1
+		}
+	} else {
+		fmt.Printf("Task %s complete\n", task.JobID)
+		taskStatus.Status = models.TaskStatusSuccess
+		taskStatus.Result.ExitCode = 0
+	}
+
+	return r.finish(taskStatus)
+}
+
+// finish records the final status of a task in the journal and reports it
+func (r *taskRunner) finish(status models.NodeTaskStatus) models.NodeTaskStatus {
+	if err := r.journal.record(status.JobID, journalFinished, &status); err != nil {
+		fmt.Printf("[Error] failed to write journal: %s\n", err)
+	}
+	r.report(status)
+	return status
+}
+
+// report queues a status update to be sent to the server. Once the server
+// accepts a final status, it is recorded as acknowledged in the journal.
+func (r *taskRunner) report(status models.NodeTaskStatus) {
+	if err := r.outbox.enqueue(status); err != nil {
+		fmt.Printf("[Error] failed to write outbox: %s\n", err)
+	}
+}
 
+// dryRun writes the next task of the node to w without running or dequeuing
+// it, along with whether the client would refuse it. Secrets in the spec are
+// redacted since the output often ends up in terminals and logs.
+func (r *taskRunner) dryRun(ctx context.Context, w io.Writer) error {
+	req, err := r.nextTaskRequest()
+	if err != nil {
+		return err
+	}
+	task, err := r.client.PeekNextTask(ctx, req)
+	if errors.Is(err, models.ErrNoTasks) {
+		fmt.Fprintln(w, "No tasks available")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	printed := task
+	if printed.Spec, err = secrets.Redact(task.Spec); err != nil {
+		return err
+	}
+	d, err := json.MarshalIndent(printed, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", d)
+	if _, err := r.checkTask(task); err != nil {
+		fmt.Fprintf(w, "The task would be refused: %s\n", err)
+	}
+	return nil
+}
+
+// exitCode returns the exit code for the client after running a task: the
+// exit code of the task, or 1 if it failed without one
+func exitCode(status models.NodeTaskStatus) int {
+	if status.Status == models.TaskStatusSuccess {
+		return 0
+	}
+	if status.Result != nil && status.Result.ExitCode > 0 {
+		return status.Result.ExitCode
+	}
+	return 1
+}
+
+// taskEnv returns the environment variables set for a task's provider: the
+// variables from the task and the ones describing the task
+func taskEnv(node models.Node, task models.NodeTask) map[string]string {
+	env := map[string]string{}
+	for k, v := range task.Env {
+		env[k] = v
+	}
+	env["FOODTRUCK_JOB_ID"] = task.JobID
+	env["FOODTRUCK_PROVIDER"] = task.Provider
+	env["FOODTRUCK_NODE_ORG"] = node.Organization
+	env["FOODTRUCK_NODE_NAME"] = node.Name
+	return env
+}
+
+// progressReportInterval is the shortest time between progress updates sent
+// to the server for a task
+const progressReportInterval = 5 * time.Second
+
+// progressReporter returns a provider.ProgressFunc that reports the progress
+// of a task to the server as a running status. Updates are rate limited so a
+// chatty provider does not flood the server, but completion is always sent.
+func progressReporter(r *taskRunner, jobID models.JobID) provider.ProgressFunc {
+	var lastReport time.Time
+	lastPercent := -1
+	return func(percent int, message string) {
+		if message != "" {
+			fmt.Printf("Progress %d%%: %s\n", percent, message)
+		}
+		if percent == lastPercent {
+			return
+		}
+		if percent < 100 && time.Since(lastReport) < progressReportInterval {
+			return
 		}
+		lastReport = time.Now()
+		lastPercent = percent
+		r.report(models.NodeTaskStatus{
+			JobID:  jobID,
+			Status: models.TaskStatusRunning,
+			Result: &models.NodeTaskStatusResult{
+				Progress: percent,
+			},
+		})
+	}
+}
+
+// refuseTask returns the failed status of a task the client will not run
+func refuseTask(task models.NodeTask, reason string) models.NodeTaskStatus {
+	fmt.Printf("[Error] Refusing task %s: %s\n", task.JobID, reason)
+	return models.NodeTaskStatus{
+		JobID:  task.JobID,
+		Status: models.TaskStatusFailed,
+		Result: &models.NodeTaskStatusResult{
+			ExitCode: -1,
+			Reason:   reason,
+		},
 	}
 }
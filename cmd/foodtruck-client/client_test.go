@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/foodtruckhttp"
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/chef/foodtruck/pkg/provider"
+	"github.com/chef/foodtruck/pkg/secrets"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer records the requests made by the client and responds to
+// /tasks/next and /tasks/peek with the given task, or with the queued tasks
+// one at a time
+type fakeServer struct {
+	task     *models.NodeTask
+	queue    []models.NodeTask
+	paths    []string
+	requests []models.NextTaskRequest
+	statuses []models.NodeTaskStatus
+	// longPoll makes the server answer as if it supported long polling
+	longPoll bool
+	// retryAfter is sent as the Retry-After header when there is no task
+	retryAfter string
+	mu         sync.Mutex
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths = append(s.paths, r.URL.Path)
+	switch filepath.Base(r.URL.Path) {
+	case "next", "peek":
+		req := models.NextTaskRequest{}
+		json.NewDecoder(r.Body).Decode(&req) // nolint: errcheck
+		s.requests = append(s.requests, req)
+		if s.longPoll {
+			w.Header().Set(models.LongPollHeader, "30")
+		}
+		task := s.task
+		if len(s.queue) > 0 {
+			task = &s.queue[0]
+			s.queue = s.queue[1:]
+		}
+		if task == nil {
+			if s.retryAfter != "" {
+				w.Header().Set("Retry-After", s.retryAfter)
+			}
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(task) // nolint: errcheck
+	case "status":
+		status := models.NodeTaskStatus{}
+		json.NewDecoder(r.Body).Decode(&status) // nolint: errcheck
+		s.statuses = append(s.statuses, status)
+		w.Write([]byte("{}")) // nolint: errcheck
+	}
+}
+
+func newTestTaskRunner(t *testing.T, s *fakeServer) *taskRunner {
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	dir, err := ioutil.TempDir("", "foodtruck-providers")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	j, err := openJournal(filepath.Join(dir, "journal.json"))
+	require.NoError(t, err)
+
+	node := models.Node{Organization: "org", Name: "node"}
+	client := foodtruckhttp.NewClient(server.URL, node, &foodtruckhttp.ApiKeyAuthProvider{Key: "key"})
+	o, err := openOutbox(filepath.Join(dir, "outbox.json"), client.UpdateNodeTaskStatus)
+	require.NoError(t, err)
+
+	opts := []provider.ExecRunnerOpt{provider.WithProvidersPath(dir), provider.WithAllowedProviders([]string{"shell"})}
+	return &taskRunner{
+		node:      node,
+		client:    client,
+		runner:    provider.NewChainRunner(provider.NewBuiltinRunner(opts...), provider.NewExecRunner(opts...)),
+		journal:   j,
+		outbox:    o,
+		scheduler: newScheduler(1, nil),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func TestTaskRunnerRunNext(t *testing.T) {
+	t.Run("reports the exit code of the task", func(t *testing.T) {
+		s := &fakeServer{task: &models.NodeTask{
+			JobID:    "job",
+			Provider: "shell",
+			Spec:     json.RawMessage(`{"command": "exit 3"}`),
+		}}
+		r := newTestTaskRunner(t, s)
+
+		r.start()
+		status, err := r.runNext(context.Background(), context.Background())
+		r.stop()
+		require.NoError(t, err)
+		require.Equal(t, models.TaskStatusFailed, status.Status)
+		require.Equal(t, 3, exitCode(status))
+		require.Equal(t, models.TaskStatusFailed, s.statuses[len(s.statuses)-1].Status)
+	})
+
+	t.Run("reports tasks terminated on shutdown as interrupted", func(t *testing.T) {
+		s := &fakeServer{task: &models.NodeTask{
+			JobID:    "job",
+			Provider: "shell",
+			Spec:     json.RawMessage(`{"command": "sleep 10"}`),
+		}}
+		r := newTestTaskRunner(t, s)
+
+		taskCtx, terminate := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, terminate)
+		r.start()
+		status, err := r.runNext(context.Background(), taskCtx)
+		r.stop()
+		require.NoError(t, err)
+		require.Equal(t, models.TaskStatusInterrupted, status.Status)
+		require.Equal(t, models.ReasonClientShutdown, status.Result.Reason)
+		require.Equal(t, models.TaskStatusInterrupted, s.statuses[len(s.statuses)-1].Status)
+	})
+
+	t.Run("reports tasks cancelled by the server as cancelled", func(t *testing.T) {
+		s := &fakeServer{task: &models.NodeTask{
+			JobID:    "job",
+			Provider: "shell",
+			Spec:     json.RawMessage(`{"command": "sleep 10"}`),
+		}}
+		r := newTestTaskRunner(t, s)
+
+		go func() {
+			for !r.cancelTask("job") {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+		r.start()
+		status, err := r.runNext(context.Background(), context.Background())
+		r.stop()
+		require.NoError(t, err)
+		require.Equal(t, models.TaskStatusCancelled, status.Status)
+		require.Equal(t, models.TaskStatusCancelled, s.statuses[len(s.statuses)-1].Status)
+		require.False(t, r.cancelTask("job"), "finished tasks are forgotten")
+	})
+
+	t.Run("does not run a task twice", func(t *testing.T) {
+		s := &fakeServer{task: &models.NodeTask{
+			JobID:    "job",
+			Provider: "shell",
+			Spec:     json.RawMessage(`{"command": "true"}`),
+		}}
+		r := newTestTaskRunner(t, s)
+
+		r.start()
+		first, err := r.runNext(context.Background(), context.Background())
+		r.stop()
+		require.NoError(t, err)
+		require.Equal(t, models.TaskStatusSuccess, first.Status)
+
+		s.statuses = nil
+		r.start()
+		second, err := r.runNext(context.Background(), context.Background())
+		r.stop()
+		require.NoError(t, err)
+		require.Equal(t, first, second)
+		require.Len(t, s.statuses, 1, "only the final status is reported again")
+		require.Equal(t, models.TaskStatusSuccess, s.statuses[0].Status)
+	})
+
+	t.Run("reports statuses of tasks interrupted by a restart", func(t *testing.T) {
+		s := &fakeServer{}
+		r := newTestTaskRunner(t, s)
+		require.NoError(t, r.journal.record("crashed", journalStarted, nil))
+		require.NoError(t, r.journal.recover())
+
+		r.start()
+		r.stop()
+		require.Len(t, s.statuses, 1)
+		require.Equal(t, "crashed", s.statuses[0].JobID)
+		require.Equal(t, models.TaskStatusInterrupted, s.statuses[0].Status)
+		require.Equal(t, models.ReasonClientRestarted, s.statuses[0].Result.Reason)
+		require.Empty(t, r.journal.unreported())
+	})
+
+	t.Run("returns ErrNoTasks without a task", func(t *testing.T) {
+		r := newTestTaskRunner(t, &fakeServer{})
+
+		_, err := r.runNext(context.Background(), context.Background())
+		require.True(t, errors.Is(err, models.ErrNoTasks))
+	})
+}
+
+func TestTaskRunnerPull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "foodtruck-pull")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Each task waits for the other one to start, so they only finish if
+	// they run at the same time
+	waitFor := func(mine, other string) json.RawMessage {
+		cmd := fmt.Sprintf("touch %s; while [ ! -f %s ]; do sleep 0.01; done",
+			filepath.Join(dir, mine), filepath.Join(dir, other))
+		d, err := json.Marshal(map[string]string{"command": cmd})
+		require.NoError(t, err)
+		return d
+	}
+	s := &fakeServer{queue: []models.NodeTask{
+		{JobID: "a", Provider: "shell", Spec: waitFor("a", "b")},
+		{JobID: "b", Provider: "shell", Spec: waitFor("b", "a")},
+	}}
+	r := newTestTaskRunner(t, s)
+	r.scheduler = newScheduler(3, map[string]int{"shell": 2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r.start()
+	result, _, err := r.pull(ctx, ctx)
+	require.NoError(t, err)
+	require.Equal(t, pullEmpty, result)
+	r.running.Wait()
+	r.stop()
+
+	require.NoError(t, ctx.Err(), "the tasks did not run at the same time")
+	require.Len(t, s.requests, 3)
+	require.Empty(t, s.requests[1].BusyProviders)
+	require.Equal(t, []string{"shell"}, s.requests[2].BusyProviders)
+	for _, status := range s.statuses[len(s.statuses)-2:] {
+		require.Equal(t, models.TaskStatusSuccess, status.Status)
+	}
+
+	t.Run("asks again right away after a long poll", func(t *testing.T) {
+		s := &fakeServer{longPoll: true}
+		r := newTestTaskRunner(t, s)
+		r.longPoll = 20 * time.Second
+
+		result, _, err := r.pull(context.Background(), context.Background())
+		require.NoError(t, err)
+		require.Equal(t, pullWaited, result)
+		require.Equal(t, 20, s.requests[0].Wait)
+		require.True(t, r.waitToPull(context.Background(), result, time.Hour))
+	})
+
+	t.Run("waits as long as the server asks after a long poll", func(t *testing.T) {
+		s := &fakeServer{longPoll: true, retryAfter: "30"}
+		r := newTestTaskRunner(t, s)
+		r.longPoll = 20 * time.Second
+
+		result, retryAfter, err := r.pull(context.Background(), context.Background())
+		require.NoError(t, err)
+		require.Equal(t, pullEmpty, result)
+		require.Equal(t, 30*time.Second, retryAfter)
+	})
+
+	t.Run("falls back to the interval on older servers", func(t *testing.T) {
+		s := &fakeServer{}
+		r := newTestTaskRunner(t, s)
+		r.longPoll = 20 * time.Second
+
+		result, _, err := r.pull(context.Background(), context.Background())
+		require.NoError(t, err)
+		require.Equal(t, pullEmpty, result)
+	})
+
+	t.Run("asks again when the server pushes that tasks are available", func(t *testing.T) {
+		r := newTestTaskRunner(t, &fakeServer{})
+
+		r.handleEvent(models.NodeEvent{Type: models.NodeEventTaskAvailable})
+		r.handleEvent(models.NodeEvent{Type: models.NodeEventTaskAvailable})
+		require.True(t, r.waitToPull(context.Background(), pullEmpty, time.Hour))
+	})
+
+	t.Run("stops when there is no free slot", func(t *testing.T) {
+		s := &fakeServer{queue: []models.NodeTask{
+			{JobID: "exclusive", Provider: "shell", Spec: json.RawMessage(`{"command": "true"}`), Exclusive: true},
+		}}
+		r := newTestTaskRunner(t, s)
+		r.scheduler = newScheduler(3, nil)
+
+		r.start()
+		result, _, err := r.pull(context.Background(), context.Background())
+		r.running.Wait()
+		r.stop()
+		require.NoError(t, err)
+		require.Equal(t, pullFull, result)
+		require.Len(t, s.requests, 1)
+	})
+}
+
+func TestTaskRunnerDryRun(t *testing.T) {
+	s := &fakeServer{task: &models.NodeTask{
+		JobID:    "job",
+		Provider: "shell",
+		Spec:     json.RawMessage(`{"command": "exit 3"}`),
+		Env:      map[string]string{"FOODTRUCK_JOB_ID": "other"},
+	}}
+	r := newTestTaskRunner(t, s)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, r.dryRun(context.Background(), out))
+	require.Contains(t, out.String(), `"job_id": "job"`)
+	require.Contains(t, out.String(), "would be refused")
+	require.Equal(t, []string{"/organizations/org/foodtruck/nodes/node/tasks/peek"}, s.paths)
+	require.Empty(t, s.statuses)
+
+	t.Run("redacts secrets", func(t *testing.T) {
+		s.task.Spec = json.RawMessage(`{"command": "deploy", "token": {"$secret": "a-download-token"}}`)
+
+		out := &bytes.Buffer{}
+		require.NoError(t, r.dryRun(context.Background(), out))
+		require.NotContains(t, out.String(), "a-download-token")
+		require.Contains(t, out.String(), secrets.Redacted)
+	})
+}
+
+func TestExitCode(t *testing.T) {
+	require.Equal(t, 0, exitCode(models.NodeTaskStatus{Status: models.TaskStatusSuccess,
+		Result: &models.NodeTaskStatusResult{}}))
+	require.Equal(t, 2, exitCode(models.NodeTaskStatus{Status: models.TaskStatusFailed,
+		Result: &models.NodeTaskStatusResult{ExitCode: 2}}))
+	require.Equal(t, 1, exitCode(models.NodeTaskStatus{Status: models.TaskStatusFailed,
+		Result: &models.NodeTaskStatusResult{ExitCode: -1}}))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/foodtruckhttp"
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+// watchEvents handles the events the server pushes to the node until ctx is
+// done. If the server does not support push, the client long polls for up to
+// longPoll instead.
+func (r *taskRunner) watchEvents(ctx context.Context, longPoll time.Duration) {
+	err := r.client.WatchEvents(ctx, r.handleEvent, func(err error, retryIn time.Duration) {
+		fmt.Fprintf(os.Stderr, "[Error]: lost the connection to the server, reconnecting in %s: %s\n",
+			retryIn.Round(time.Millisecond), err)
+	})
+	if errors.Is(err, foodtruckhttp.ErrEventsUnsupported) {
+		fmt.Fprintf(os.Stderr, "[Warning]: the server does not support push, polling for tasks instead\n")
+		r.setLongPoll(longPoll)
+	}
+}
+
+// handleEvent wakes up the client when tasks are available, and stops the
+// tasks the server cancels
+func (r *taskRunner) handleEvent(event models.NodeEvent) {
+	switch event.Type {
+	case models.NodeEventTaskAvailable:
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	case models.NodeEventCancel:
+		if r.cancelTask(event.JobID) {
+			fmt.Printf("Cancelling task %s\n", event.JobID)
+		}
+	}
+}
+
+func (r *taskRunner) longPollWait() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.longPoll
+}
+
+func (r *taskRunner) setLongPoll(wait time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.longPoll = wait
+}
+
+// runningTask is a task received and not finished yet
+type runningTask struct {
+	cancel    func()
+	cancelled int32
+}
+
+func (t *runningTask) isCancelled() bool {
+	return atomic.LoadInt32(&t.cancelled) == 1
+}
+
+// track keeps the function cancelling a task until untrack is called
+func (r *taskRunner) track(jobID models.JobID, cancel func()) *runningTask {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tasks == nil {
+		r.tasks = map[models.JobID]*runningTask{}
+	}
+	t := &runningTask{cancel: cancel}
+	r.tasks[jobID] = t
+	return t
+}
+
+func (r *taskRunner) untrack(jobID models.JobID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tasks, jobID)
+}
+
+// cancelTask stops a task if it is waiting to start or running. It returns
+// false if the client has no such task, which is the case when the server
+// sends a cancellation again.
+func (r *taskRunner) cancelTask(jobID models.JobID) bool {
+	r.mu.Lock()
+	t, ok := r.tasks[jobID]
+	r.mu.Unlock()
+	if !ok || !atomic.CompareAndSwapInt32(&t.cancelled, 0, 1) {
+		return false
+	}
+	t.cancel()
+	return true
+}
+
+// cancelledStatus is the status of a task the server cancelled before it
+// started
+func cancelledStatus(task models.NodeTask) models.NodeTaskStatus {
+	return models.NodeTaskStatus{
+		JobID:  task.JobID,
+		Status: models.TaskStatusCancelled,
+		Result: &models.NodeTaskStatusResult{ExitCode: -1},
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+// journalState is how far the client got with a task
+type journalState string
+
+const (
+	// journalReceived is recorded when a task is dequeued, before it runs
+	journalReceived journalState = "received"
+	// journalStarted is recorded right before the provider is started
+	journalStarted journalState = "started"
+	// journalFinished is recorded with the final status of the task before
+	// it is reported to the server
+	journalFinished journalState = "finished"
+	// journalAcknowledged is recorded once the server accepted the final
+	// status of the task
+	journalAcknowledged journalState = "acknowledged"
+)
+
+// maxAcknowledgedEntries is how many acknowledged tasks the journal keeps so
+// that a task sent again by the server is not run twice
+const maxAcknowledgedEntries = 100
+
+type journalEntry struct {
+	JobID   models.JobID           `json:"job_id"`
+	State   journalState           `json:"state"`
+	Status  *models.NodeTaskStatus `json:"status,omitempty"`
+	Updated time.Time              `json:"updated"`
+}
+
+// journal records the progress of the node's tasks on disk, so that after a
+// crash or reboot the client can report what happened to a task and never
+// runs a task twice. The file is replaced atomically each time an entry is
+// recorded.
+type journal struct {
+	path string
+
+	mu      sync.Mutex
+	entries []journalEntry
+}
+
+// openJournal loads the journal at path, or starts an empty one if it does
+// not exist yet
+func openJournal(path string) (*journal, error) {
+	j := &journal{path: path}
+	d, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(d, &j.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse journal %s: %w", path, err)
+	}
+	return j, nil
+}
+
+// get returns the entry for a job if the journal has one
+func (j *journal) get(jobID models.JobID) (journalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, e := range j.entries {
+		if e.JobID == jobID {
+			return e, true
+		}
+	}
+	return journalEntry{}, false
+}
+
+// record moves a job to state, keeping its final status if one is given,
+// and saves the journal
+func (j *journal) record(jobID models.JobID, state journalState, status *models.NodeTaskStatus) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry := journalEntry{JobID: jobID}
+	entries := make([]journalEntry, 0, len(j.entries)+1)
+	for _, e := range j.entries {
+		if e.JobID == jobID {
+			entry = e
+			continue
+		}
+		entries = append(entries, e)
+	}
+	entry.State = state
+	entry.Updated = time.Now().UTC()
+	if status != nil {
+		entry.Status = status
+	}
+	entries = trimAcknowledged(append(entries, entry))
+
+	if err := j.save(entries); err != nil {
+		return err
+	}
+	j.entries = entries
+	return nil
+}
+
+// recover marks the tasks that were received or started but never finished,
+// because the client stopped while they ran, as interrupted. It must be
+// called before any task is run.
+func (j *journal) recover() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := make([]journalEntry, len(j.entries))
+	copy(entries, j.entries)
+	changed := false
+	for i, e := range entries {
+		if e.State != journalReceived && e.State != journalStarted {
+			continue
+		}
+		entries[i].State = journalFinished
+		entries[i].Updated = time.Now().UTC()
+		entries[i].Status = &models.NodeTaskStatus{
+			JobID:  e.JobID,
+			Status: models.TaskStatusInterrupted,
+			Result: &models.NodeTaskStatusResult{
+				ExitCode: -1,
+				Reason:   models.ReasonClientRestarted,
+			},
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	if err := j.save(entries); err != nil {
+		return err
+	}
+	j.entries = entries
+	return nil
+}
+
+// unreported returns the final statuses that have not been acknowledged by
+// the server, oldest first
+func (j *journal) unreported() []models.NodeTaskStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var statuses []models.NodeTaskStatus
+	for _, e := range j.entries {
+		if e.State == journalFinished && e.Status != nil {
+			statuses = append(statuses, *e.Status)
+		}
+	}
+	return statuses
+}
+
+func (j *journal) save(entries []journalEntry) error {
+	d, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.path, d, 0600)
+}
+
+// trimAcknowledged drops the oldest acknowledged entries beyond
+// maxAcknowledgedEntries
+func trimAcknowledged(entries []journalEntry) []journalEntry {
+	acknowledged := 0
+	for _, e := range entries {
+		if e.State == journalAcknowledged {
+			acknowledged++
+		}
+	}
+	trimmed := entries[:0]
+	for _, e := range entries {
+		if e.State == journalAcknowledged && acknowledged > maxAcknowledgedEntries {
+			acknowledged--
+			continue
+		}
+		trimmed = append(trimmed, e)
+	}
+	return trimmed
+}
+
+// writeFileAtomic replaces the file at path with data so that a crash leaves
+// either the old or the new content, never a mix of both
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable. Directories cannot be synced on every
+	// platform, so failing to is not an error.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
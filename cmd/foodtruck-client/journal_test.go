@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "foodtruck-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", "journal.json")
+
+	j, err := openJournal(path)
+	require.NoError(t, err)
+	require.NoError(t, j.record("received", journalReceived, nil))
+	require.NoError(t, j.record("started", journalStarted, nil))
+	finished := models.NodeTaskStatus{JobID: "finished", Status: models.TaskStatusSuccess,
+		Result: &models.NodeTaskStatusResult{}}
+	require.NoError(t, j.record("finished", journalFinished, &finished))
+	require.NoError(t, j.record("acknowledged", journalFinished, &finished))
+	require.NoError(t, j.record("acknowledged", journalAcknowledged, nil))
+
+	t.Run("keeps entries across restarts", func(t *testing.T) {
+		j, err := openJournal(path)
+		require.NoError(t, err)
+
+		entry, ok := j.get("acknowledged")
+		require.True(t, ok)
+		require.Equal(t, journalAcknowledged, entry.State)
+		require.Equal(t, models.TaskStatusSuccess, entry.Status.Status)
+		require.Equal(t, []models.NodeTaskStatus{finished}, j.unreported())
+	})
+
+	t.Run("marks unfinished tasks as interrupted on recovery", func(t *testing.T) {
+		j, err := openJournal(path)
+		require.NoError(t, err)
+		require.NoError(t, j.recover())
+
+		unreported := j.unreported()
+		require.Len(t, unreported, 3)
+		require.Equal(t, "received", unreported[0].JobID)
+		require.Equal(t, "started", unreported[1].JobID)
+		for _, status := range unreported[:2] {
+			require.Equal(t, models.TaskStatusInterrupted, status.Status)
+			require.Equal(t, models.ReasonClientRestarted, status.Result.Reason)
+		}
+
+		j, err = openJournal(path)
+		require.NoError(t, err)
+		require.Len(t, j.unreported(), 3)
+	})
+
+	t.Run("only keeps the most recent acknowledged tasks", func(t *testing.T) {
+		j, err := openJournal(filepath.Join(dir, "trimmed.json"))
+		require.NoError(t, err)
+		require.NoError(t, j.record("unreported", journalFinished, &finished))
+		for i := 0; i < maxAcknowledgedEntries+5; i++ {
+			require.NoError(t, j.record(fmt.Sprintf("job-%d", i), journalAcknowledged, nil))
+		}
+		require.Len(t, j.entries, maxAcknowledgedEntries+1)
+		_, ok := j.get("job-0")
+		require.False(t, ok)
+		_, ok = j.get("unreported")
+		require.True(t, ok)
+	})
+
+	t.Run("rejects a corrupted journal", func(t *testing.T) {
+		corrupted := filepath.Join(dir, "corrupted.json")
+		require.NoError(t, ioutil.WriteFile(corrupted, []byte("{"), 0600))
+		_, err := openJournal(corrupted)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/foodtruckhttp"
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+const (
+	outboxMinBackoff = time.Second
+	outboxMaxBackoff = 5 * time.Minute
+)
+
+type outboxItem struct {
+	Seq    uint64                `json:"seq"`
+	Status models.NodeTaskStatus `json:"status"`
+}
+
+// outbox delivers status updates to the server, retrying with exponential
+// backoff until the server accepts them. Updates waiting to be delivered are
+// kept on disk so they survive a restart. Only the latest update of each task
+// is kept, and an update never replaces a final status.
+type outbox struct {
+	path string
+	send func(ctx context.Context, status models.NodeTaskStatus) error
+	// onDone is called with each update the server accepted, or rejected
+	// in a way sending it again would not fix
+	onDone func(status models.NodeTaskStatus)
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// jitter is only used by deliver, which never runs concurrently
+	jitter *rand.Rand
+
+	mu    sync.Mutex
+	items []outboxItem
+	seq   uint64
+	wake  chan struct{}
+}
+
+// openOutbox loads the updates waiting at path to be sent with send
+func openOutbox(path string, send func(ctx context.Context, status models.NodeTaskStatus) error) (*outbox, error) {
+	o := &outbox{
+		path:       path,
+		send:       send,
+		minBackoff: outboxMinBackoff,
+		maxBackoff: outboxMaxBackoff,
+		jitter:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		wake:       make(chan struct{}, 1),
+	}
+	d, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(d, &o.items); err != nil {
+		return nil, fmt.Errorf("failed to parse outbox %s: %w", path, err)
+	}
+	for _, item := range o.items {
+		if item.Seq > o.seq {
+			o.seq = item.Seq
+		}
+	}
+	return o, nil
+}
+
+// enqueue adds a status update to be delivered. The update is kept in memory
+// even if it cannot be saved to disk.
+func (o *outbox) enqueue(status models.NodeTaskStatus) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	items := make([]outboxItem, 0, len(o.items)+1)
+	for _, item := range o.items {
+		if item.Status.JobID != status.JobID {
+			items = append(items, item)
+			continue
+		}
+		if item.Status.Status.IsFinal() && !status.Status.IsFinal() {
+			return nil
+		}
+	}
+	o.seq++
+	o.items = append(items, outboxItem{Seq: o.seq, Status: status})
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return o.save()
+}
+
+// pending returns the number of updates waiting to be delivered
+func (o *outbox) pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.items)
+}
+
+// run delivers updates as they are added until ctx is done
+func (o *outbox) run(ctx context.Context) {
+	for {
+		if !o.deliver(ctx) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		}
+	}
+}
+
+// deliver sends the waiting updates in order until there are none left,
+// backing off while the server cannot be reached or does not accept the
+// node's credentials. It returns false if ctx was done first.
+func (o *outbox) deliver(ctx context.Context) bool {
+	attempt := 0
+	for {
+		item, ok := o.next()
+		if !ok {
+			return true
+		}
+
+		err := o.send(ctx, item.Status)
+		respErr := &foodtruckhttp.ResponseError{}
+		if err != nil && errors.As(err, &respErr) && respErr.Rejected() {
+			// Sending the update again would fail the same way
+			fmt.Printf("[Error] Dropping the %s status of task %s: %s\n", item.Status.Status, item.Status.JobID, err)
+			err = nil
+		}
+		if err == nil {
+			o.remove(item)
+			if o.onDone != nil {
+				o.onDone(item.Status)
+			}
+			attempt = 0
+			continue
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+
+		attempt++
+		delay := o.backoff(attempt)
+		fmt.Printf("[Error] Failed to send the %s status of task %s, retrying in %s: %s\n", item.Status.Status,
+			item.Status.JobID, delay.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns how long to wait before the given attempt: an exponentially
+// growing delay, of which a random half is used so that nodes that lost
+// their connection together do not retry together
+func (o *outbox) backoff(attempt int) time.Duration {
+	d := o.maxBackoff
+	if attempt < 32 {
+		if exp := o.minBackoff << uint(attempt-1); exp > 0 && exp < d {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(o.jitter.Int63n(int64(d/2)+1))
+}
+
+func (o *outbox) next() (outboxItem, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.items) == 0 {
+		return outboxItem{}, false
+	}
+	return o.items[0], true
+}
+
+// remove removes a delivered update, unless it was replaced by a newer one
+// while it was being sent
+func (o *outbox) remove(delivered outboxItem) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, item := range o.items {
+		if item.Seq == delivered.Seq {
+			o.items = append(o.items[:i:i], o.items[i+1:]...)
+			if err := o.save(); err != nil {
+				fmt.Printf("[Error] failed to write outbox: %s\n", err)
+			}
+			return
+		}
+	}
+}
+
+func (o *outbox) save() error {
+	d, err := json.Marshal(o.items)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.path, d, 0600)
+}
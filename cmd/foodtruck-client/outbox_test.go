@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/foodtruckhttp"
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "foodtruck-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	running := models.NodeTaskStatus{JobID: "job", Status: models.TaskStatusRunning}
+	success := models.NodeTaskStatus{JobID: "job", Status: models.TaskStatusSuccess,
+		Result: &models.NodeTaskStatusResult{}}
+
+	t.Run("retries until the server accepts the update", func(t *testing.T) {
+		var sent []models.NodeTaskStatus
+		failures := 2
+		o, err := openOutbox(filepath.Join(dir, "retries.json"), func(ctx context.Context, status models.NodeTaskStatus) error {
+			if failures > 0 {
+				failures--
+				return errors.New("connection refused")
+			}
+			sent = append(sent, status)
+			return nil
+		})
+		require.NoError(t, err)
+		o.minBackoff = time.Millisecond
+		var delivered []models.NodeTaskStatus
+		o.onDone = func(status models.NodeTaskStatus) {
+			delivered = append(delivered, status)
+		}
+
+		require.NoError(t, o.enqueue(success))
+		require.True(t, o.deliver(context.Background()))
+		require.Equal(t, []models.NodeTaskStatus{success}, sent)
+		require.Equal(t, sent, delivered)
+		require.Equal(t, 0, o.pending())
+	})
+
+	t.Run("keeps updates across restarts", func(t *testing.T) {
+		path := filepath.Join(dir, "restarts.json")
+		o, err := openOutbox(path, nil)
+		require.NoError(t, err)
+		require.NoError(t, o.enqueue(running))
+
+		var sent []models.NodeTaskStatus
+		o, err = openOutbox(path, func(ctx context.Context, status models.NodeTaskStatus) error {
+			sent = append(sent, status)
+			return nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, o.enqueue(models.NodeTaskStatus{JobID: "other", Status: models.TaskStatusRunning}))
+		require.True(t, o.deliver(context.Background()))
+		require.Len(t, sent, 2)
+		require.Equal(t, running, sent[0])
+	})
+
+	t.Run("never replaces a final status", func(t *testing.T) {
+		var sent []models.NodeTaskStatus
+		o, err := openOutbox(filepath.Join(dir, "final.json"), func(ctx context.Context, status models.NodeTaskStatus) error {
+			sent = append(sent, status)
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, o.enqueue(running))
+		require.NoError(t, o.enqueue(success))
+		require.NoError(t, o.enqueue(running))
+		require.True(t, o.deliver(context.Background()))
+		require.Equal(t, []models.NodeTaskStatus{success}, sent)
+	})
+
+	t.Run("drops updates the server rejects", func(t *testing.T) {
+		for _, code := range []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict} {
+			o, err := openOutbox(filepath.Join(dir, "rejected.json"), func(ctx context.Context, status models.NodeTaskStatus) error {
+				return &foodtruckhttp.ResponseError{StatusCode: code}
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, o.enqueue(success))
+			require.True(t, o.deliver(context.Background()))
+			require.Equal(t, 0, o.pending(), "%d", code)
+		}
+	})
+
+	t.Run("retries updates while the node is not authorized", func(t *testing.T) {
+		codes := []int{http.StatusUnauthorized, http.StatusForbidden}
+		var sent []models.NodeTaskStatus
+		o, err := openOutbox(filepath.Join(dir, "unauthorized.json"), func(ctx context.Context, status models.NodeTaskStatus) error {
+			if len(codes) > 0 {
+				code := codes[0]
+				codes = codes[1:]
+				return &foodtruckhttp.ResponseError{StatusCode: code}
+			}
+			sent = append(sent, status)
+			return nil
+		})
+		require.NoError(t, err)
+		o.minBackoff = time.Millisecond
+
+		require.NoError(t, o.enqueue(success))
+		require.True(t, o.deliver(context.Background()))
+		require.Equal(t, []models.NodeTaskStatus{success}, sent)
+	})
+
+	t.Run("stops retrying when the context is done", func(t *testing.T) {
+		o, err := openOutbox(filepath.Join(dir, "cancelled.json"), func(ctx context.Context, status models.NodeTaskStatus) error {
+			return &foodtruckhttp.ResponseError{StatusCode: http.StatusServiceUnavailable}
+		})
+		require.NoError(t, err)
+		o.minBackoff = time.Millisecond
+
+		require.NoError(t, o.enqueue(success))
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		require.False(t, o.deliver(ctx))
+		require.Equal(t, 1, o.pending())
+	})
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := &outbox{minBackoff: time.Second, maxBackoff: time.Minute, jitter: rand.New(rand.NewSource(1))}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		d := o.backoff(attempt + 1)
+		require.True(t, d >= max/2 && d <= max, "attempt %d waits %s", attempt+1, d)
+	}
+	for _, attempt := range []int{7, 40, 1000} {
+		d := o.backoff(attempt)
+		require.True(t, d >= 30*time.Second && d <= time.Minute, "attempt %d waits %s", attempt, d)
+	}
+}
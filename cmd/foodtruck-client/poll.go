@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/foodtruckhttp"
+)
+
+// pollTimer decides how long the client waits before asking for tasks again.
+// Every wait is spread out at random, so that nodes started at the same time,
+// or coming back after the server was down, do not all ask at once.
+type pollTimer struct {
+	interval time.Duration
+	// minInterval and maxInterval bound how long the server may ask the
+	// client to wait
+	minInterval time.Duration
+	maxInterval time.Duration
+}
+
+// next returns how long to wait, given how long the server asked the client
+// to wait, or 0 if it did not. Without a request from the server, the client
+// waits between 3/4 and 5/4 of its interval. Otherwise it waits between 3/4
+// of what the server asked and all of it, since the server may have asked the
+// client to come back when its next task starts. The wait is then kept within
+// the client's bounds, so it is longer than asked when the server asks for
+// less than minInterval, and a task may start up to minInterval late.
+func (p pollTimer) next(retryAfter time.Duration) time.Duration {
+	if retryAfter <= 0 {
+		return p.interval*3/4 + randDuration(p.interval/2)
+	}
+
+	wait := retryAfter - randDuration(retryAfter/4)
+	if wait < p.minInterval {
+		wait = p.minInterval
+	}
+	if p.maxInterval > 0 && wait > p.maxInterval {
+		wait = p.maxInterval
+	}
+	return wait
+}
+
+// randDuration returns a random duration between 0 and max
+func randDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// retryAfter returns how long the server asked the client to wait before
+// asking for tasks again with err, or 0 if it did not
+func retryAfter(err error) time.Duration {
+	retryErr := &foodtruckhttp.RetryAfterError{}
+	if errors.As(err, &retryErr) {
+		return retryErr.RetryAfter
+	}
+	return 0
+}
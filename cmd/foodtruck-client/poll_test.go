@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollTimer(t *testing.T) {
+	p := pollTimer{interval: time.Minute, minInterval: 10 * time.Second, maxInterval: time.Hour}
+
+	for i := 0; i < 100; i++ {
+		wait := p.next(0)
+		require.True(t, wait >= 45*time.Second && wait <= 75*time.Second, "interval with jitter: %s", wait)
+
+		wait = p.next(2 * time.Minute)
+		require.True(t, wait >= 90*time.Second && wait <= 2*time.Minute, "server hint with jitter, never past the hint: %s", wait)
+	}
+
+	require.Equal(t, 10*time.Second, p.next(time.Second), "hints are raised to the min interval")
+	require.Equal(t, time.Hour, p.next(24*time.Hour), "hints are capped at the max interval")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+// scheduler decides how many tasks the client runs at the same time. A task
+// takes a slot when it is received, and starts once its provider is under its
+// cap. An exclusive task only starts once no other task is running, and no
+// task is received while it waits or runs.
+type scheduler struct {
+	maxTasks       int
+	providerLimits map[string]int
+
+	mu sync.Mutex
+	// admitted counts the tasks received, whether they are running or
+	// waiting to start
+	admitted           int
+	admittedByProvider map[string]int
+	started            int
+	startedByProvider  map[string]int
+	// exclusive counts the exclusive tasks received
+	exclusive int
+	released  chan struct{}
+}
+
+// newScheduler returns a scheduler running up to maxTasks tasks at the same
+// time, and up to providerLimits tasks of each provider in it
+func newScheduler(maxTasks int, providerLimits map[string]int) *scheduler {
+	if maxTasks < 1 {
+		maxTasks = 1
+	}
+	return &scheduler{
+		maxTasks:           maxTasks,
+		providerLimits:     providerLimits,
+		admittedByProvider: map[string]int{},
+		startedByProvider:  map[string]int{},
+		released:           make(chan struct{}),
+	}
+}
+
+// free returns whether another task can be received, and the providers
+// whose tasks cannot be because they are at their cap
+func (s *scheduler) free() (busy []string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exclusive > 0 || s.admitted >= s.maxTasks {
+		return nil, false
+	}
+	for provider, limit := range s.providerLimits {
+		if s.admittedByProvider[provider] >= limit {
+			busy = append(busy, provider)
+		}
+	}
+	sort.Strings(busy)
+	return busy, true
+}
+
+// releasedChan returns a channel closed the next time a task gives up its
+// slot
+func (s *scheduler) releasedChan() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.released
+}
+
+// admit takes a slot for a received task. It is taken even if the
+// scheduler is full, so that a task the server sent anyway still runs once
+// there is room for it.
+func (s *scheduler) admit(task models.NodeTask) *slot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.admitted++
+	s.admittedByProvider[task.Provider]++
+	if task.Exclusive {
+		s.exclusive++
+	}
+	return &slot{s: s, task: task}
+}
+
+// slot is a task's place in the scheduler
+type slot struct {
+	s       *scheduler
+	task    models.NodeTask
+	started bool
+}
+
+// start waits until the task may run. It returns ctx.Err() if ctx is done
+// first.
+func (sl *slot) start(ctx context.Context) error {
+	s := sl.s
+	for {
+		s.mu.Lock()
+		if s.canStart(sl.task) {
+			s.started++
+			s.startedByProvider[sl.task.Provider]++
+			sl.started = true
+			s.mu.Unlock()
+			return nil
+		}
+		released := s.released
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+func (s *scheduler) canStart(task models.NodeTask) bool {
+	if limit, ok := s.providerLimits[task.Provider]; ok && s.startedByProvider[task.Provider] >= limit {
+		return false
+	}
+	if s.started >= s.maxTasks {
+		return false
+	}
+	if task.Exclusive {
+		return s.started == 0
+	}
+	// An exclusive task waiting for the running tasks to finish goes first
+	return s.exclusive == 0
+}
+
+// release gives up the slot once the task finished or will not run
+func (sl *slot) release() {
+	s := sl.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.admitted--
+	s.admittedByProvider[sl.task.Provider]--
+	if sl.started {
+		s.started--
+		s.startedByProvider[sl.task.Provider]--
+	}
+	if sl.task.Exclusive {
+		s.exclusive--
+	}
+	close(s.released)
+	s.released = make(chan struct{})
+}
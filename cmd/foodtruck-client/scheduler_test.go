@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerFree(t *testing.T) {
+	s := newScheduler(3, map[string]int{"infra": 1, "shell": 2})
+
+	busy, ok := s.free()
+	require.True(t, ok)
+	require.Empty(t, busy)
+
+	infra := s.admit(models.NodeTask{Provider: "infra"})
+	s.admit(models.NodeTask{Provider: "shell"})
+	busy, ok = s.free()
+	require.True(t, ok)
+	require.Equal(t, []string{"infra"}, busy)
+
+	s.admit(models.NodeTask{Provider: "shell"})
+	_, ok = s.free()
+	require.False(t, ok, "all slots are taken")
+
+	infra.release()
+	busy, ok = s.free()
+	require.True(t, ok)
+	require.Equal(t, []string{"shell"}, busy)
+}
+
+func TestSlotStart(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("waits for the provider to be under its cap", func(t *testing.T) {
+		s := newScheduler(2, map[string]int{"infra": 1})
+		first := s.admit(models.NodeTask{Provider: "infra"})
+		require.NoError(t, first.start(ctx))
+
+		// An older server may send a task for a busy provider anyway
+		second := s.admit(models.NodeTask{Provider: "infra"})
+		started := startAsync(ctx, second)
+		requireWaiting(t, started)
+
+		first.release()
+		require.NoError(t, <-started)
+	})
+
+	t.Run("runs exclusive tasks alone", func(t *testing.T) {
+		s := newScheduler(3, nil)
+		running := s.admit(models.NodeTask{Provider: "shell"})
+		require.NoError(t, running.start(ctx))
+
+		exclusive := s.admit(models.NodeTask{Provider: "shell", Exclusive: true})
+		_, ok := s.free()
+		require.False(t, ok, "no task is received while an exclusive task waits")
+		started := startAsync(ctx, exclusive)
+		requireWaiting(t, started)
+
+		running.release()
+		require.NoError(t, <-started)
+
+		exclusive.release()
+		_, ok = s.free()
+		require.True(t, ok)
+	})
+
+	t.Run("gives up when ctx is done", func(t *testing.T) {
+		s := newScheduler(1, nil)
+		require.NoError(t, s.admit(models.NodeTask{}).start(ctx))
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		require.Error(t, s.admit(models.NodeTask{}).start(cancelled))
+	})
+}
+
+func startAsync(ctx context.Context, sl *slot) chan error {
+	started := make(chan error, 1)
+	go func() {
+		started <- sl.start(ctx)
+	}()
+	return started
+}
+
+func requireWaiting(t *testing.T, started chan error) {
+	select {
+	case err := <-started:
+		t.Fatalf("the task started: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -2,11 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/chef/foodtruck/pkg/secrets"
 	"github.com/chef/foodtruck/pkg/server"
 	"github.com/chef/foodtruck/pkg/storage"
 	"github.com/labstack/echo-contrib/prometheus"
@@ -19,25 +27,66 @@ const (
 	mongoDBConnectionStringEnvVarName = "MONGODB_CONNECTION_STRING"
 	mongoDBDatabaseNameEnvVarName     = "MONGODB_DATABASE_NAME"
 	nodesAPIKeyEnvVarName             = "NODES_API_KEY"
+	nodesAPIKeysFileEnvVarName        = "NODES_API_KEYS_FILE"
 	adminAPIKeyEnvVarName             = "ADMIN_API_KEY"
+	adminAPIKeysFileEnvVarName        = "ADMIN_API_KEYS_FILE"
 	foodtruckPortEnvVarName           = "FOODTRUCK_LISTEN_ADDR"
+	tlsCertFileEnvVarName             = "FOODTRUCK_TLS_CERT_FILE"
+	tlsKeyFileEnvVarName              = "FOODTRUCK_TLS_KEY_FILE"
+	tlsClientCAFileEnvVarName         = "FOODTRUCK_TLS_CLIENT_CA_FILE"
+	secretsKeyFileEnvVarName          = "FOODTRUCK_SECRETS_KEY_FILE"
+	allowUnregisteredEnvVarName       = "FOODTRUCK_ALLOW_UNREGISTERED_PROVIDERS"
+	longPollMaxWaitEnvVarName         = "FOODTRUCK_LONG_POLL_MAX_WAIT"
+	pollIntervalEnvVarName            = "FOODTRUCK_POLL_INTERVAL"
+	pollMaxIntervalEnvVarName         = "FOODTRUCK_POLL_MAX_INTERVAL"
+	pollTargetRateEnvVarName          = "FOODTRUCK_POLL_TARGET_RATE"
+	rateLimitsFileEnvVarName          = "FOODTRUCK_RATE_LIMITS_FILE"
+)
+
+const (
+	defaultLongPollMaxWait = 30 * time.Second
+	defaultPollMaxInterval = 10 * time.Minute
 )
 
 type Config struct {
-	ListenAddr         string
-	DatabaseConnection string
-	Database           string
-	Auth               struct {
+	ListenAddr string
+	TLS        struct {
+		CertFile string
+		KeyFile  string
+		// ClientCAFile is the CA bundle used to verify node client
+		// certificates
+		ClientCAFile string
+	}
+	// SecretsKeyFile is the key used to encrypt secrets in task specs
+	SecretsKeyFile string
+	// AllowUnregisteredProviders accepts jobs for unregistered providers
+	AllowUnregisteredProviders bool
+	DatabaseConnection         string
+	Database                   string
+	Auth                       struct {
 		// Auth for the nodes endpoints
 		Nodes struct {
-			ApiKey string
+			ApiKey     string
+			ApiKeyFile string
 		}
 
 		// Auth for the admin endpoints
 		Admin struct {
-			ApiKey string
+			ApiKey     string
+			ApiKeyFile string
 		}
 	}
+	// LongPollMaxWait is the longest nodes may wait for their next task in
+	// a single request
+	LongPollMaxWait time.Duration
+	// PollInterval, PollMaxInterval and PollTargetRate decide how long nodes
+	// are told to wait before asking for tasks again
+	PollInterval    time.Duration
+	PollMaxInterval time.Duration
+	PollTargetRate  float64
+	// RateLimitsFile is a JSON file with the rate limits of the admin and
+	// nodes routes
+	RateLimitsFile string
 }
 
 func loadConfig() Config {
@@ -50,6 +99,39 @@ func loadConfig() Config {
 		c.ListenAddr = v
 	}
 
+	{
+		c.TLS.CertFile = os.Getenv(tlsCertFileEnvVarName)
+		c.TLS.KeyFile = os.Getenv(tlsKeyFileEnvVarName)
+		c.TLS.ClientCAFile = os.Getenv(tlsClientCAFileEnvVarName)
+		if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+			fmt.Fprintf(os.Stderr, "You must provide both %s and %s to enable TLS\n", tlsCertFileEnvVarName,
+				tlsKeyFileEnvVarName)
+			os.Exit(1)
+		}
+		if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+			fmt.Fprintf(os.Stderr, "%s requires TLS to be enabled\n", tlsClientCAFileEnvVarName)
+			os.Exit(1)
+		}
+	}
+
+	c.SecretsKeyFile = os.Getenv(secretsKeyFileEnvVarName)
+	c.AllowUnregisteredProviders = os.Getenv(allowUnregisteredEnvVarName) == "true"
+
+	c.LongPollMaxWait = durationFromEnv(longPollMaxWaitEnvVarName, defaultLongPollMaxWait)
+	c.PollInterval = durationFromEnv(pollIntervalEnvVarName, 0)
+	c.PollMaxInterval = durationFromEnv(pollMaxIntervalEnvVarName, defaultPollMaxInterval)
+
+	if v, ok := os.LookupEnv(pollTargetRateEnvVarName); ok {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			fmt.Fprintf(os.Stderr, "%s must be a number of requests per second such as 100\n", pollTargetRateEnvVarName)
+			os.Exit(1)
+		}
+		c.PollTargetRate = rate
+	}
+
+	c.RateLimitsFile = os.Getenv(rateLimitsFileEnvVarName)
+
 	{
 		v, ok := os.LookupEnv(mongoDBConnectionStringEnvVarName)
 		if !ok {
@@ -69,18 +151,22 @@ func loadConfig() Config {
 	}
 
 	{
+		c.Auth.Nodes.ApiKeyFile = os.Getenv(nodesAPIKeysFileEnvVarName)
 		v, ok := os.LookupEnv(nodesAPIKeyEnvVarName)
-		if !ok {
-			fmt.Fprintf(os.Stderr, "You must provide %s in the environment\n", nodesAPIKeyEnvVarName)
+		if !ok && c.Auth.Nodes.ApiKeyFile == "" {
+			fmt.Fprintf(os.Stderr, "You must provide %s or %s in the environment\n", nodesAPIKeyEnvVarName,
+				nodesAPIKeysFileEnvVarName)
 			os.Exit(1)
 		}
 		c.Auth.Nodes.ApiKey = v
 	}
 
 	{
+		c.Auth.Admin.ApiKeyFile = os.Getenv(adminAPIKeysFileEnvVarName)
 		v, ok := os.LookupEnv(adminAPIKeyEnvVarName)
-		if !ok {
-			fmt.Fprintf(os.Stderr, "You must provide %s in the environment\n", adminAPIKeyEnvVarName)
+		if !ok && c.Auth.Admin.ApiKeyFile == "" {
+			fmt.Fprintf(os.Stderr, "You must provide %s or %s in the environment\n", adminAPIKeyEnvVarName,
+				adminAPIKeysFileEnvVarName)
 			os.Exit(1)
 		}
 		c.Auth.Admin.ApiKey = v
@@ -88,6 +174,39 @@ func loadConfig() Config {
 	return c
 }
 
+// durationFromEnv returns the duration in the environment variable name, or
+// def if it is not set
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		fmt.Fprintf(os.Stderr, "%s must be a duration such as 30s\n", name)
+		os.Exit(1)
+	}
+	return d
+}
+
+// rateLimits are the limits of each group of routes
+type rateLimits struct {
+	Admin server.RateLimit `json:"admin"`
+	Nodes server.RateLimit `json:"nodes"`
+}
+
+func loadRateLimits(path string) (rateLimits, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rateLimits{}, err
+	}
+	limits := rateLimits{}
+	if err := json.Unmarshal(d, &limits); err != nil {
+		return rateLimits{}, err
+	}
+	return limits, nil
+}
+
 func main() {
 	config := loadConfig()
 
@@ -100,12 +219,109 @@ func main() {
 		log.Fatalf("failed to initialize cosmos backend: %s", err)
 	}
 
-	e := server.Setup(db, config.Auth.Admin.ApiKey, config.Auth.Nodes.ApiKey)
+	adminKeys, err := loadKeySet(config.Auth.Admin.ApiKey, config.Auth.Admin.ApiKeyFile)
+	if err != nil {
+		log.Fatalf("failed to load admin api keys: %s", err)
+	}
+	nodesKeys, err := loadKeySet(config.Auth.Nodes.ApiKey, config.Auth.Nodes.ApiKeyFile)
+	if err != nil {
+		log.Fatalf("failed to load nodes api keys: %s", err)
+	}
+	go reloadKeySetsOnHangup(adminKeys, nodesKeys)
+
+	setupOpts := []server.SetupOpt{
+		server.WithContext(ctx),
+		server.WithNodeCertificateAuth(config.TLS.ClientCAFile != ""),
+		server.WithAllowUnregisteredProviders(config.AllowUnregisteredProviders),
+		server.WithLongPoll(config.LongPollMaxWait),
+		server.WithPollHints(config.PollInterval, config.PollMaxInterval, config.PollTargetRate),
+	}
+	if config.SecretsKeyFile != "" {
+		keyring, err := secrets.LoadKeyring(config.SecretsKeyFile)
+		if err != nil {
+			log.Fatalf("failed to load secrets key: %s", err)
+		}
+		setupOpts = append(setupOpts, server.WithSecretsKeyring(keyring))
+	}
+	if config.RateLimitsFile != "" {
+		limits, err := loadRateLimits(config.RateLimitsFile)
+		if err != nil {
+			log.Fatalf("failed to load rate limits: %s", err)
+		}
+		setupOpts = append(setupOpts,
+			server.WithAdminRateLimit(limits.Admin),
+			server.WithNodesRateLimit(limits.Nodes),
+		)
+	}
+
+	e := server.Setup(db, adminKeys, nodesKeys, setupOpts...)
 	e.Use(middleware.Logger())
 	p := prometheus.NewPrometheus("foodtruck", nil)
 	p.Use(e)
 
-	e.Logger.Fatal(e.Start(config.ListenAddr))
+	if config.TLS.CertFile == "" {
+		e.Logger.Fatal(e.Start(config.ListenAddr))
+	}
+
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		log.Fatalf("failed to configure tls: %s", err)
+	}
+	e.TLSServer.Addr = config.ListenAddr
+	e.TLSServer.TLSConfig = tlsConfig
+	e.Logger.Fatal(e.StartServer(e.TLSServer))
+}
+
+// loadTLSConfig creates the tls config for serving. If a client CA is
+// configured, client certificates are requested and verified against it, but
+// not required so that api keys can still be used.
+func loadTLSConfig(config Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.TLS.ClientCAFile != "" {
+		caData, err := ioutil.ReadFile(config.TLS.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in %s", config.TLS.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+func loadKeySet(key string, keyFile string) (*server.KeySet, error) {
+	if keyFile != "" {
+		return server.LoadKeySet(keyFile)
+	}
+	return server.NewStaticKeySet(key)
+}
+
+// reloadKeySetsOnHangup rereads the api key files every time the process
+// receives SIGHUP
+func reloadKeySetsOnHangup(keySets ...*server.KeySet) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		for _, ks := range keySets {
+			if err := ks.Reload(); err != nil {
+				log.Printf("failed to reload api keys: %s", err)
+			}
+		}
+		log.Printf("reloaded api keys")
+	}
 }
 
 func connect() *mongo.Client {
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/chef/foodtruck/pkg/signing"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func main() {
+	keyPath := flag.String("key", "", "path to the ed25519 private key to sign with")
+	keyID := flag.String("key-id", "", "id of the key, matching the name of the public key in the node trust stores")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "[usage]: foodtruck-sign-job -key signer.key -key-id signer job.json\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *keyPath == "" || *keyID == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	keyData, err := ioutil.ReadFile(*keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read key: %v\n", err)
+		os.Exit(1)
+	}
+	key, err := signing.ParsePrivateKey(keyData)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse key: %v\n", err)
+		os.Exit(1)
+	}
+
+	jobData, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read job: %v\n", err)
+		os.Exit(1)
+	}
+	job := models.Job{}
+	if err := json.Unmarshal(jobData, &job); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse job: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The job id is part of the signature, so it has to be chosen before the
+	// job is submitted
+	if job.ID == "" {
+		job.ID = primitive.NewObjectID().Hex()
+	}
+	job.Task.JobID = job.ID
+
+	if err := signing.Sign(&job.Task, *keyID, key); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to sign job: %v\n", err)
+		os.Exit(1)
+	}
+	job.Task.JobID = ""
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(job); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write job: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -13,8 +13,10 @@ require (
 	github.com/labstack/gommon v0.3.0
 	github.com/moby/term v0.0.0-20201216013528-df9cb8a40635 // indirect
 	github.com/ory/dockertest/v3 v3.6.3
+	github.com/prometheus/client_golang v1.1.0
 	github.com/stretchr/testify v1.6.1
+	github.com/xeipuuv/gojsonschema v1.1.0
 	go.mongodb.org/mongo-driver v1.4.4
-	golang.org/x/net v0.0.0-20210119194325-5f4716e94777 // indirect
-	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c // indirect
+	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
+	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c
 )
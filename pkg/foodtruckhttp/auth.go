@@ -3,6 +3,7 @@ package foodtruckhttp
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -85,6 +86,38 @@ func (p *ChefServerAuthProvider) NewPostRequest(requestURL string, body io.Reade
 	return req, nil
 }
 
+// MutualTLSAuthProvider authenticates the node with a TLS client certificate.
+// The server maps the certificate subject to the node, so the certificate
+// common name must be the node name and its organization the node org.
+type MutualTLSAuthProvider struct {
+	certificate tls.Certificate
+}
+
+func NewMutualTLSAuthProvider(CertPath string, KeyPath string) (*MutualTLSAuthProvider, error) {
+	cert, err := tls.LoadX509KeyPair(CertPath, KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate %s: %w", CertPath, err)
+	}
+	return &MutualTLSAuthProvider{certificate: cert}, nil
+}
+
+func (p *MutualTLSAuthProvider) Name() string { return "mutualTLS" }
+
+func (p *MutualTLSAuthProvider) NewPostRequest(requestURL string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest("POST", requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	return req, nil
+}
+
+func (p *MutualTLSAuthProvider) ConfigureTLS(tlsConfig *tls.Config) {
+	tlsConfig.Certificates = append(tlsConfig.Certificates, p.certificate)
+}
+
 func hash256(data []byte) string {
 	if len(data) == 0 {
 		data = []byte("")
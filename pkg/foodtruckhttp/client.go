@@ -10,7 +10,8 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/chef/foodtruck/pkg/models"
@@ -28,71 +29,212 @@ type AuthProvider interface {
 	NewPostRequest(requestURL string, body io.Reader) (*http.Request, error)
 }
 
-func NewClient(baseURL string, node models.Node, authProvider AuthProvider, sslNoVerify bool) *Client {
-	tr := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		Dial: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).Dial,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: sslNoVerify},
-	}
+// TLSAuthProvider is implemented by auth providers that authenticate at the
+// TLS layer, for example by presenting a client certificate
+type TLSAuthProvider interface {
+	ConfigureTLS(tlsConfig *tls.Config)
+}
+
+func NewClient(baseURL string, node models.Node, authProvider AuthProvider, opts ...ClientOpt) *Client {
+	copts := newClientOpts(opts)
 	return &Client{
 		BaseURL:      fmt.Sprintf("%s/organizations/%s/foodtruck/nodes/%s", baseURL, node.Organization, node.Name),
 		Node:         node,
 		authProvider: authProvider,
 		httpClient: &http.Client{
-			Transport: tr,
-			Timeout:   time.Duration(5*time.Second) * time.Second,
+			Transport: newTransport(copts, authProvider),
+			Timeout:   copts.RequestTimeout,
 		},
 	}
 }
 
-func (c *Client) GetNextTask(ctx context.Context) (models.NodeTask, error) {
-	resp, err := c.post(ctx, "/tasks/next", nil)
-	defer resp.Body.Close()
+// NewDownloadClient returns an http client for providers to download files
+// with. It uses the same CA bundle, proxy and TLS settings as the client for
+// the server, but never presents the node's client certificate, since files
+// may be downloaded from any host. It has no request timeout since downloads
+// can be large. They are bounded by the task instead.
+func NewDownloadClient(opts ...ClientOpt) *http.Client {
+	return &http.Client{Transport: newTransport(newClientOpts(opts), nil)}
+}
+
+func newClientOpts(opts []ClientOpt) ClientOpts {
+	copts := ClientOpts{
+		Proxy:               http.ProxyFromEnvironment,
+		DialTimeout:         defaultDialTimeout,
+		TLSHandshakeTimeout: defaultTLSHandshakeTimeout,
+		RequestTimeout:      defaultRequestTimeout,
+	}
+	for _, o := range opts {
+		o(&copts)
+	}
+	return copts
+}
+
+func newTransport(copts ClientOpts, authProvider AuthProvider) *http.Transport {
+	tr := &http.Transport{
+		Proxy: copts.Proxy,
+		Dial: (&net.Dialer{
+			Timeout:   copts.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: copts.TLSHandshakeTimeout,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: copts.InsecureSkipVerify,
+			RootCAs:            copts.RootCAs,
+			MinVersion:         copts.MinTLSVersion,
+		},
+	}
+	if tlsAuthProvider, ok := authProvider.(TLSAuthProvider); ok {
+		tlsAuthProvider.ConfigureTLS(tr.TLSClientConfig)
+	}
+	return tr
+}
+
+func (c *Client) GetNextTask(ctx context.Context, nextTaskRequest models.NextTaskRequest) (models.NodeTask, error) {
+	task, _, err := c.nextTask(ctx, c.httpClient, "/tasks/next", nextTaskRequest)
+	return task, err
+}
+
+// WaitForNextTask is GetNextTask, but asks the server to hold the request for
+// up to wait until a task is available. longPoll is false if the server does
+// not support long polling, in which case it answered right away.
+func (c *Client) WaitForNextTask(ctx context.Context, nextTaskRequest models.NextTaskRequest,
+	wait time.Duration) (task models.NodeTask, longPoll bool, err error) {
+	nextTaskRequest.Wait = int(wait.Seconds())
+	httpClient := *c.httpClient
+	if httpClient.Timeout > 0 {
+		httpClient.Timeout += wait
+	}
+	return c.nextTask(ctx, &httpClient, "/tasks/next", nextTaskRequest)
+}
+
+// PeekNextTask returns the task GetNextTask would return without dequeuing
+// it. Servers that do not support peeking respond as if there are no tasks.
+func (c *Client) PeekNextTask(ctx context.Context, nextTaskRequest models.NextTaskRequest) (models.NodeTask, error) {
+	task, _, err := c.nextTask(ctx, c.httpClient, "/tasks/peek", nextTaskRequest)
+	return task, err
+}
+
+func (c *Client) nextTask(ctx context.Context, httpClient *http.Client, path string,
+	nextTaskRequest models.NextTaskRequest) (models.NodeTask, bool, error) {
+	reqBody, err := json.Marshal(nextTaskRequest)
+	if err != nil {
+		return models.NodeTask{}, false, err
+	}
+	resp, err := c.do(ctx, httpClient, path, bytes.NewReader(reqBody))
 	if err != nil {
-		return models.NodeTask{}, err
+		return models.NodeTask{}, false, err
 	}
+	defer resp.Body.Close()
+	longPoll := resp.Header.Get(models.LongPollHeader) != ""
 
 	if resp.StatusCode == 200 {
 		d := json.NewDecoder(resp.Body)
 		task := models.NodeTask{}
 		if err := d.Decode(&task); err != nil {
-			return models.NodeTask{}, err
+			return models.NodeTask{}, longPoll, err
 		}
-		return task, nil
-	} else if resp.StatusCode == 404 {
-		return models.NodeTask{}, models.ErrNoTasks
+		return task, longPoll, nil
+	}
+
+	err = models.ErrNoTasks
+	if resp.StatusCode != 404 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err = &ResponseError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		err = &RetryAfterError{Err: err, RetryAfter: retryAfter}
 	}
-	body, _ := ioutil.ReadAll(resp.Body)
-	fmt.Fprintf(os.Stderr, "Unknown response:\n%s\n\n", body)
-	return models.NodeTask{}, fmt.Errorf("Request failed")
+	return models.NodeTask{}, longPoll, err
+}
+
+// RetryAfterError is returned when the server answered a request for the
+// next task with how long the node should wait before asking again. It wraps
+// the error for the response, such as models.ErrNoTasks.
+type RetryAfterError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Err, e.RetryAfter)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or a date
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
 }
 
 func (c *Client) UpdateNodeTaskStatus(ctx context.Context, nodeTaskStatus models.NodeTaskStatus) error {
 	reqBody, err := json.Marshal(nodeTaskStatus)
+	if err != nil {
+		return err
+	}
 	resp, err := c.post(ctx, "/tasks/status", bytes.NewReader(reqBody))
-	defer resp.Body.Close()
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == 200 {
 		return nil
 	}
 	respBody, _ := ioutil.ReadAll(resp.Body)
-	fmt.Fprintf(os.Stderr, "Unknown response:\n%s\n\n", respBody)
-	return fmt.Errorf("Request failed")
+	return &ResponseError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(respBody))}
+}
+
+// ResponseError is returned when the server responds to a request with an
+// unexpected status
+type ResponseError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("Request failed: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// Rejected returns whether the server refused what the request asked for, so
+// sending it again would fail the same way. Authentication failures are not
+// rejections, since new credentials may fix them.
+func (e *ResponseError) Rejected() bool {
+	return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusNotFound ||
+		e.StatusCode == http.StatusConflict
 }
 
 func (c *Client) post(ctx context.Context, requestURL string, body io.Reader) (*http.Response, error) {
+	return c.do(ctx, c.httpClient, requestURL, body)
+}
+
+func (c *Client) do(ctx context.Context, httpClient *http.Client, requestURL string, body io.Reader) (*http.Response, error) {
 	u := c.BaseURL + requestURL
 	req, err := c.authProvider.NewPostRequest(u, body)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
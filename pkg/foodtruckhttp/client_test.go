@@ -0,0 +1,155 @@
+package foodtruckhttp
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRootCAs(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}")) // nolint: errcheck
+	}))
+	defer server.Close()
+
+	node := models.Node{Organization: "org", Name: "node"}
+	status := models.NodeTaskStatus{JobID: "job", Status: models.TaskStatusRunning}
+
+	t.Run("fails without the server CA", func(t *testing.T) {
+		c := NewClient(server.URL, node, &ApiKeyAuthProvider{Key: "key"})
+		require.Error(t, c.UpdateNodeTaskStatus(context.Background(), status))
+	})
+
+	t.Run("succeeds with the server CA bundle", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "foodtruck-ca")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		require.NoError(t, pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+		require.NoError(t, f.Close())
+
+		pool, err := LoadCABundle(f.Name())
+		require.NoError(t, err)
+
+		c := NewClient(server.URL, node, &ApiKeyAuthProvider{Key: "key"}, WithRootCAs(pool))
+		require.NoError(t, c.UpdateNodeTaskStatus(context.Background(), status))
+
+		_, err = NewDownloadClient().Get(server.URL)
+		require.Error(t, err)
+		resp, err := NewDownloadClient(WithRootCAs(pool)).Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+	})
+
+	t.Run("rejects an empty CA bundle", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "foodtruck-ca")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		require.NoError(t, f.Close())
+
+		_, err = LoadCABundle(f.Name())
+		require.Error(t, err)
+	})
+}
+
+func TestWithProxy(t *testing.T) {
+	opts := ClientOpts{}
+	WithProxy("http://proxy.example.com:3128", "http://secure-proxy.example.com:3128", "internal.example.com,10.0.0.0/8")(&opts)
+
+	proxyFor := func(rawurl string) string {
+		req, err := http.NewRequest("POST", rawurl, nil)
+		require.NoError(t, err)
+		u, err := opts.Proxy(req)
+		require.NoError(t, err)
+		if u == nil {
+			return ""
+		}
+		return u.String()
+	}
+
+	require.Equal(t, "http://proxy.example.com:3128", proxyFor("http://foodtruck.example.com"))
+	require.Equal(t, "http://secure-proxy.example.com:3128", proxyFor("https://foodtruck.example.com"))
+	require.Equal(t, "", proxyFor("https://foodtruck.internal.example.com"))
+	require.Equal(t, "", proxyFor("https://10.1.2.3"))
+}
+
+func TestWaitForNextTask(t *testing.T) {
+	var wait int
+	longPoll := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := models.NextTaskRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		wait = req.Wait
+		if longPoll {
+			w.Header().Set(models.LongPollHeader, "30")
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, models.Node{Organization: "org", Name: "node"}, &ApiKeyAuthProvider{Key: "key"})
+
+	t.Run("detects servers that do not support long polling", func(t *testing.T) {
+		_, supported, err := client.WaitForNextTask(context.Background(), models.NextTaskRequest{}, 20*time.Second)
+		require.True(t, errors.Is(err, models.ErrNoTasks))
+		require.False(t, supported)
+		require.Equal(t, 20, wait)
+	})
+
+	t.Run("detects servers that support long polling", func(t *testing.T) {
+		longPoll = true
+		_, supported, err := client.WaitForNextTask(context.Background(), models.NextTaskRequest{}, 20*time.Second)
+		require.True(t, errors.Is(err, models.ErrNoTasks))
+		require.True(t, supported)
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	status, retryAfter := http.StatusNotFound, ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, models.Node{Organization: "org", Name: "node"}, &ApiKeyAuthProvider{Key: "key"})
+
+	t.Run("returns how long the server asked to wait", func(t *testing.T) {
+		retryAfter = "30"
+		_, err := client.GetNextTask(context.Background(), models.NextTaskRequest{})
+		require.True(t, errors.Is(err, models.ErrNoTasks))
+		retryErr := &RetryAfterError{}
+		require.True(t, errors.As(err, &retryErr))
+		require.Equal(t, 30*time.Second, retryErr.RetryAfter)
+	})
+
+	t.Run("returns the response error of busy servers", func(t *testing.T) {
+		status = http.StatusServiceUnavailable
+		retryAfter = time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+		_, err := client.GetNextTask(context.Background(), models.NextTaskRequest{})
+		respErr := &ResponseError{}
+		require.True(t, errors.As(err, &respErr))
+		require.Equal(t, http.StatusServiceUnavailable, respErr.StatusCode)
+		retryErr := &RetryAfterError{}
+		require.True(t, errors.As(err, &retryErr))
+		require.InDelta(t, time.Minute.Seconds(), retryErr.RetryAfter.Seconds(), 2)
+	})
+
+	t.Run("ignores invalid values", func(t *testing.T) {
+		status = http.StatusNotFound
+		retryAfter = "soon"
+		_, err := client.GetNextTask(context.Background(), models.NextTaskRequest{})
+		require.Equal(t, models.ErrNoTasks, err)
+	})
+}
@@ -0,0 +1,151 @@
+package foodtruckhttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+// ErrEventsUnsupported is returned when the server does not have an events
+// stream
+var ErrEventsUnsupported = errors.New("server does not support events")
+
+// ErrHeartbeatTimeout is returned when the server sent nothing on the events
+// stream, not even a heartbeat, for too long
+var ErrHeartbeatTimeout = errors.New("no heartbeat from the server")
+
+const (
+	// defaultHeartbeatInterval is used when the server does not say how
+	// often it sends heartbeats
+	defaultHeartbeatInterval = 15 * time.Second
+	// missedHeartbeats is how many heartbeats may be missed before the
+	// connection is considered lost
+	missedHeartbeats = 3
+
+	eventsMinBackoff = time.Second
+	eventsMaxBackoff = 5 * time.Minute
+)
+
+// Events connects to the node's events stream and calls onEvent with each
+// event until the connection is lost or ctx is done. Heartbeats are not
+// passed to onEvent. The server's first event is always task_available.
+func (c *Client) Events(ctx context.Context, onEvent func(models.NodeEvent)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The stream stays open, the heartbeats tell whether it is alive
+	httpClient := *c.httpClient
+	httpClient.Timeout = 0
+	resp, err := c.do(ctx, &httpClient, "/tasks/events", strings.NewReader("{}"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return ErrEventsUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return &ResponseError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(respBody))}
+	}
+
+	heartbeat := defaultHeartbeatInterval
+	if secs, err := strconv.ParseFloat(resp.Header.Get(models.HeartbeatHeader), 64); err == nil && secs > 0 {
+		heartbeat = time.Duration(secs * float64(time.Second))
+	}
+	var timedOut int32
+	timer := time.AfterFunc(missedHeartbeats*heartbeat, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+	defer timer.Stop()
+
+	scanner := bufio.NewScanner(resp.Body)
+	data := ""
+	for scanner.Scan() {
+		timer.Reset(missedHeartbeats * heartbeat)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line ends an event
+			if data == "" {
+				continue
+			}
+			event := models.NodeEvent{}
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				return fmt.Errorf("invalid event %q: %w", data, err)
+			}
+			data = ""
+			if event.Type != models.NodeEventHeartbeat {
+				onEvent(event)
+			}
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		}
+	}
+
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return ErrHeartbeatTimeout
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("events stream closed by the server")
+}
+
+// WatchEvents calls onEvent with the node's events until ctx is done,
+// reconnecting whenever the connection is lost. It waits longer after each
+// failed attempt, from 1 second up to 5 minutes with some jitter, starting
+// over once connected. onError, if not nil, is called with each error and how
+// long until the next attempt. ErrEventsUnsupported is returned right away if
+// the server does not have an events stream.
+func (c *Client) WatchEvents(ctx context.Context, onEvent func(models.NodeEvent),
+	onError func(err error, retryIn time.Duration)) error {
+	backoff := eventsMinBackoff
+	for {
+		connected := false
+		err := c.Events(ctx, func(event models.NodeEvent) {
+			connected = true
+			onEvent(event)
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrEventsUnsupported) {
+			return err
+		}
+		if connected {
+			backoff = eventsMinBackoff
+		}
+
+		// Between half and all of the backoff, so nodes that lost their
+		// connection together do not all come back at once
+		retryIn := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if onError != nil {
+			onError(err, retryIn)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryIn):
+		}
+		backoff *= 2
+		if backoff > eventsMaxBackoff {
+			backoff = eventsMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package foodtruckhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	node := models.Node{Organization: "org", Name: "node"}
+
+	t.Run("passes the events but not the heartbeats", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "/organizations/org/foodtruck/nodes/node/tasks/events", r.URL.Path)
+			w.Header().Set(models.HeartbeatHeader, "15")
+			fmt.Fprint(w, "event: task_available\ndata: {\"type\":\"task_available\"}\n\n")
+			fmt.Fprint(w, "event: heartbeat\ndata: {\"type\":\"heartbeat\"}\n\n")
+			fmt.Fprint(w, "event: cancel\ndata: {\"type\":\"cancel\",\"job_id\":\"job1\"}\n\n")
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL, node, &ApiKeyAuthProvider{Key: "key"})
+		var events []models.NodeEvent
+		err := client.Events(context.Background(), func(event models.NodeEvent) {
+			events = append(events, event)
+		})
+		require.Error(t, err)
+		require.Equal(t, []models.NodeEvent{
+			{Type: models.NodeEventTaskAvailable},
+			{Type: models.NodeEventCancel, JobID: "job1"},
+		}, events)
+	})
+
+	t.Run("gives up when the heartbeats stop", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(models.HeartbeatHeader, "0.05")
+			fmt.Fprint(w, "event: task_available\ndata: {\"type\":\"task_available\"}\n\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL, node, &ApiKeyAuthProvider{Key: "key"})
+		err := client.Events(context.Background(), func(models.NodeEvent) {})
+		require.True(t, errors.Is(err, ErrHeartbeatTimeout))
+	})
+
+	t.Run("detects servers without an events stream", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+
+		client := NewClient(server.URL, node, &ApiKeyAuthProvider{Key: "key"})
+		err := client.WatchEvents(context.Background(), func(models.NodeEvent) {}, nil)
+		require.True(t, errors.Is(err, ErrEventsUnsupported))
+	})
+
+	t.Run("reconnects when the connection is lost", func(t *testing.T) {
+		var connections int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&connections, 1)
+			fmt.Fprint(w, "event: task_available\ndata: {\"type\":\"task_available\"}\n\n")
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL, node, &ApiKeyAuthProvider{Key: "key"})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		events := 0
+		var retries []time.Duration
+		err := client.WatchEvents(ctx, func(models.NodeEvent) {
+			events++
+			if events == 2 {
+				cancel()
+			}
+		}, func(err error, retryIn time.Duration) {
+			retries = append(retries, retryIn)
+		})
+		require.True(t, errors.Is(err, context.Canceled))
+		require.Equal(t, int32(2), atomic.LoadInt32(&connections))
+		require.Len(t, retries, 1)
+		require.True(t, retries[0] >= eventsMinBackoff/2 && retries[0] <= eventsMinBackoff)
+	})
+}
@@ -0,0 +1,111 @@
+package foodtruckhttp
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultRequestTimeout      = 30 * time.Second
+)
+
+type ClientOpts struct {
+	// InsecureSkipVerify disables verification of the server certificate
+	InsecureSkipVerify bool
+	// RootCAs is the set of CAs used to verify the server certificate. If
+	// nil, the system roots are used.
+	RootCAs *x509.CertPool
+	// MinTLSVersion is the minimum TLS version accepted, for example
+	// tls.VersionTLS12. If 0, the go default is used.
+	MinTLSVersion uint16
+	// Proxy selects the proxy for a request. If nil, the proxy is taken from
+	// the environment.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	RequestTimeout      time.Duration
+}
+
+type ClientOpt func(*ClientOpts)
+
+func WithInsecureSkipVerify(insecureSkipVerify bool) ClientOpt {
+	return func(opts *ClientOpts) {
+		opts.InsecureSkipVerify = insecureSkipVerify
+	}
+}
+
+func WithRootCAs(pool *x509.CertPool) ClientOpt {
+	return func(opts *ClientOpts) {
+		opts.RootCAs = pool
+	}
+}
+
+func WithMinTLSVersion(version uint16) ClientOpt {
+	return func(opts *ClientOpts) {
+		opts.MinTLSVersion = version
+	}
+}
+
+// WithProxy sets the proxies used to talk to the server. Empty values fall back
+// to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables. noProxy is
+// a comma separated list of hosts, domains and CIDRs that should not be proxied.
+func WithProxy(httpProxy string, httpsProxy string, noProxy string) ClientOpt {
+	return func(opts *ClientOpts) {
+		envConfig := httpproxy.FromEnvironment()
+		proxyConfig := &httpproxy.Config{
+			HTTPProxy:  firstNonEmpty(httpProxy, envConfig.HTTPProxy),
+			HTTPSProxy: firstNonEmpty(httpsProxy, envConfig.HTTPSProxy),
+			NoProxy:    firstNonEmpty(noProxy, envConfig.NoProxy),
+		}
+		proxyFunc := proxyConfig.ProxyFunc()
+		opts.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+}
+
+func WithTimeouts(dial time.Duration, tlsHandshake time.Duration, request time.Duration) ClientOpt {
+	return func(opts *ClientOpts) {
+		if dial > 0 {
+			opts.DialTimeout = dial
+		}
+		if tlsHandshake > 0 {
+			opts.TLSHandshakeTimeout = tlsHandshake
+		}
+		if request > 0 {
+			opts.RequestTimeout = request
+		}
+	}
+}
+
+// LoadCABundle reads a PEM encoded CA bundle into a new cert pool. The system
+// roots are not included.
+func LoadCABundle(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle %s: %w", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
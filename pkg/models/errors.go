@@ -3,7 +3,45 @@ package models
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 
 var ErrNotFound = errors.New("Not Found")
 var ErrNoTasks = fmt.Errorf("No tasks available: %w", ErrNotFound)
+var ErrInvalidJobID = errors.New("Invalid job id")
+var ErrJobExists = errors.New("Job already exists")
+var ErrInvalidTaskEnv = errors.New("Invalid task env")
+var ErrJobNotForNode = fmt.Errorf("Job does not target the node: %w", ErrNotFound)
+var ErrInvalidStatusTransition = errors.New("Invalid status transition")
+var ErrTaskNotSent = fmt.Errorf("Task has not been sent to the node: %w", ErrInvalidStatusTransition)
+
+// StatusTransitionError is returned when the status of a task cannot change
+// to the requested status. Current is the task's status.
+type StatusTransitionError struct {
+	Current NodeTaskStatus
+	To      TaskStatus
+}
+
+func (e *StatusTransitionError) Error() string {
+	return fmt.Sprintf("%s: %s cannot change from %s to %s", ErrInvalidStatusTransition, e.Current.JobID,
+		e.Current.Status, e.To)
+}
+
+func (e *StatusTransitionError) Unwrap() error {
+	return ErrInvalidStatusTransition
+}
+
+// NoTasksError is returned instead of ErrNoTasks when the node has tasks
+// whose window has not started yet. NextWindowStart is when the first one
+// starts.
+type NoTasksError struct {
+	NextWindowStart time.Time
+}
+
+func (e *NoTasksError) Error() string {
+	return fmt.Sprintf("%s until %s", ErrNoTasks, e.NextWindowStart.Format(time.RFC3339))
+}
+
+func (e *NoTasksError) Unwrap() error {
+	return ErrNoTasks
+}
@@ -0,0 +1,26 @@
+package models
+
+// NodeEventType is the kind of a NodeEvent
+type NodeEventType string
+
+const (
+	// NodeEventTaskAvailable is sent when tasks may be available for the
+	// node, including when it connects
+	NodeEventTaskAvailable NodeEventType = "task_available"
+	// NodeEventCancel is sent when a task the node received is cancelled
+	NodeEventCancel NodeEventType = "cancel"
+	// NodeEventHeartbeat is sent regularly so the node knows it is still
+	// connected
+	NodeEventHeartbeat NodeEventType = "heartbeat"
+)
+
+// NodeEvent is pushed by the server to the nodes connected to their events
+// stream
+type NodeEvent struct {
+	Type  NodeEventType `json:"type"`
+	JobID JobID         `json:"job_id,omitempty"`
+}
+
+// HeartbeatHeader is sent with the events stream, with how many seconds the
+// server waits between heartbeats
+const HeartbeatHeader = "Foodtruck-Heartbeat"
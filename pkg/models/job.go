@@ -3,6 +3,8 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -13,13 +15,71 @@ const (
 	TaskStatusRunning TaskStatus = "running"
 	TaskStatusFailed  TaskStatus = "failed"
 	TaskStatusSuccess TaskStatus = "success"
+	// TaskStatusTimedOut is reported for a task that did not finish in the
+	// time it was given
+	TaskStatusTimedOut TaskStatus = "timed_out"
+	// TaskStatusInterrupted is reported for a task that was stopped because
+	// the client shut down while it was running
+	TaskStatusInterrupted TaskStatus = "interrupted"
+	// TaskStatusExpired is set by the server for a task whose window ended
+	// before the node asked for it
+	TaskStatusExpired TaskStatus = "expired"
+	// TaskStatusCancelled is set by the server for a task cancelled before
+	// the node received it, and reported by nodes for a task they stopped
+	// because it was cancelled
+	TaskStatusCancelled TaskStatus = "cancelled"
 )
 
+// IsFinal returns whether s is the last status of a task. A final status is
+// never replaced.
+func (s TaskStatus) IsFinal() bool {
+	for _, final := range FinalTaskStatuses {
+		if s == final {
+			return true
+		}
+	}
+	return false
+}
+
+// FinalTaskStatuses are the statuses for which IsFinal is true
+var FinalTaskStatuses = []TaskStatus{
+	TaskStatusFailed,
+	TaskStatusSuccess,
+	TaskStatusTimedOut,
+	TaskStatusInterrupted,
+	TaskStatusExpired,
+	TaskStatusCancelled,
+}
+
+// CanTransitionTo returns whether the status of a task may change from s to
+// to. A task goes from pending, to running, to a final status, though it may
+// skip running. A task without a status yet has the empty status: it becomes
+// pending when the server hands it to the node, or failed, expired or
+// cancelled if the server drops it from the node's queue. Setting a final
+// status again is allowed so that a node can safely send it twice, but
+// changes nothing.
+func (s TaskStatus) CanTransitionTo(to TaskStatus) bool {
+	switch {
+	case s == "":
+		return to == TaskStatusPending || to == TaskStatusFailed || to == TaskStatusExpired || to == TaskStatusCancelled
+	case s.IsFinal():
+		return to == s
+	case s == TaskStatusRunning:
+		return to == TaskStatusRunning || to.IsFinal()
+	case s == TaskStatusPending:
+		return to == TaskStatusPending || to == TaskStatusRunning || to.IsFinal()
+	}
+	return false
+}
+
 var ValidTaskStatuses = []string{
 	string(TaskStatusPending),
 	string(TaskStatusRunning),
 	string(TaskStatusFailed),
 	string(TaskStatusSuccess),
+	string(TaskStatusTimedOut),
+	string(TaskStatusInterrupted),
+	string(TaskStatusCancelled),
 }
 
 type JobID = string
@@ -54,11 +114,131 @@ type NodeTask struct {
 	WindowEnd   time.Time       `json:"window_end" bson:"window_end"`
 	Provider    string          `json:"provider" bson:"provider"`
 	Spec        json.RawMessage `json:"spec" bson:"spec"`
+	Signature   *TaskSignature  `json:"signature,omitempty" bson:"signature,omitempty"`
+	// Env are environment variables set for the provider, in addition to
+	// those the client passes through
+	Env map[string]string `json:"env,omitempty" bson:"env,omitempty"`
+	// RunAs is the user and group the provider is run as. The client only
+	// runs tasks as users and groups it allows.
+	RunAs *RunAs `json:"run_as,omitempty" bson:"run_as,omitempty"`
+	// Limits lower the resource limits the client runs the provider with
+	Limits *ResourceLimits `json:"limits,omitempty" bson:"limits,omitempty"`
+	// Exclusive tasks never run at the same time as another task on the
+	// node
+	Exclusive bool `json:"exclusive,omitempty" bson:"exclusive,omitempty"`
+	// SecretsKey is the encrypted data key for the secrets in Spec. It is
+	// never sent over the api.
+	SecretsKey []byte `json:"-" bson:"secrets_key,omitempty"`
+}
+
+type RunAs struct {
+	User  string `json:"user,omitempty" bson:"user,omitempty"`
+	Group string `json:"group,omitempty" bson:"group,omitempty"`
+}
+
+// ResourceLimits are limits on the resources used by a provider. A zero value
+// means no limit.
+type ResourceLimits struct {
+	// CPUSeconds is the CPU time the provider may use
+	CPUSeconds uint64 `json:"cpu_seconds,omitempty" bson:"cpu_seconds,omitempty"`
+	// CPUPercent is the share of one CPU the provider may use. It requires a
+	// cgroup.
+	CPUPercent   uint64 `json:"cpu_percent,omitempty" bson:"cpu_percent,omitempty"`
+	MemoryBytes  uint64 `json:"memory_bytes,omitempty" bson:"memory_bytes,omitempty"`
+	MaxProcesses uint64 `json:"max_processes,omitempty" bson:"max_processes,omitempty"`
+	OpenFiles    uint64 `json:"open_files,omitempty" bson:"open_files,omitempty"`
+}
+
+// Override returns the limits with the non-zero limits of o applied. A limit
+// of o can only lower a limit, so a task cannot raise or remove the limits
+// the node is configured with.
+func (l ResourceLimits) Override(o *ResourceLimits) ResourceLimits {
+	if o == nil {
+		return l
+	}
+	l.CPUSeconds = lowerLimit(l.CPUSeconds, o.CPUSeconds)
+	l.CPUPercent = lowerLimit(l.CPUPercent, o.CPUPercent)
+	l.MemoryBytes = lowerLimit(l.MemoryBytes, o.MemoryBytes)
+	l.MaxProcesses = lowerLimit(l.MaxProcesses, o.MaxProcesses)
+	l.OpenFiles = lowerLimit(l.OpenFiles, o.OpenFiles)
+	return l
+}
+
+// lowerLimit returns the lower of two limits, where 0 means no limit
+func lowerLimit(limit uint64, override uint64) uint64 {
+	if limit == 0 || (override != 0 && override < limit) {
+		return override
+	}
+	return limit
+}
+
+// TaskEnvPrefix is the prefix of the environment variables the client sets
+// for a task. Tasks may not set variables with this prefix.
+const TaskEnvPrefix = "FOODTRUCK_"
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateTaskEnv checks that the environment variables provided by a task
+// have valid names that are not reserved for the client
+func ValidateTaskEnv(env map[string]string) error {
+	for name := range env {
+		if !envNameRegex.MatchString(name) {
+			return fmt.Errorf("%w: %q is not a valid name", ErrInvalidTaskEnv, name)
+		}
+		if strings.HasPrefix(strings.ToUpper(name), TaskEnvPrefix) {
+			return fmt.Errorf("%w: %q uses the reserved prefix %s", ErrInvalidTaskEnv, name, TaskEnvPrefix)
+		}
+	}
+	return nil
+}
+
+// TaskSignature is a signature over the job id, provider, spec and window of a
+// task made by the job submitter
+type TaskSignature struct {
+	KeyID     string `json:"key_id" bson:"key_id"`
+	Signature []byte `json:"signature" bson:"signature"`
 }
 
 type NodeTaskStatusResult struct {
 	ExitCode int    `json:"exit_code" bson:"exit_code"`
 	Reason   string `json:"reason,omitempty" bson:"reason,omitempty"`
+	// Progress is the last progress percentage reported by the provider
+	Progress int `json:"progress,omitempty" bson:"progress,omitempty"`
+	// Logs are the most recent log messages emitted by the provider
+	Logs []ProviderLog `json:"logs,omitempty" bson:"logs,omitempty"`
+	// Output is the structured result emitted by the provider
+	Output json.RawMessage `json:"output,omitempty" bson:"output,omitempty"`
+}
+
+// Result reasons for providers killed or failed because they exceeded a
+// resource limit
+const (
+	ReasonCPULimitExceeded     = "cpu_limit_exceeded"
+	ReasonMemoryLimitExceeded  = "memory_limit_exceeded"
+	ReasonProcessLimitExceeded = "process_limit_exceeded"
+)
+
+// Result reasons for tasks interrupted by the client stopping
+const (
+	// ReasonClientShutdown is the reason of a task terminated because the
+	// client was asked to shut down
+	ReasonClientShutdown = "client_shutdown"
+	// ReasonClientRestarted is the reason of a task the client was running
+	// when it crashed or the node rebooted
+	ReasonClientRestarted = "client_restarted"
+)
+
+// Limits on the provider outputs carried in a NodeTaskStatusResult
+const (
+	MaxResultLogs          = 100
+	MaxResultLogMessageLen = 1024
+	MaxResultOutputSize    = 64 * 1024
+)
+
+type ProviderLog struct {
+	Time    time.Time `json:"time" bson:"time"`
+	Level   string    `json:"level" bson:"level"`
+	Message string    `json:"message" bson:"message"`
 }
 
 type NodeTaskStatus struct {
@@ -67,4 +247,14 @@ type NodeTaskStatus struct {
 	Status      TaskStatus            `json:"status,omitempty" bson:"status,omitempty"`
 	LastUpdated time.Time             `json:"last_updated,omitempty" bson:"last_updated,omitempty"`
 	Result      *NodeTaskStatusResult `json:"result,omitempty" bson:"result,omitempty"`
+	// History are the statuses the task went through, oldest first. It is
+	// only returned when asking for the status of a single node.
+	History []StatusTransition `json:"history,omitempty" bson:"history,omitempty"`
+}
+
+// StatusTransition is a change of the status of a node's task
+type StatusTransition struct {
+	Status TaskStatus            `json:"status" bson:"status"`
+	Time   time.Time             `json:"time" bson:"time"`
+	Result *NodeTaskStatusResult `json:"result,omitempty" bson:"result,omitempty"`
 }
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskStatusCanTransitionTo(t *testing.T) {
+	allowed := map[TaskStatus][]TaskStatus{
+		"":                    {TaskStatusPending, TaskStatusFailed, TaskStatusExpired, TaskStatusCancelled},
+		TaskStatusPending:     {TaskStatusPending, TaskStatusRunning, TaskStatusSuccess, TaskStatusFailed, TaskStatusTimedOut},
+		TaskStatusRunning:     {TaskStatusRunning, TaskStatusSuccess, TaskStatusFailed, TaskStatusTimedOut, TaskStatusInterrupted, TaskStatusCancelled},
+		TaskStatusSuccess:     {TaskStatusSuccess},
+		TaskStatusTimedOut:    {TaskStatusTimedOut},
+		TaskStatusInterrupted: {TaskStatusInterrupted},
+		TaskStatusCancelled:   {TaskStatusCancelled},
+	}
+	denied := map[TaskStatus][]TaskStatus{
+		"":                  {TaskStatusRunning, TaskStatusSuccess, TaskStatusTimedOut, TaskStatusInterrupted},
+		TaskStatusRunning:   {TaskStatusPending},
+		TaskStatusSuccess:   {TaskStatusPending, TaskStatusRunning, TaskStatusFailed},
+		TaskStatusFailed:    {TaskStatusRunning, TaskStatusSuccess},
+		TaskStatusTimedOut:  {TaskStatusRunning, TaskStatusFailed},
+		TaskStatusExpired:   {TaskStatusRunning, TaskStatusSuccess},
+		TaskStatusCancelled: {TaskStatusRunning, TaskStatusSuccess},
+	}
+
+	for from, tos := range allowed {
+		for _, to := range tos {
+			require.True(t, from.CanTransitionTo(to), "%q to %q should be allowed", from, to)
+		}
+	}
+	for from, tos := range denied {
+		for _, to := range tos {
+			require.False(t, from.CanTransitionTo(to), "%q to %q should be denied", from, to)
+		}
+	}
+}
+
+func TestResourceLimitsOverride(t *testing.T) {
+	configured := ResourceLimits{CPUSeconds: 60, MemoryBytes: 1024, MaxProcesses: 10}
+
+	require.Equal(t, configured, configured.Override(nil))
+	require.Equal(t,
+		ResourceLimits{CPUSeconds: 30, MemoryBytes: 1024, MaxProcesses: 10, OpenFiles: 64},
+		configured.Override(&ResourceLimits{CPUSeconds: 30, MemoryBytes: 4096, OpenFiles: 64}),
+		"a task can only lower the configured limits")
+	require.Equal(t,
+		ResourceLimits{MemoryBytes: 512},
+		ResourceLimits{}.Override(&ResourceLimits{MemoryBytes: 512}))
+}
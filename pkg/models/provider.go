@@ -0,0 +1,54 @@
+package models
+
+import (
+	"encoding/json"
+	"regexp"
+	"time"
+)
+
+const maxProviderNameLength = 64
+
+var providerNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// IsValidProviderName reports whether name can be used as a provider name.
+// Names are used to find provider executables, so they are restricted to
+// lowercase letters, digits, - and _.
+func IsValidProviderName(name string) bool {
+	return len(name) <= maxProviderNameLength && providerNameRegexp.MatchString(name)
+}
+
+// Provider is a provider registered with the server. Jobs for the provider
+// must have a spec matching Schema, a JSON Schema document.
+type Provider struct {
+	Name        string          `json:"name" bson:"name"`
+	Schema      json.RawMessage `json:"schema,omitempty" bson:"schema,omitempty"`
+	LastUpdated time.Time       `json:"last_updated,omitempty" bson:"last_updated,omitempty"`
+}
+
+// ReasonProviderMissing is the result reason for tasks that were not run
+// because the node does not have their provider
+const ReasonProviderMissing = "provider_missing"
+
+// NodeProvider is a provider installed on a node
+type NodeProvider struct {
+	Name    string `json:"name" bson:"name"`
+	Version string `json:"version,omitempty" bson:"version,omitempty"`
+}
+
+// NextTaskRequest is sent by nodes asking for their next task
+type NextTaskRequest struct {
+	// Providers are the providers installed on the node. If nil, the node
+	// did not report its providers and may be sent tasks for any provider.
+	Providers []NodeProvider `json:"providers"`
+	// BusyProviders are providers the node has but cannot run another task
+	// for right now. Their tasks are left in the queue.
+	BusyProviders []string `json:"busy_providers,omitempty"`
+	// Wait is how many seconds the server may hold the request waiting for
+	// a task if there is none yet. Servers that support it send the
+	// LongPollHeader.
+	Wait int `json:"wait,omitempty"`
+}
+
+// LongPollHeader is sent by servers that support long polling for the next
+// task, with the longest wait they allow in seconds
+const LongPollHeader = "Foodtruck-Long-Poll"
@@ -0,0 +1,280 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+var ErrProviderNotFound = errors.New("provider not found")
+var ErrInvalidSpec = errors.New("invalid spec")
+
+// Builtin is a provider compiled into the client. Builtin providers do not
+// depend on anything being installed on the node, so they work on every
+// platform the client is built for.
+type Builtin interface {
+	// Version is the version advertised to the server for the provider
+	Version() string
+	// Run runs the task described by spec, reporting progress, logs and its
+	// result through r
+	Run(ctx context.Context, spec json.RawMessage, r *Reporter) error
+}
+
+type BuiltinOpts struct {
+	// ExplicitOnly makes the provider available only to clients that list
+	// it in their allowed providers. It is used for providers that run
+	// arbitrary commands from the spec.
+	ExplicitOnly bool
+}
+
+type BuiltinOpt func(*BuiltinOpts)
+
+// WithExplicitOnly makes a builtin provider available only when it is listed
+// in the allowed providers, rather than whenever no allowed providers are set
+func WithExplicitOnly() BuiltinOpt {
+	return func(opts *BuiltinOpts) {
+		opts.ExplicitOnly = true
+	}
+}
+
+type registeredBuiltin struct {
+	Builtin
+	opts BuiltinOpts
+}
+
+// available reports whether the provider may be run under name by a runner
+// with the given allowed providers
+func (b registeredBuiltin) available(name string, allowedProviders []string) bool {
+	if len(allowedProviders) == 0 {
+		return !b.opts.ExplicitOnly
+	}
+	return isAllowed(allowedProviders, name)
+}
+
+var (
+	builtinsMu sync.RWMutex
+	builtins   = map[string]registeredBuiltin{}
+)
+
+// RegisterBuiltin makes a builtin provider available under name. It panics if
+// the name is invalid or already registered.
+func RegisterBuiltin(name string, b Builtin, opts ...BuiltinOpt) {
+	builtinsMu.Lock()
+	defer builtinsMu.Unlock()
+
+	if !models.IsValidProviderName(name) {
+		panic(fmt.Sprintf("provider: invalid builtin provider name %q", name))
+	}
+	if _, ok := builtins[name]; ok {
+		panic(fmt.Sprintf("provider: builtin provider %q registered twice", name))
+	}
+	bopts := BuiltinOpts{}
+	for _, o := range opts {
+		o(&bopts)
+	}
+	builtins[name] = registeredBuiltin{Builtin: b, opts: bopts}
+}
+
+func lookupBuiltin(name string) (registeredBuiltin, bool) {
+	builtinsMu.RLock()
+	defer builtinsMu.RUnlock()
+	b, ok := builtins[name]
+	return b, ok
+}
+
+// Reporter is how a builtin provider reports what it is doing. It is the in
+// process equivalent of the provider protocol. It also holds the environment
+// the commands run by the provider are started in.
+type Reporter struct {
+	// Stdout and Stderr are where a provider writes the output of the
+	// commands it runs
+	Stdout io.Writer
+	Stderr io.Writer
+	// CachePath is a directory the provider may keep files in across runs.
+	// It is empty if no cache directory is available.
+	CachePath string
+	// Workdir is the working directory created for the task. It is removed
+	// after the task.
+	Workdir string
+	// HTTPClient is the client to download files with. It is configured
+	// with the client's CA bundle, proxy and TLS settings.
+	HTTPClient *http.Client
+
+	outputs    *Outputs
+	onProgress ProgressFunc
+	exec       *execEnv
+	fileRoots  []string
+	infra      InfraConfig
+}
+
+func newReporter(outputs *Outputs, onProgress ProgressFunc) *Reporter {
+	return &Reporter{
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		outputs:    outputs,
+		onProgress: onProgress,
+	}
+}
+
+// Progress reports the percentage of the task that is done
+func (r *Reporter) Progress(percent int, message string) {
+	r.handle(Message{Type: MessageTypeProgress, Percent: percent, Message: message})
+}
+
+// Logf records a log message with the given level
+func (r *Reporter) Logf(level string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Fprintf(r.Stderr, "[%s] %s\n", level, message)
+	r.handle(Message{Type: MessageTypeLog, Level: level, Message: message})
+}
+
+// Result records v, marshaled to json, as the result of the task
+func (r *Reporter) Result(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.handle(Message{Type: MessageTypeResult, Data: data})
+	return nil
+}
+
+// httpClient returns the client to download files with
+func (r *Reporter) httpClient() *http.Client {
+	if r == nil || r.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return r.HTTPClient
+}
+
+// prepare sets up cmd to run in the task's environment and send its output
+// to the reporter
+func (r *Reporter) prepare(cmd *exec.Cmd) {
+	if r.exec != nil {
+		r.exec.apply(cmd)
+	}
+	cmd.Stdout = r.Stdout
+	cmd.Stderr = r.Stderr
+}
+
+// own makes a file prepared for the task owned by the user the task runs as
+func (r *Reporter) own(path string) error {
+	if r.exec == nil {
+		return nil
+	}
+	return r.exec.own(path)
+}
+
+func (r *Reporter) handle(msg Message) {
+	if err := r.outputs.handle(msg, r.onProgress); err != nil {
+		r.outputs.addLog("warn", err.Error())
+	}
+}
+
+// BuiltinRunner runs the builtin providers
+type BuiltinRunner struct {
+	opts ExecRunnerOpts
+}
+
+// NewBuiltinRunner returns a runner for the builtin providers. The options
+// locating and verifying provider executables do not apply to builtin
+// providers.
+func NewBuiltinRunner(opts ...ExecRunnerOpt) *BuiltinRunner {
+	eopts := ExecRunnerOpts{}
+	for _, o := range opts {
+		o(&eopts)
+	}
+	return &BuiltinRunner{opts: eopts}
+}
+
+func (p *BuiltinRunner) Run(ctx context.Context, providerName string, spec json.RawMessage, opts ...RunOpt) (*Outputs, error) {
+	ropts := RunOpts{}
+	for _, o := range opts {
+		o(&ropts)
+	}
+
+	if err := validateProviderName(providerName); err != nil {
+		return nil, err
+	}
+	b, ok := lookupBuiltin(providerName)
+	if !ok {
+		return nil, fmt.Errorf("%w: no builtin provider %q", ErrProviderNotFound, providerName)
+	}
+	if !b.available(providerName, p.opts.AllowedProviders) {
+		// Fall back to a provider executable the operator installed, which
+		// the exec runner checks against the allowed providers
+		if b.opts.ExplicitOnly {
+			return nil, fmt.Errorf("%w: builtin provider %q must be listed in the allowed providers",
+				ErrProviderNotFound, providerName)
+		}
+		return nil, fmt.Errorf("%w: %q", ErrProviderNotAllowed, providerName)
+	}
+
+	e, cleanup, err := newExecEnv(p.opts, ropts)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	outputs := &Outputs{}
+	r := newReporter(outputs, ropts.OnProgress)
+	r.CachePath = p.cachePath()
+	r.Workdir = e.dir
+	r.HTTPClient = p.opts.HTTPClient
+	r.exec = e
+	r.fileRoots = p.opts.FileRoots
+	r.infra = p.opts.Infra
+	return outputs, b.Run(ctx, spec, r)
+}
+
+// cachePath returns the configured cache path, falling back to the user's
+// cache directory. It returns an empty string if neither is available.
+func (p *BuiltinRunner) cachePath() string {
+	if p.opts.CachePath != "" {
+		return p.opts.CachePath
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "foodtruck")
+}
+
+// Providers lists the builtin providers that are allowed to run
+func (p *BuiltinRunner) Providers() ([]models.NodeProvider, error) {
+	builtinsMu.RLock()
+	defer builtinsMu.RUnlock()
+
+	providers := []models.NodeProvider{}
+	for name, b := range builtins {
+		if !b.available(name, p.opts.AllowedProviders) {
+			continue
+		}
+		providers = append(providers, models.NodeProvider{Name: name, Version: b.Version()})
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name < providers[j].Name
+	})
+	return providers, nil
+}
+
+// decodeSpec decodes a builtin provider's spec, rejecting unknown fields so
+// typos in a job are not silently ignored
+func decodeSpec(spec json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(spec))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSpec, err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterBuiltin("file-download", fileDownloadProvider{})
+}
+
+// FileDownloadSpec is the spec of the file-download provider. For example:
+//
+//	{"url": "https://example.com/motd", "path": "/opt/app/motd", "sha256": "...", "mode": "0644"}
+type FileDownloadSpec struct {
+	URL  string `json:"url"`
+	Path string `json:"path"`
+	// SHA256 is the hex encoded checksum the download must match. If empty,
+	// the download is not verified.
+	SHA256 string `json:"sha256,omitempty"`
+	// Mode is the octal file mode of the file. It defaults to 0644.
+	Mode string `json:"mode,omitempty"`
+}
+
+// FileDownloadResult is the result reported by the file-download provider
+type FileDownloadResult struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+type fileDownloadProvider struct{}
+
+func (fileDownloadProvider) Version() string {
+	return "1.0.0"
+}
+
+func (fileDownloadProvider) Run(ctx context.Context, rawSpec json.RawMessage, r *Reporter) error {
+	spec := FileDownloadSpec{}
+	if err := decodeSpec(rawSpec, &spec); err != nil {
+		return err
+	}
+	if spec.URL == "" || spec.Path == "" {
+		return fmt.Errorf("%w: url and path must be provided", ErrInvalidSpec)
+	}
+	mode, err := parseFileMode(spec.Mode, 0644)
+	if err != nil {
+		return err
+	}
+	dest, err := r.destination(spec.Path)
+	if err != nil {
+		return err
+	}
+
+	r.Logf("info", "downloading %s to %s", spec.URL, spec.Path)
+	result, err := downloadFile(ctx, r.httpClient(), spec.URL, dest, spec.SHA256, mode, r)
+	if err != nil {
+		return err
+	}
+	result.Path = spec.Path
+	return r.Result(result)
+}
+
+// downloadFile downloads url to path with client. The file is written next
+// to path and renamed into place once it is complete and matches the
+// checksum, so path is never left partially written. Progress is reported to
+// r if it is not nil.
+func downloadFile(ctx context.Context, client *http.Client, url string, path string, checksum string, mode os.FileMode,
+	r *Reporter) (*FileDownloadResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".foodtruck")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	body := io.TeeReader(resp.Body, h)
+	if r != nil && resp.ContentLength > 0 {
+		body = &progressReader{r: body, total: resp.ContentLength, reporter: r}
+	}
+	size, err := io.Copy(tmp, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if checksum != "" && actual != strings.ToLower(checksum) {
+		return nil, fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrChecksumMismatch, url, actual, checksum)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+
+	return &FileDownloadResult{Path: path, SHA256: actual, Size: size}, nil
+}
+
+// progressReader reports the progress of a download as it is read
+type progressReader struct {
+	r        io.Reader
+	read     int64
+	total    int64
+	percent  int
+	reporter *Reporter
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if percent := int(p.read * 100 / p.total); percent != p.percent && percent <= 100 {
+		p.percent = percent
+		p.reporter.Progress(percent, "downloading")
+	}
+	return n, err
+}
+
+// parseFileMode parses an octal file mode such as "0644", returning def if
+// mode is empty
+func parseFileMode(mode string, def os.FileMode) (os.FileMode, error) {
+	if mode == "" {
+		return def, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("%w: invalid mode %q", ErrInvalidSpec, mode)
+	}
+	return os.FileMode(m), nil
+}
@@ -0,0 +1,169 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	RegisterBuiltin("file", fileProvider{})
+}
+
+// FileSpec is the spec of the file provider. For example:
+//
+//	{
+//	    "files": [
+//	        {
+//	            "urls": ["https://mirror1.example.com/app.tar.gz", "https://mirror2.example.com/app.tar.gz"],
+//	            "sha256": "...",
+//	            "path": "/opt/app/app.tar.gz",
+//	            "mode": "0640",
+//	            "owner": "app",
+//	            "group": "app"
+//	        }
+//	    ]
+//	}
+type FileSpec struct {
+	Files []FileSpecFile `json:"files"`
+}
+
+type FileSpecFile struct {
+	// URLs are tried in order until the file is downloaded
+	URLs []string `json:"urls"`
+	// SHA256 is the hex encoded checksum of the file. It is required, and is
+	// used to find the file in the cache.
+	SHA256 string `json:"sha256"`
+	Path   string `json:"path"`
+	// Mode is the octal file mode of the file. It defaults to 0644.
+	Mode string `json:"mode,omitempty"`
+	// Owner and Group are the names or ids of the user and group that own
+	// the file. They are not supported on Windows.
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// FileResult is the result reported by the file provider
+type FileResult struct {
+	Files []FileResultFile `json:"files"`
+}
+
+type FileResultFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	// Cached is true if the file was not downloaded because it was cached
+	Cached bool `json:"cached"`
+	// Changed is true if the file at the path was replaced
+	Changed bool `json:"changed"`
+}
+
+type fileProvider struct{}
+
+func (fileProvider) Version() string {
+	return "1.0.0"
+}
+
+func (fileProvider) Run(ctx context.Context, rawSpec json.RawMessage, r *Reporter) error {
+	spec := FileSpec{}
+	if err := decodeSpec(rawSpec, &spec); err != nil {
+		return err
+	}
+	if len(spec.Files) == 0 {
+		return fmt.Errorf("%w: files must be provided", ErrInvalidSpec)
+	}
+	modes := make([]os.FileMode, len(spec.Files))
+	for i, f := range spec.Files {
+		if len(f.URLs) == 0 || f.SHA256 == "" || f.Path == "" {
+			return fmt.Errorf("%w: files[%d] must have urls, sha256 and path", ErrInvalidSpec, i)
+		}
+		// The checksums of files on disk are compared in lowercase hex
+		spec.Files[i].SHA256 = strings.ToLower(f.SHA256)
+		if !sha256Regex.MatchString(spec.Files[i].SHA256) {
+			return fmt.Errorf("%w: files[%d] has an invalid sha256 %q", ErrInvalidSpec, i, f.SHA256)
+		}
+		mode, err := parseFileMode(f.Mode, 0644)
+		if err != nil {
+			return err
+		}
+		modes[i] = mode
+	}
+	if r.CachePath == "" {
+		return fmt.Errorf("the file provider requires a cache path")
+	}
+
+	cache := newFileCache(r.CachePath)
+	result := FileResult{}
+	for i, f := range spec.Files {
+		r.Progress(i*100/len(spec.Files), fmt.Sprintf("fetching %s", f.Path))
+		dest, err := r.destination(f.Path)
+		if err != nil {
+			return err
+		}
+		cached, wasCached, err := cache.Fetch(ctx, f.SHA256, f.URLs, r)
+		if err != nil {
+			return err
+		}
+
+		changed, err := installFile(cached, dest, f.SHA256, modes[i])
+		if err != nil {
+			return err
+		}
+		if err := chownFile(dest, f.Owner, f.Group); err != nil {
+			return err
+		}
+		if changed {
+			r.Logf("info", "updated %s", f.Path)
+		}
+
+		result.Files = append(result.Files, FileResultFile{
+			Path:    f.Path,
+			SHA256:  f.SHA256,
+			Cached:  wasCached,
+			Changed: changed,
+		})
+	}
+	r.Progress(100, "done")
+
+	return r.Result(result)
+}
+
+// installFile copies the cached file src to dest unless dest is already a
+// file with the same content, and sets its mode. The copy is renamed into
+// place so dest is never partially written, and a symlink at dest is replaced
+// rather than followed. It returns whether dest was replaced.
+func installFile(src string, dest string, checksum string, mode os.FileMode) (bool, error) {
+	if info, err := os.Lstat(dest); err == nil && info.Mode().IsRegular() {
+		if sum, err := fileSHA256(dest); err == nil && sum == checksum {
+			return false, os.Chmod(dest, mode)
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".foodtruck")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), dest)
+}
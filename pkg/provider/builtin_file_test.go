@@ -0,0 +1,204 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileProvider(t *testing.T) {
+	content := bytes.Repeat([]byte("foodtruck"), 1000)
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("Range"))
+		mu.Unlock()
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	takeRequests := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		r := requests
+		requests = nil
+		return r
+	}
+
+	dir, err := ioutil.TempDir("", "foodtruck-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "cache")
+
+	run := func(t *testing.T, files ...FileSpecFile) (FileResult, error) {
+		spec, err := json.Marshal(FileSpec{Files: files})
+		require.NoError(t, err)
+		r := NewBuiltinRunner(WithCachePath(cachePath), WithFileRoots([]string{dir}))
+		outputs, err := r.Run(context.Background(), "file", spec)
+		result := FileResult{}
+		if outputs != nil && outputs.Output != nil {
+			require.NoError(t, json.Unmarshal(outputs.Output, &result))
+		}
+		return result, err
+	}
+
+	dest := filepath.Join(dir, "dest", "file")
+
+	t.Run("downloads the file from the first url that works", func(t *testing.T) {
+		result, err := run(t, FileSpecFile{
+			URLs:   []string{server.URL + "/missing", server.URL + "/file"},
+			SHA256: checksum,
+			Path:   dest,
+			Mode:   "0600",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []FileResultFile{{Path: dest, SHA256: checksum, Cached: false, Changed: true}}, result.Files)
+		require.Equal(t, []string{"/missing ", "/file "}, takeRequests())
+
+		data, err := ioutil.ReadFile(dest)
+		require.NoError(t, err)
+		require.Equal(t, content, data)
+		if runtime.GOOS != "windows" {
+			info, err := os.Stat(dest)
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		}
+	})
+
+	t.Run("uses the cache and leaves unchanged files alone", func(t *testing.T) {
+		result, err := run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: checksum, Path: dest})
+		require.NoError(t, err)
+		require.Equal(t, []FileResultFile{{Path: dest, SHA256: checksum, Cached: true, Changed: false}}, result.Files)
+		require.Empty(t, takeRequests())
+
+		other := filepath.Join(dir, "dest", "other")
+		result, err = run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: checksum, Path: other})
+		require.NoError(t, err)
+		require.Equal(t, []FileResultFile{{Path: other, SHA256: checksum, Cached: true, Changed: true}}, result.Files)
+		require.Empty(t, takeRequests())
+	})
+
+	t.Run("compares checksums in any case", func(t *testing.T) {
+		result, err := run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: strings.ToUpper(checksum), Path: dest})
+		require.NoError(t, err)
+		require.Equal(t, []FileResultFile{{Path: dest, SHA256: checksum, Cached: true, Changed: false}}, result.Files)
+		require.Empty(t, takeRequests())
+	})
+
+	cache := newFileCache(cachePath)
+
+	t.Run("resumes partial downloads", func(t *testing.T) {
+		require.NoError(t, os.Remove(cache.path(checksum)))
+		require.NoError(t, ioutil.WriteFile(cache.partialPath(checksum), content[:100], 0600))
+
+		result, err := run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: checksum, Path: dest})
+		require.NoError(t, err)
+		require.False(t, result.Files[0].Cached)
+		require.Equal(t, []string{"/file bytes=100-"}, takeRequests())
+
+		data, err := ioutil.ReadFile(cache.path(checksum))
+		require.NoError(t, err)
+		require.Equal(t, content, data)
+	})
+
+	t.Run("downloads again if a resumed download is corrupt", func(t *testing.T) {
+		require.NoError(t, os.Remove(cache.path(checksum)))
+		require.NoError(t, ioutil.WriteFile(cache.partialPath(checksum), bytes.Repeat([]byte("x"), 100), 0600))
+
+		_, err := run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: checksum, Path: dest})
+		require.NoError(t, err)
+		require.Equal(t, []string{"/file bytes=100-", "/file "}, takeRequests())
+	})
+
+	t.Run("fails files that do not match the checksum", func(t *testing.T) {
+		other := sha256.Sum256([]byte("other"))
+		_, err := run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: hex.EncodeToString(other[:]), Path: filepath.Join(dir, "mismatch")})
+		require.True(t, errors.Is(err, ErrChecksumMismatch))
+		_, err = os.Stat(filepath.Join(dir, "mismatch"))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("sets the owner", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("owners are not supported on windows")
+		}
+		_, err := run(t, FileSpecFile{
+			URLs:   []string{server.URL + "/file"},
+			SHA256: checksum,
+			Path:   dest,
+			Owner:  strconv.Itoa(os.Getuid()),
+			Group:  strconv.Itoa(os.Getgid()),
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("only writes files in the file roots", func(t *testing.T) {
+		outside, err := ioutil.TempDir("", "foodtruck-outside")
+		require.NoError(t, err)
+		defer os.RemoveAll(outside)
+
+		_, err = run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: checksum, Path: filepath.Join(outside, "file")})
+		require.True(t, errors.Is(err, ErrPathNotAllowed))
+		_, err = run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: checksum, Path: dir + "/../file"})
+		require.True(t, errors.Is(err, ErrPathNotAllowed))
+		_, err = run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: checksum, Path: "dest/file"})
+		require.True(t, errors.Is(err, ErrInvalidSpec))
+
+		if runtime.GOOS == "windows" {
+			t.Skip("creating symlinks requires privileges on windows")
+		}
+		require.NoError(t, os.Symlink(outside, filepath.Join(dir, "link")))
+		_, err = run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: checksum, Path: filepath.Join(dir, "link", "file")})
+		require.True(t, errors.Is(err, ErrPathNotAllowed))
+
+		target := filepath.Join(outside, "target")
+		require.NoError(t, ioutil.WriteFile(target, []byte("keep"), 0644))
+		link := filepath.Join(dir, "dest", "symlink")
+		require.NoError(t, os.Symlink(target, link))
+		_, err = run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: checksum, Path: link})
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(target)
+		require.NoError(t, err)
+		require.Equal(t, "keep", string(data), "symlinks at the destination are replaced, not followed")
+		info, err := os.Lstat(link)
+		require.NoError(t, err)
+		require.True(t, info.Mode().IsRegular())
+		takeRequests()
+	})
+
+	t.Run("rejects invalid specs", func(t *testing.T) {
+		_, err := run(t)
+		require.True(t, errors.Is(err, ErrInvalidSpec))
+
+		_, err = run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: "abc", Path: dest})
+		require.True(t, errors.Is(err, ErrInvalidSpec))
+
+		_, err = run(t, FileSpecFile{URLs: []string{server.URL + "/file"}, SHA256: checksum, Path: dest, Mode: "rw"})
+		require.True(t, errors.Is(err, ErrInvalidSpec))
+	})
+}
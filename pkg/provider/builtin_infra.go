@@ -0,0 +1,203 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+func init() {
+	RegisterBuiltin("infra", infraProvider{})
+}
+
+// InfraSpec is the spec of the infra provider. For example:
+//
+//	{"url": "https://example.com/policy.tar.gz", "sha256": "...", "json_params": {"foo": "bar"}}
+type InfraSpec struct {
+	// URL is the policy archive created by chef export. It must be a gzipped
+	// tarball with an out directory.
+	URL string `json:"url"`
+	// SHA256 is the hex encoded checksum the archive must match. If empty,
+	// the archive is not verified.
+	SHA256 string `json:"sha256,omitempty"`
+	// JSONParams are attributes passed to chef-client with -j. They may be
+	// given as an object or as a string holding json.
+	JSONParams json.RawMessage `json:"json_params,omitempty"`
+	// KeepCache skips removing the chef-client cache after the run
+	KeepCache bool `json:"keep_cache,omitempty"`
+}
+
+// InfraConfig is how the infra provider runs chef-client on the node. It is
+// part of the client's config rather than the spec, so tasks cannot choose
+// what is run or which directory is removed.
+type InfraConfig struct {
+	// ChefClientPath is the chef-client executable. It defaults to
+	// chef-client in $PATH.
+	ChefClientPath string `json:"chef_client_path"`
+	// ChefClientArgs replace the default arguments passed to chef-client
+	// after -z.
+	ChefClientArgs []string `json:"chef_client_args"`
+	// CachePath is the chef-client cache removed after the run. It defaults
+	// to the chef-client default for the platform.
+	CachePath string `json:"cache_path"`
+}
+
+// InfraPhase is a step of running the infra provider
+type InfraPhase string
+
+const (
+	InfraPhaseDownload InfraPhase = "download"
+	InfraPhaseExtract  InfraPhase = "extract"
+	InfraPhaseConverge InfraPhase = "converge"
+	InfraPhaseCleanup  InfraPhase = "cleanup"
+	InfraPhaseDone     InfraPhase = "done"
+)
+
+// InfraResult is the result reported by the infra provider. If the run
+// failed, Phase is the phase it failed in.
+type InfraResult struct {
+	Phase  InfraPhase `json:"phase"`
+	SHA256 string     `json:"sha256,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+var defaultChefClientArgs = []string{
+	"--log-level", "debug",
+	"--minimal-ohai",
+	"--chef-license", "accept",
+}
+
+type infraProvider struct{}
+
+func (infraProvider) Version() string {
+	return "1.0.0"
+}
+
+func (infraProvider) Run(ctx context.Context, rawSpec json.RawMessage, r *Reporter) error {
+	spec := InfraSpec{}
+	if err := decodeSpec(rawSpec, &spec); err != nil {
+		return err
+	}
+	if spec.URL == "" {
+		return fmt.Errorf("%w: url must be provided", ErrInvalidSpec)
+	}
+	jsonParams, err := infraJSONParams(spec.JSONParams)
+	if err != nil {
+		return err
+	}
+
+	result := &InfraResult{}
+	err = runInfra(ctx, spec, jsonParams, result, r)
+	if err != nil {
+		result.Error = err.Error()
+		r.Logf("error", "%s failed: %s", result.Phase, err)
+	} else {
+		result.Phase = InfraPhaseDone
+	}
+	if rerr := r.Result(result); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func runInfra(ctx context.Context, spec InfraSpec, jsonParams []byte, result *InfraResult, r *Reporter) error {
+	result.Phase = InfraPhaseDownload
+	r.Progress(0, "downloading policy archive")
+	tmpdir, err := ioutil.TempDir(r.Workdir, "foodtruck-infra")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	archivePath := filepath.Join(tmpdir, "policy.tar.gz")
+	download, err := downloadFile(ctx, r.httpClient(), spec.URL, archivePath, spec.SHA256, 0600, nil)
+	if err != nil {
+		return err
+	}
+	result.SHA256 = download.SHA256
+
+	result.Phase = InfraPhaseExtract
+	r.Progress(30, "extracting policy archive")
+	policyDir := filepath.Join(tmpdir, "policy")
+	if err := extractTarGz(archivePath, policyDir); err != nil {
+		return err
+	}
+	outDir := filepath.Join(policyDir, "out")
+	if info, err := os.Stat(outDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("policy archive does not have an out directory")
+	}
+
+	result.Phase = InfraPhaseConverge
+	r.Progress(40, "running chef-client")
+	args := []string{"-z"}
+	if r.infra.ChefClientArgs != nil {
+		args = append(args, r.infra.ChefClientArgs...)
+	} else {
+		args = append(args, defaultChefClientArgs...)
+	}
+	if jsonParams != nil {
+		paramsPath := filepath.Join(tmpdir, "json_params.json")
+		if err := ioutil.WriteFile(paramsPath, jsonParams, 0600); err != nil {
+			return err
+		}
+		if err := r.own(paramsPath); err != nil {
+			return err
+		}
+		args = append(args, "-j", paramsPath)
+	}
+
+	chefClient := r.infra.ChefClientPath
+	if chefClient == "" {
+		chefClient = "chef-client"
+	}
+	cmd := exec.Command(chefClient, args...)
+	cmd.Dir = outDir
+	if err := runCommand(ctx, cmd, r); err != nil {
+		return err
+	}
+
+	result.Phase = InfraPhaseCleanup
+	r.Progress(95, "cleaning up")
+	if !spec.KeepCache {
+		cachePath := r.infra.CachePath
+		if cachePath == "" {
+			cachePath = defaultChefCachePath()
+		}
+		if err := os.RemoveAll(cachePath); err != nil {
+			return err
+		}
+	}
+
+	r.Progress(100, "done")
+	return nil
+}
+
+// infraJSONParams returns the json passed to chef-client with -j, or nil if
+// there is none. The script this provider replaced accepted both an object
+// and a string holding json, so both are still accepted.
+func infraJSONParams(raw json.RawMessage) ([]byte, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		raw = json.RawMessage(s)
+	}
+	var params map[string]interface{}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, fmt.Errorf("%w: json_params must be an object: %s", ErrInvalidSpec, err)
+	}
+	return raw, nil
+}
+
+func defaultChefCachePath() string {
+	if runtime.GOOS == "windows" {
+		return `C:\chef\cache`
+	}
+	return "/var/chef/cache"
+}
@@ -0,0 +1,141 @@
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfraProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake chef-client is a shell script")
+	}
+
+	archive := makeTarGz(t, []tarEntry{
+		{name: "out/", typeflag: tar.TypeDir},
+		{name: "out/Policyfile.lock.json", content: "{}"},
+	})
+	sum := sha256.Sum256(archive)
+	checksum := hex.EncodeToString(sum[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "foodtruck-infra-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The fake chef-client records how it was run
+	record := filepath.Join(dir, "record")
+	chefClient := filepath.Join(dir, "chef-client")
+	require.NoError(t, ioutil.WriteFile(chefClient, []byte(`#!/bin/sh
+pwd > `+record+`
+echo "$@" >> `+record+`
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-j" ]; then cat "$2" >> `+record+`; fi
+  shift
+done
+exit ${FAKE_CHEF_EXIT:-0}
+`), 0755))
+
+	cachePath := filepath.Join(dir, "cache")
+
+	config := InfraConfig{ChefClientPath: chefClient, CachePath: cachePath}
+	runWithConfig := func(config InfraConfig, spec map[string]interface{}, opts ...RunOpt) (*Outputs, error) {
+		data, err := json.Marshal(spec)
+		require.NoError(t, err)
+		return NewBuiltinRunner(WithInfraConfig(config)).Run(context.Background(), "infra", data, opts...)
+	}
+	run := func(spec map[string]interface{}, opts ...RunOpt) (*Outputs, error) {
+		return runWithConfig(config, spec, opts...)
+	}
+
+	result := func(outputs *Outputs) InfraResult {
+		r := InfraResult{}
+		require.NoError(t, json.Unmarshal(outputs.Output, &r))
+		return r
+	}
+
+	t.Run("runs chef-client in the policy", func(t *testing.T) {
+		require.NoError(t, os.MkdirAll(cachePath, 0755))
+
+		outputs, err := run(map[string]interface{}{
+			"url":         server.URL,
+			"sha256":      checksum,
+			"json_params": map[string]string{"foo": "bar"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, InfraPhaseDone, result(outputs).Phase)
+		require.Equal(t, 100, outputs.Progress)
+
+		data, err := ioutil.ReadFile(record)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		require.Len(t, lines, 3)
+		require.True(t, strings.HasSuffix(lines[0], filepath.Join("policy", "out")))
+		require.True(t, strings.HasPrefix(lines[1], "-z --log-level debug --minimal-ohai --chef-license accept -j "))
+		require.JSONEq(t, `{"foo": "bar"}`, lines[2])
+
+		_, err = os.Stat(cachePath)
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("passes configured args and json params given as a string", func(t *testing.T) {
+		config := config
+		config.ChefClientArgs = []string{"--once"}
+		_, err := runWithConfig(config, map[string]interface{}{
+			"url":         server.URL,
+			"json_params": `{"foo": "baz"}`,
+		})
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(record)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		require.True(t, strings.HasPrefix(lines[1], "-z --once -j "))
+		require.JSONEq(t, `{"foo": "baz"}`, lines[2])
+	})
+
+	t.Run("does not let tasks choose what is run or removed", func(t *testing.T) {
+		for _, field := range []string{"chef_client_path", "chef_client_args", "cache_path"} {
+			_, err := run(map[string]interface{}{
+				"url": server.URL,
+				field: "/",
+			})
+			require.True(t, errors.Is(err, ErrInvalidSpec), field)
+		}
+	})
+
+	t.Run("reports the phase that failed", func(t *testing.T) {
+		outputs, err := run(map[string]interface{}{
+			"url":    server.URL,
+			"sha256": checksum[1:] + "0",
+		})
+		require.True(t, errors.Is(err, ErrChecksumMismatch))
+		require.Equal(t, InfraPhaseDownload, result(outputs).Phase)
+
+		outputs, err = run(map[string]interface{}{
+			"url": server.URL,
+		}, WithEnv(map[string]string{"FAKE_CHEF_EXIT": "3"}))
+		exitErr := &exec.ExitError{}
+		require.True(t, errors.As(err, &exitErr))
+		require.Equal(t, 3, exitErr.ExitCode())
+		require.Equal(t, InfraPhaseConverge, result(outputs).Phase)
+	})
+}
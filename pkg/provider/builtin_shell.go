@@ -0,0 +1,132 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+func init() {
+	// They run whatever the job asks, so nodes have to opt in to them
+	RegisterBuiltin("shell", shellProvider{}, WithExplicitOnly())
+	RegisterBuiltin("script", scriptProvider{}, WithExplicitOnly())
+}
+
+// ShellSpec is the spec of the shell provider. For example:
+//
+//	{"command": "systemctl restart nginx"}
+type ShellSpec struct {
+	// Command is run with /bin/sh -c, or cmd.exe /C on Windows
+	Command string `json:"command"`
+}
+
+type shellProvider struct{}
+
+func (shellProvider) Version() string {
+	return "1.0.0"
+}
+
+func (shellProvider) Run(ctx context.Context, rawSpec json.RawMessage, r *Reporter) error {
+	spec := ShellSpec{}
+	if err := decodeSpec(rawSpec, &spec); err != nil {
+		return err
+	}
+	if spec.Command == "" {
+		return fmt.Errorf("%w: command must be provided", ErrInvalidSpec)
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd.exe", "/C", spec.Command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", spec.Command)
+	}
+	return runCommand(ctx, cmd, r)
+}
+
+// ScriptSpec is the spec of the script provider. For example:
+//
+//	{"interpreter": ["/bin/bash"], "script": "echo $1", "args": ["hello"]}
+type ScriptSpec struct {
+	// Interpreter is the command the script file is passed to. It defaults
+	// to /bin/sh, or PowerShell on Windows.
+	Interpreter []string `json:"interpreter,omitempty"`
+	// Script is the content of the script
+	Script string `json:"script"`
+	// Args are passed to the script after its path
+	Args []string `json:"args,omitempty"`
+}
+
+type scriptProvider struct{}
+
+func (scriptProvider) Version() string {
+	return "1.0.0"
+}
+
+func (scriptProvider) Run(ctx context.Context, rawSpec json.RawMessage, r *Reporter) error {
+	spec := ScriptSpec{}
+	if err := decodeSpec(rawSpec, &spec); err != nil {
+		return err
+	}
+	if spec.Script == "" {
+		return fmt.Errorf("%w: script must be provided", ErrInvalidSpec)
+	}
+
+	interpreter := spec.Interpreter
+	ext := ""
+	if len(interpreter) == 0 {
+		interpreter, ext = defaultInterpreter()
+	}
+
+	dir, err := ioutil.TempDir(r.Workdir, "foodtruck-script")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	scriptPath := filepath.Join(dir, "script"+ext)
+	if err := ioutil.WriteFile(scriptPath, []byte(spec.Script), 0700); err != nil {
+		return err
+	}
+	for _, p := range []string{dir, scriptPath} {
+		if err := r.own(p); err != nil {
+			return err
+		}
+	}
+
+	args := append(append(interpreter[1:len(interpreter):len(interpreter)], scriptPath), spec.Args...)
+	return runCommand(ctx, exec.Command(interpreter[0], args...), r)
+}
+
+// defaultInterpreter returns the interpreter used for scripts that do not
+// name one, and the extension the interpreter expects scripts to have
+func defaultInterpreter() ([]string, string) {
+	if runtime.GOOS == "windows" {
+		return []string{"powershell.exe", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File"}, ".ps1"
+	}
+	return []string{"/bin/sh"}, ""
+}
+
+// runCommand runs a command for a builtin provider in the task's environment,
+// sending its output to the reporter. The command is terminated if ctx is
+// done before it exits.
+func runCommand(ctx context.Context, cmd *exec.Cmd, r *Reporter) error {
+	r.prepare(cmd)
+	r.Logf("info", "running %s", cmd.Path)
+	if r.exec == nil {
+		setProcessGroup(cmd)
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		return waitContext(ctx, cmd)
+	}
+	if err := r.exec.start(cmd); err != nil {
+		return err
+	}
+	return r.exec.wait(ctx, cmd)
+}
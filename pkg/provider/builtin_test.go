@@ -0,0 +1,211 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinRunner(t *testing.T) {
+	t.Run("lists the builtin providers", func(t *testing.T) {
+		providers, err := NewBuiltinRunner().Providers()
+		require.NoError(t, err)
+		require.Equal(t, []models.NodeProvider{
+			{Name: "file", Version: "1.0.0"},
+			{Name: "file-download", Version: "1.0.0"},
+			{Name: "infra", Version: "1.0.0"},
+		}, providers)
+
+		providers, err = NewBuiltinRunner(WithAllowedProviders([]string{"shell"})).Providers()
+		require.NoError(t, err)
+		require.Equal(t, []models.NodeProvider{{Name: "shell", Version: "1.0.0"}}, providers)
+	})
+
+	t.Run("does not run unknown or disallowed providers", func(t *testing.T) {
+		_, err := NewBuiltinRunner().Run(context.Background(), "custom", []byte(`{}`))
+		require.True(t, errors.Is(err, ErrProviderNotFound))
+
+		_, err = NewBuiltinRunner(WithAllowedProviders([]string{"script"})).Run(context.Background(), "file", []byte(`{}`))
+		require.True(t, errors.Is(err, ErrProviderNotAllowed))
+	})
+
+	t.Run("only runs command providers that are explicitly allowed", func(t *testing.T) {
+		for _, name := range []string{"shell", "script"} {
+			_, err := NewBuiltinRunner().Run(context.Background(), name, []byte(`{}`))
+			require.True(t, errors.Is(err, ErrProviderNotFound), name)
+
+			_, err = NewBuiltinRunner(WithAllowedProviders([]string{"file"})).Run(context.Background(), name, []byte(`{}`))
+			require.True(t, errors.Is(err, ErrProviderNotFound), name)
+
+			_, err = NewBuiltinRunner(WithAllowedProviders([]string{name})).Run(context.Background(), name, []byte(`{}`))
+			require.True(t, errors.Is(err, ErrInvalidSpec), name)
+		}
+	})
+
+	t.Run("rejects invalid specs", func(t *testing.T) {
+		r := NewBuiltinRunner(WithAllowedProviders([]string{"shell"}))
+		_, err := r.Run(context.Background(), "shell", []byte(`{"cmd": "true"}`))
+		require.True(t, errors.Is(err, ErrInvalidSpec))
+
+		_, err = r.Run(context.Background(), "shell", []byte(`{}`))
+		require.True(t, errors.Is(err, ErrInvalidSpec))
+	})
+}
+
+func TestShellProviders(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the tests use /bin/sh")
+	}
+
+	run := func(providerName string, spec string) (string, error) {
+		out := &bytes.Buffer{}
+		r := newReporter(&Outputs{}, nil)
+		r.Stdout = out
+		r.Stderr = ioutil.Discard
+		b, _ := lookupBuiltin(providerName)
+		err := b.Run(context.Background(), []byte(spec), r)
+		return out.String(), err
+	}
+
+	t.Run("shell runs the command", func(t *testing.T) {
+		out, err := run("shell", `{"command": "echo hello"}`)
+		require.NoError(t, err)
+		require.Equal(t, "hello\n", out)
+
+		_, err = run("shell", `{"command": "exit 4"}`)
+		exitErr := &exec.ExitError{}
+		require.True(t, errors.As(err, &exitErr))
+		require.Equal(t, 4, exitErr.ExitCode())
+	})
+
+	t.Run("script runs the script with its args", func(t *testing.T) {
+		out, err := run("script", `{"script": "echo \"$1 $2\"", "args": ["hello", "world"]}`)
+		require.NoError(t, err)
+		require.Equal(t, "hello world\n", out)
+	})
+}
+
+func TestFileDownloadProvider(t *testing.T) {
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "foodtruck-download")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("downloads and verifies the file", func(t *testing.T) {
+		path := filepath.Join(dir, "a", "file.txt")
+		outputs, err := NewBuiltinRunner(WithFileRoots([]string{dir})).Run(context.Background(), "file-download",
+			[]byte(`{"url": "`+server.URL+`", "path": "`+filepath.ToSlash(path)+`", "sha256": "`+checksum+`", "mode": "0600"}`))
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, content, data)
+		require.Equal(t, 100, outputs.Progress)
+		require.JSONEq(t, `{"path": "`+filepath.ToSlash(path)+`", "sha256": "`+checksum+`", "size": 11}`, string(outputs.Output))
+
+		if runtime.GOOS != "windows" {
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		}
+	})
+
+	t.Run("does not write files that do not match the checksum", func(t *testing.T) {
+		path := filepath.Join(dir, "mismatch.txt")
+		_, err := NewBuiltinRunner(WithFileRoots([]string{dir})).Run(context.Background(), "file-download",
+			[]byte(`{"url": "`+server.URL+`", "path": "`+filepath.ToSlash(path)+`", "sha256": "`+checksum[1:]+`0"}`))
+		require.True(t, errors.Is(err, ErrChecksumMismatch))
+
+		_, err = os.Stat(path)
+		require.True(t, os.IsNotExist(err))
+		entries, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	})
+
+	t.Run("only writes files in the file roots", func(t *testing.T) {
+		path := filepath.Join(dir, "file.txt")
+		_, err := NewBuiltinRunner().Run(context.Background(), "file-download",
+			[]byte(`{"url": "`+server.URL+`", "path": "`+filepath.ToSlash(path)+`"}`))
+		require.True(t, errors.Is(err, ErrPathNotAllowed))
+
+		_, err = os.Stat(path)
+		require.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestChainRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "foodtruck-providers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foodtruck-provider-custom"), []byte("#!/bin/sh\nexit 0\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foodtruck-provider-shell"), []byte("#!/bin/sh\nexit 0\n"), 0755))
+
+	r := NewChainRunner(NewBuiltinRunner(), NewExecRunner(WithProvidersPath(dir)))
+
+	t.Run("prefers builtin providers", func(t *testing.T) {
+		allowed := []string{"custom", "file", "shell"}
+		r := NewChainRunner(NewBuiltinRunner(WithAllowedProviders(allowed)),
+			NewExecRunner(WithProvidersPath(dir), WithAllowedProviders(allowed)))
+		providers, err := r.Providers()
+		require.NoError(t, err)
+		require.Equal(t, []models.NodeProvider{
+			{Name: "custom"},
+			{Name: "file", Version: "1.0.0"},
+			{Name: "shell", Version: "1.0.0"},
+		}, providers)
+
+		_, err = r.Run(context.Background(), "shell", []byte(`{}`))
+		require.True(t, errors.Is(err, ErrInvalidSpec))
+	})
+
+	t.Run("only runs provider executables that are explicitly allowed", func(t *testing.T) {
+		providers, err := r.Providers()
+		require.NoError(t, err)
+		require.Equal(t, []models.NodeProvider{
+			{Name: "file", Version: "1.0.0"},
+			{Name: "file-download", Version: "1.0.0"},
+			{Name: "infra", Version: "1.0.0"},
+		}, providers)
+
+		_, err = r.Run(context.Background(), "shell", []byte(`{}`))
+		require.True(t, errors.Is(err, ErrProviderNotAllowed))
+		_, err = r.Run(context.Background(), "custom", []byte(`{}`))
+		require.True(t, errors.Is(err, ErrProviderNotAllowed))
+	})
+
+	t.Run("falls back to provider executables", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("the provider is a shell script")
+		}
+		allowed := []string{"custom", "missing"}
+		r := NewChainRunner(NewBuiltinRunner(WithAllowedProviders(allowed)),
+			NewExecRunner(WithProvidersPath(dir), WithAllowedProviders(allowed)))
+		_, err := r.Run(context.Background(), "custom", []byte(`{}`))
+		require.NoError(t, err)
+
+		_, err = r.Run(context.Background(), "missing", []byte(`{}`))
+		require.True(t, errors.Is(err, ErrProviderNotFound))
+	})
+}
@@ -0,0 +1,68 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+// ListingRunner is a Runner that can list the providers it is able to run
+type ListingRunner interface {
+	Runner
+	Providers() ([]models.NodeProvider, error)
+}
+
+// ChainRunner runs a provider with the first of its runners that has it. It
+// is used to prefer the builtin providers while still supporting provider
+// executables.
+type ChainRunner struct {
+	runners []ListingRunner
+}
+
+func NewChainRunner(runners ...ListingRunner) *ChainRunner {
+	return &ChainRunner{runners: runners}
+}
+
+func (c *ChainRunner) Run(ctx context.Context, providerName string, spec json.RawMessage, opts ...RunOpt) (*Outputs, error) {
+	var err error
+	for _, r := range c.runners {
+		var outputs *Outputs
+		outputs, err = r.Run(ctx, providerName, spec, opts...)
+		if !errors.Is(err, ErrProviderNotFound) {
+			return outputs, err
+		}
+	}
+	if err == nil {
+		err = ErrProviderNotFound
+	}
+	return nil, err
+}
+
+// Providers lists the providers of all the runners. If more than one runner
+// has a provider, the version of the one that would run it is listed.
+func (c *ChainRunner) Providers() ([]models.NodeProvider, error) {
+	found := map[string]models.NodeProvider{}
+	for _, r := range c.runners {
+		providers, err := r.Providers()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range providers {
+			if _, ok := found[p.Name]; !ok {
+				found[p.Name] = p
+			}
+		}
+	}
+
+	providers := make([]models.NodeProvider, 0, len(found))
+	for _, p := range found {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name < providers[j].Name
+	})
+	return providers, nil
+}
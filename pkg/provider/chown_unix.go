@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+package provider
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// chownFile sets the owner and group of path. Either may be a name or an id,
+// and is left unchanged if empty.
+func chownFile(path string, owner string, group string) error {
+	if owner == "" && group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if owner != "" {
+		u, err := lookupUser(owner)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+	}
+	if group != "" {
+		var err error
+		if gid, err = lookupGID(group); err != nil {
+			return err
+		}
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// lookupUser finds a user by name or id
+func lookupUser(nameOrID string) (*user.User, error) {
+	u, err := user.Lookup(nameOrID)
+	if err != nil {
+		if u, err = user.LookupId(nameOrID); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// lookupGID finds the id of a group by name or id
+func lookupGID(nameOrID string) (int, error) {
+	g, err := user.LookupGroup(nameOrID)
+	if err != nil {
+		if g, err = user.LookupGroupId(nameOrID); err != nil {
+			return 0, err
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,13 @@
+package provider
+
+import (
+	"errors"
+)
+
+// chownFile is not supported on Windows, where files are owned through ACLs
+func chownFile(path string, owner string, group string) error {
+	if owner == "" && group == "" {
+		return nil
+	}
+	return errors.New("setting the owner of a file is not supported on windows")
+}
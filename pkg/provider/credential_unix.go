@@ -0,0 +1,81 @@
+//go:build !windows
+// +build !windows
+
+package provider
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+// credential is the user and group a task's processes run as
+type credential struct {
+	uid      uint32
+	gid      uint32
+	username string
+	home     string
+}
+
+// lookupCredential resolves runAs to a credential. It returns nil if runAs
+// is empty, in which case processes run as the client's user.
+func lookupCredential(runAs models.RunAs) (*credential, error) {
+	if runAs.User == "" && runAs.Group == "" {
+		return nil, nil
+	}
+
+	var u *user.User
+	var err error
+	if runAs.User != "" {
+		u, err = lookupUser(runAs.User)
+	} else {
+		u, err = user.Current()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, err
+	}
+	if runAs.Group != "" {
+		if gid, err = lookupGID(runAs.Group); err != nil {
+			return nil, err
+		}
+	}
+
+	return &credential{
+		uid:      uint32(uid),
+		gid:      uint32(gid),
+		username: u.Username,
+		home:     u.HomeDir,
+	}, nil
+}
+
+// apply makes cmd run as the credential. Supplementary groups of the client
+// are dropped.
+func (c *credential) apply(cmd *exec.Cmd) {
+	if c == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: c.uid, Gid: c.gid}
+}
+
+func (c *credential) chown(path string) error {
+	if c == nil {
+		return nil
+	}
+	return os.Chown(path, int(c.uid), int(c.gid))
+}
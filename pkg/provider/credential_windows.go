@@ -0,0 +1,28 @@
+package provider
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+type credential struct {
+	username string
+	home     string
+}
+
+// lookupCredential returns an error if runAs is set because running
+// providers as another user is not supported on Windows
+func lookupCredential(runAs models.RunAs) (*credential, error) {
+	if runAs.User == "" && runAs.Group == "" {
+		return nil, nil
+	}
+	return nil, errors.New("running providers as another user is not supported on windows")
+}
+
+func (c *credential) apply(cmd *exec.Cmd) {}
+
+func (c *credential) chown(path string) error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+const execPrefix = "foodtruck-provider-"
+
+// versionFileSuffix is the suffix of the file next to a provider executable
+// holding its version, for example foodtruck-provider-infra.version
+const versionFileSuffix = ".version"
+
+// Providers lists the providers the runner can run: executables named
+// foodtruck-provider-<name> in the providers path that are allowed to run.
+// Providers are not executed to find their version. Instead, it is read from a
+// foodtruck-provider-<name>.version file next to the executable if there is
+// one.
+func (p *ExecRunner) Providers() ([]models.NodeProvider, error) {
+	providers := []models.NodeProvider{}
+	if p.opts.ProvidersPath == "" {
+		return providers, nil
+	}
+
+	entries, err := ioutil.ReadDir(p.opts.ProvidersPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, ok := providerNameFromFile(entry)
+		if !ok || !p.isAllowed(name) {
+			continue
+		}
+		providers = append(providers, models.NodeProvider{
+			Name:    name,
+			Version: readVersion(filepath.Join(p.opts.ProvidersPath, entry.Name())),
+		})
+	}
+
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name < providers[j].Name
+	})
+	return providers, nil
+}
+
+func providerNameFromFile(entry os.FileInfo) (string, bool) {
+	if entry.IsDir() || !strings.HasPrefix(entry.Name(), execPrefix) {
+		return "", false
+	}
+	name := strings.TrimPrefix(entry.Name(), execPrefix)
+	if runtime.GOOS == "windows" {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	} else if entry.Mode()&0111 == 0 {
+		return "", false
+	}
+	if !models.IsValidProviderName(name) {
+		return "", false
+	}
+	return name, true
+}
+
+func readVersion(execPath string) string {
+	if runtime.GOOS == "windows" {
+		execPath = strings.TrimSuffix(execPath, filepath.Ext(execPath))
+	}
+	data, err := ioutil.ReadFile(execPath + versionFileSuffix)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,229 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+var ErrRunAsNotAllowed = errors.New("run as is not allowed")
+
+// terminateGracePeriod is how long a provider has to exit after it is asked
+// to before it is killed
+const terminateGracePeriod = 10 * time.Second
+
+// EnvWorkdir is the environment variable holding the working directory
+// created for a task
+const EnvWorkdir = "FOODTRUCK_WORKDIR"
+
+// DefaultEnvPassthrough are the variables from the client's environment that
+// are passed to providers if no passthrough list is configured
+var DefaultEnvPassthrough = []string{
+	"PATH", "LANG", "LC_ALL", "TZ", "TMPDIR", "TEMP", "TMP",
+	"HOME", "USER", "LOGNAME",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	"SYSTEMROOT", "SYSTEMDRIVE", "WINDIR", "COMSPEC", "PATHEXT",
+	"PROGRAMDATA", "PROGRAMFILES", "USERPROFILE", "APPDATA", "LOCALAPPDATA",
+}
+
+// execEnv is the environment a task's processes are run in: a working
+// directory created for the task, an explicit environment, optionally a
+// different user and group, and resource limits
+type execEnv struct {
+	dir    string
+	env    []string
+	cred   *credential
+	limits *limiter
+}
+
+// newExecEnv creates the working directory for a task and works out its
+// environment, credentials and limits. The returned cleanup function removes
+// the working directory and any cgroup created for the task.
+func newExecEnv(opts ExecRunnerOpts, ropts RunOpts) (*execEnv, func(), error) {
+	runAs, err := effectiveRunAs(opts, ropts.RunAs)
+	if err != nil {
+		return nil, nil, err
+	}
+	cred, err := lookupCredential(runAs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	limits, err := newLimiter(opts, ropts.Limits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dir, err := ioutil.TempDir(opts.WorkdirBase, "foodtruck-task")
+	if err != nil {
+		limits.close()
+		return nil, nil, err
+	}
+	cleanup := func() {
+		limits.close()
+		os.RemoveAll(dir)
+	}
+
+	e := &execEnv{dir: dir, cred: cred, limits: limits}
+	if err := e.own(dir); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	vars := passthroughEnv(opts.EnvPassthrough, os.Environ())
+	if cred != nil {
+		vars["HOME"] = cred.home
+		vars["USER"] = cred.username
+		vars["LOGNAME"] = cred.username
+	}
+	for k, v := range ropts.Env {
+		vars[k] = v
+	}
+	vars[EnvWorkdir] = dir
+	e.env = envList(vars)
+
+	return e, cleanup, nil
+}
+
+// apply sets up cmd to run in the environment. A directory already set on
+// cmd is kept.
+func (e *execEnv) apply(cmd *exec.Cmd) {
+	if cmd.Dir == "" {
+		cmd.Dir = e.dir
+	}
+	cmd.Env = append(cmd.Env, e.env...)
+	e.cred.apply(cmd)
+	setProcessGroup(cmd)
+}
+
+// start starts cmd with the resource limits applied to it
+func (e *execEnv) start(cmd *exec.Cmd) error {
+	return e.limits.start(cmd)
+}
+
+// wait waits for cmd to exit. If it failed because of a resource limit, a
+// LimitError is returned.
+func (e *execEnv) wait(ctx context.Context, cmd *exec.Cmd) error {
+	err := waitContext(ctx, cmd)
+	if err != nil {
+		if reason := e.limits.exceeded(cmd.ProcessState); reason != "" {
+			return &LimitError{Reason: reason, Err: err}
+		}
+	}
+	return err
+}
+
+// waitContext waits for the started cmd to exit. If ctx is done first, cmd is
+// asked to exit and killed if it has not after terminateGracePeriod. The
+// error of a command that failed after ctx was done wraps the ctx error.
+func waitContext(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		terminateProcess(cmd.Process)
+		select {
+		case <-done:
+		case <-time.After(terminateGracePeriod):
+			killProcess(cmd.Process)
+		}
+	}()
+
+	err := cmd.Wait()
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w: %s", ctx.Err(), err)
+	}
+	return err
+}
+
+// own makes path owned by the user the task runs as, so files the client
+// prepares for the task can be read by it
+func (e *execEnv) own(path string) error {
+	return e.cred.chown(path)
+}
+
+// effectiveRunAs returns who a task runs as. A task may only ask to run as a
+// user or group other than the configured default if it is allowed.
+func effectiveRunAs(opts ExecRunnerOpts, taskRunAs *models.RunAs) (models.RunAs, error) {
+	runAs := opts.RunAs
+	if taskRunAs == nil {
+		return runAs, nil
+	}
+	if taskRunAs.User != "" && taskRunAs.User != runAs.User {
+		if !contains(opts.AllowedUsers, taskRunAs.User) {
+			return models.RunAs{}, fmt.Errorf("%w: user %q", ErrRunAsNotAllowed, taskRunAs.User)
+		}
+		runAs.User = taskRunAs.User
+		// The default group belongs to the default user
+		runAs.Group = ""
+	}
+	if taskRunAs.Group != "" && taskRunAs.Group != runAs.Group {
+		if !contains(opts.AllowedGroups, taskRunAs.Group) {
+			return models.RunAs{}, fmt.Errorf("%w: group %q", ErrRunAsNotAllowed, taskRunAs.Group)
+		}
+		runAs.Group = taskRunAs.Group
+	}
+	return runAs, nil
+}
+
+// passthroughEnv returns the variables in environ allowed by passthrough. A
+// nil passthrough uses DefaultEnvPassthrough, and "*" passes everything.
+func passthroughEnv(passthrough []string, environ []string) map[string]string {
+	if passthrough == nil {
+		passthrough = DefaultEnvPassthrough
+	}
+	vars := map[string]string{}
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		for _, name := range passthrough {
+			if name == "*" || envNameEqual(name, parts[0]) {
+				vars[parts[0]] = parts[1]
+				break
+			}
+		}
+	}
+	return vars
+}
+
+// envNameEqual compares environment variable names, which are case
+// insensitive on Windows
+func envNameEqual(a string, b string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+func envList(vars map[string]string) []string {
+	env := make([]string, 0, len(vars))
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassthroughEnv(t *testing.T) {
+	environ := []string{"PATH=/usr/bin", "SECRET_TOKEN=abc", "LANG=C", "EMPTY=", "bad"}
+
+	require.Equal(t, map[string]string{"PATH": "/usr/bin", "LANG": "C"}, passthroughEnv(nil, environ))
+	require.Equal(t, map[string]string{"SECRET_TOKEN": "abc"}, passthroughEnv([]string{"SECRET_TOKEN"}, environ))
+	require.Equal(t, map[string]string{}, passthroughEnv([]string{}, environ))
+	require.Equal(t, map[string]string{
+		"PATH": "/usr/bin", "SECRET_TOKEN": "abc", "LANG": "C", "EMPTY": "",
+	}, passthroughEnv([]string{"*"}, environ))
+}
+
+func TestEffectiveRunAs(t *testing.T) {
+	opts := ExecRunnerOpts{
+		RunAs:         models.RunAs{User: "foodtruck", Group: "foodtruck"},
+		AllowedUsers:  []string{"app"},
+		AllowedGroups: []string{"web"},
+	}
+
+	runAs, err := effectiveRunAs(opts, nil)
+	require.NoError(t, err)
+	require.Equal(t, models.RunAs{User: "foodtruck", Group: "foodtruck"}, runAs)
+
+	runAs, err = effectiveRunAs(opts, &models.RunAs{User: "foodtruck"})
+	require.NoError(t, err)
+	require.Equal(t, models.RunAs{User: "foodtruck", Group: "foodtruck"}, runAs)
+
+	runAs, err = effectiveRunAs(opts, &models.RunAs{User: "app"})
+	require.NoError(t, err)
+	require.Equal(t, models.RunAs{User: "app"}, runAs)
+
+	runAs, err = effectiveRunAs(opts, &models.RunAs{User: "app", Group: "web"})
+	require.NoError(t, err)
+	require.Equal(t, models.RunAs{User: "app", Group: "web"}, runAs)
+
+	_, err = effectiveRunAs(opts, &models.RunAs{User: "root"})
+	require.True(t, errors.Is(err, ErrRunAsNotAllowed))
+
+	_, err = effectiveRunAs(opts, &models.RunAs{Group: "wheel"})
+	require.True(t, errors.Is(err, ErrRunAsNotAllowed))
+}
+
+func TestExecRunnerEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the provider is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "foodtruck-providers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Chmod(dir, 0755))
+
+	out := filepath.Join(dir, "out")
+	script := `#!/bin/sh
+cat > /dev/null
+{ pwd; id -un; env; } > ` + out + `
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foodtruck-provider-env"), []byte(script), 0755))
+
+	os.Setenv("FOODTRUCK_TEST_SECRET", "secret")
+	defer os.Unsetenv("FOODTRUCK_TEST_SECRET")
+
+	allowed := WithAllowedProviders([]string{"env"})
+	run := func(t *testing.T, opts []ExecRunnerOpt, ropts ...RunOpt) (string, string, map[string]string) {
+		opts = append([]ExecRunnerOpt{WithProvidersPath(dir), allowed}, opts...)
+		_, err := NewExecRunner(opts...).Run(context.Background(), "env", []byte(`{}`), ropts...)
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(out)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		env := map[string]string{}
+		for _, l := range lines[2:] {
+			parts := strings.SplitN(l, "=", 2)
+			if len(parts) == 2 {
+				env[parts[0]] = parts[1]
+			}
+		}
+		return lines[0], lines[1], env
+	}
+
+	t.Run("runs in a working directory with an explicit environment", func(t *testing.T) {
+		pwd, _, env := run(t, nil, WithEnv(map[string]string{"FOODTRUCK_JOB_ID": "abc", "APP_ENV": "prod"}))
+
+		require.Equal(t, pwd, env[EnvWorkdir])
+		require.True(t, strings.HasPrefix(filepath.Base(pwd), "foodtruck-task"))
+		_, err := os.Stat(pwd)
+		require.True(t, os.IsNotExist(err), "the working directory is removed")
+
+		require.Equal(t, "abc", env["FOODTRUCK_JOB_ID"])
+		require.Equal(t, "prod", env["APP_ENV"])
+		require.Equal(t, os.Getenv("PATH"), env["PATH"])
+		require.NotContains(t, env, "FOODTRUCK_TEST_SECRET")
+	})
+
+	t.Run("passes through configured variables", func(t *testing.T) {
+		_, _, env := run(t, []ExecRunnerOpt{WithEnvPassthrough([]string{"PATH", "FOODTRUCK_TEST_SECRET"})})
+		require.Equal(t, "secret", env["FOODTRUCK_TEST_SECRET"])
+	})
+
+	t.Run("refuses to run as users that are not allowed", func(t *testing.T) {
+		_, err := NewExecRunner(WithProvidersPath(dir), allowed).Run(context.Background(), "env", []byte(`{}`),
+			WithTaskRunAs(&models.RunAs{User: "nobody"}))
+		require.True(t, errors.Is(err, ErrRunAsNotAllowed))
+	})
+
+	t.Run("runs as another user", func(t *testing.T) {
+		if os.Getuid() != 0 {
+			t.Skip("running as another user requires root")
+		}
+		nobody, err := user.Lookup("nobody")
+		if err != nil {
+			t.Skip("there is no nobody user")
+		}
+		require.NoError(t, os.Chmod(dir, 0777))
+		require.NoError(t, os.Remove(out))
+
+		pwd, username, env := run(t, []ExecRunnerOpt{WithAllowedRunAs([]string{"nobody"}, nil)},
+			WithTaskRunAs(&models.RunAs{User: "nobody"}))
+		require.Equal(t, "nobody", username)
+		require.Equal(t, "nobody", env["USER"])
+		require.Equal(t, nobody.HomeDir, env["HOME"])
+		require.NotEmpty(t, pwd)
+	})
+}
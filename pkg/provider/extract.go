@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrUnsafeArchive = errors.New("unsafe archive")
+
+// extractTarGz extracts a gzipped tarball into dest. Entries that would be
+// written outside of dest, either directly or through a link, are rejected,
+// as are entries other than files, directories and symlinks.
+func extractTarGz(archivePath string, dest string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := safeJoin(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if err := checkParents(dest, target); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := writeFile(target, tr, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			linkTarget := hdr.Linkname
+			if filepath.IsAbs(linkTarget) {
+				return fmt.Errorf("%w: %s links to absolute path %s", ErrUnsafeArchive, hdr.Name, linkTarget)
+			}
+			if _, err := safeJoin(dest, filepath.Join(filepath.Dir(hdr.Name), linkTarget)); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(linkTarget, target); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: %s has unsupported type %q", ErrUnsafeArchive, hdr.Name, hdr.Typeflag)
+		}
+	}
+}
+
+// safeJoin joins name to dest, making sure the result is inside dest
+func safeJoin(dest string, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("%w: %s is an absolute path", ErrUnsafeArchive, name)
+	}
+	target := filepath.Join(dest, name)
+	if target != dest && !strings.HasPrefix(target, dest+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s is outside of the destination", ErrUnsafeArchive, name)
+	}
+	return target, nil
+}
+
+// checkParents makes sure none of the directories between dest and target are
+// symlinks, so an entry cannot be written through a link extracted earlier
+func checkParents(dest string, target string) error {
+	rel, err := filepath.Rel(dest, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+	p := dest
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s is inside the symlink %s", ErrUnsafeArchive, target, p)
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
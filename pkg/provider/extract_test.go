@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+func makeTarGz(t *testing.T, entries []tarEntry) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		typeflag := e.typeflag
+		if typeflag == 0 {
+			typeflag = tar.TypeReg
+		}
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Typeflag: typeflag,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+			Linkname: e.linkname,
+		}))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestExtractTarGz(t *testing.T) {
+	extract := func(t *testing.T, entries []tarEntry) (string, error) {
+		dir, err := ioutil.TempDir("", "foodtruck-extract")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		archivePath := filepath.Join(dir, "archive.tar.gz")
+		require.NoError(t, ioutil.WriteFile(archivePath, makeTarGz(t, entries), 0600))
+		dest := filepath.Join(dir, "dest")
+		return dest, extractTarGz(archivePath, dest)
+	}
+
+	t.Run("extracts files, directories and symlinks", func(t *testing.T) {
+		dest, err := extract(t, []tarEntry{
+			{name: "out/", typeflag: tar.TypeDir},
+			{name: "out/Policyfile.lock.json", content: "{}"},
+			{name: "out/nested/file", content: "data"},
+			{name: "out/link", typeflag: tar.TypeSymlink, linkname: "nested/file"},
+		})
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(filepath.Join(dest, "out", "nested", "file"))
+		require.NoError(t, err)
+		require.Equal(t, "data", string(data))
+
+		data, err = ioutil.ReadFile(filepath.Join(dest, "out", "link"))
+		require.NoError(t, err)
+		require.Equal(t, "data", string(data))
+	})
+
+	for name, entries := range map[string][]tarEntry{
+		"parent directory":        {{name: "../evil", content: "x"}},
+		"nested parent directory": {{name: "out/../../evil", content: "x"}},
+		"absolute path":           {{name: "/tmp/evil", content: "x"}},
+		"symlink outside":         {{name: "out/link", typeflag: tar.TypeSymlink, linkname: "../../evil"}},
+		"absolute symlink":        {{name: "link", typeflag: tar.TypeSymlink, linkname: "/etc"}},
+		"hard link":               {{name: "link", typeflag: tar.TypeLink, linkname: "/etc/passwd"}},
+		"write through symlink": {
+			{name: "out/", typeflag: tar.TypeDir},
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "out"},
+			{name: "link/file", content: "x"},
+		},
+	} {
+		entries := entries
+		t.Run("rejects "+name, func(t *testing.T) {
+			_, err := extract(t, entries)
+			require.True(t, errors.Is(err, ErrUnsafeArchive), "%v", err)
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var sha256Regex = regexp.MustCompile("^[a-f0-9]{64}$")
+
+// fileCache keeps downloaded files by their sha256 so they are only
+// downloaded once across runs. Downloads are written to a partial file first,
+// which a later download of the same file resumes from if the server
+// supports range requests.
+type fileCache struct {
+	dir string
+}
+
+// fileCacheLocks makes sure only one download of a file runs at a time
+var fileCacheLocks sync.Map
+
+func newFileCache(dir string) *fileCache {
+	return &fileCache{dir: dir}
+}
+
+func (c *fileCache) path(checksum string) string {
+	return filepath.Join(c.dir, "sha256", checksum)
+}
+
+func (c *fileCache) partialPath(checksum string) string {
+	return filepath.Join(c.dir, "partial", checksum+".part")
+}
+
+// Fetch returns the path of the cached file with the given checksum,
+// downloading it from the first of urls that works if it is not cached. It
+// also returns whether the file was already cached.
+func (c *fileCache) Fetch(ctx context.Context, checksum string, urls []string, r *Reporter) (string, bool, error) {
+	checksum = strings.ToLower(checksum)
+	if !sha256Regex.MatchString(checksum) {
+		return "", false, fmt.Errorf("%w: invalid sha256 %q", ErrInvalidSpec, checksum)
+	}
+
+	lock, _ := fileCacheLocks.LoadOrStore(checksum, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	cached := c.path(checksum)
+	if sum, err := fileSHA256(cached); err == nil && sum == checksum {
+		return cached, true, nil
+	}
+
+	for _, dir := range []string{filepath.Dir(cached), filepath.Dir(c.partialPath(checksum))} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", false, err
+		}
+	}
+
+	var err error
+	for _, url := range urls {
+		if err = c.download(ctx, checksum, url, r); err == nil {
+			return cached, false, nil
+		}
+		r.Logf("warn", "failed to download %s: %s", url, err)
+	}
+	return "", false, err
+}
+
+// download downloads url into the cache, resuming a partial download if
+// there is one. A resumed download that does not match the checksum is
+// downloaded again from the start in case the partial file was bad.
+func (c *fileCache) download(ctx context.Context, checksum string, url string, r *Reporter) error {
+	partial := c.partialPath(checksum)
+	resumed, err := c.downloadPartial(ctx, url, partial, r)
+	if err != nil {
+		return err
+	}
+
+	sum, err := fileSHA256(partial)
+	if err != nil {
+		return err
+	}
+	if sum != checksum && resumed {
+		r.Logf("warn", "resumed download of %s does not match its checksum, downloading it again", url)
+		if err := os.Remove(partial); err != nil {
+			return err
+		}
+		if _, err := c.downloadPartial(ctx, url, partial, r); err != nil {
+			return err
+		}
+		if sum, err = fileSHA256(partial); err != nil {
+			return err
+		}
+	}
+	if sum != checksum {
+		os.Remove(partial)
+		return fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrChecksumMismatch, url, sum, checksum)
+	}
+
+	return os.Rename(partial, c.path(checksum))
+}
+
+// downloadPartial downloads url to partial, continuing from the end of
+// partial if it exists. It returns whether the download was resumed.
+func (c *fileCache) downloadPartial(ctx context.Context, url string, partial string, r *Reporter) (bool, error) {
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := r.httpClient().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	resumed := false
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent && contentRangeStart(resp) == offset:
+		resumed = true
+		r.Logf("info", "resuming download of %s at %d bytes", url, offset)
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial file may already be complete. If it is not, the
+		// checksum will not match and it is downloaded again.
+		return true, nil
+	case resp.StatusCode == http.StatusOK:
+		if err := f.Truncate(0); err != nil {
+			return false, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return resumed, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	return resumed, f.Close()
+}
+
+// contentRangeStart returns the first byte of a partial response, or -1 if
+// the response does not have a valid Content-Range header
+func contentRangeStart(resp *http.Response) int64 {
+	cr := resp.Header.Get("Content-Range")
+	if !strings.HasPrefix(cr, "bytes ") {
+		return -1
+	}
+	parts := strings.SplitN(strings.TrimPrefix(cr, "bytes "), "-", 2)
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,67 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrPathNotAllowed is returned when a task asks a builtin provider to write a
+// file outside of the file roots
+var ErrPathNotAllowed = errors.New("path is not allowed")
+
+// destination returns where a builtin provider writes the file a task asked
+// for at path, creating its directory. The client writes files as its own
+// user, so path must be in one of the file roots the operator configured, and
+// symlinks below the root are not followed.
+func (r *Reporter) destination(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("%w: path %q is not absolute", ErrInvalidSpec, path)
+	}
+	path = filepath.Clean(path)
+
+	for _, root := range r.fileRoots {
+		rel, err := filepath.Rel(filepath.Clean(root), path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return "", err
+		}
+		dir, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return "", err
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		for _, part := range parts[:len(parts)-1] {
+			dir = filepath.Join(dir, part)
+			if err := mkdirNoFollow(dir); err != nil {
+				return "", err
+			}
+		}
+		return filepath.Join(dir, parts[len(parts)-1]), nil
+	}
+	return "", fmt.Errorf("%w: %q is not in a file root", ErrPathNotAllowed, path)
+}
+
+// mkdirNoFollow creates dir if it does not exist. It fails if dir is a
+// symlink, which could lead out of the file root.
+func mkdirNoFollow(dir string) error {
+	info, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		return os.Mkdir(dir, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%w: %s is a symlink", ErrPathNotAllowed, dir)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package provider
+
+import (
+	"fmt"
+)
+
+// LimitError is returned when a provider was killed or failed because it
+// exceeded a resource limit. Reason is one of the models.Reason*LimitExceeded
+// reasons.
+type LimitError struct {
+	Reason string
+	Err    error
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Err)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
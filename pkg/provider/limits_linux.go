@@ -0,0 +1,236 @@
+package provider
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"golang.org/x/sys/unix"
+)
+
+// cpuPeriod is the cgroup cpu.max period, in microseconds
+const cpuPeriod = 100000
+
+// limiter applies resource limits to the processes of a task. The limits are
+// set with rlimits on each process the task starts and, if a cgroup parent is
+// configured, a cgroup v2 group created for the task. Processes the task's
+// processes start inherit both.
+type limiter struct {
+	limits models.ResourceLimits
+	// cgroup is the path of the task's cgroup, or empty if there is none
+	cgroup string
+}
+
+// newLimiter returns a limiter for the configured limits overridden by the
+// task's limits. It returns nil if there are no limits.
+func newLimiter(opts ExecRunnerOpts, taskLimits *models.ResourceLimits) (*limiter, error) {
+	limits := opts.Limits.Override(taskLimits)
+	if limits == (models.ResourceLimits{}) {
+		return nil, nil
+	}
+
+	l := &limiter{limits: limits}
+	if opts.CgroupParent == "" {
+		if limits.CPUPercent != 0 {
+			return nil, fmt.Errorf("cpu_percent requires a cgroup parent")
+		}
+		return l, nil
+	}
+
+	dir, err := ioutil.TempDir(opts.CgroupParent, "task-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	l.cgroup = dir
+
+	settings := map[string]string{}
+	if limits.MemoryBytes != 0 {
+		settings["memory.max"] = strconv.FormatUint(limits.MemoryBytes, 10)
+		// Without this, the group would be allowed to swap instead of
+		// being killed
+		settings["memory.swap.max"] = "0"
+	}
+	if limits.MaxProcesses != 0 {
+		settings["pids.max"] = strconv.FormatUint(limits.MaxProcesses, 10)
+	}
+	if limits.CPUPercent != 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d %d", limits.CPUPercent*cpuPeriod/100, cpuPeriod)
+	}
+	for file, value := range settings {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+			// memory.swap.max does not exist if swap accounting is off
+			if file == "memory.swap.max" && os.IsNotExist(err) {
+				continue
+			}
+			l.close()
+			return nil, fmt.Errorf("failed to set %s: %w", file, err)
+		}
+	}
+	return l, nil
+}
+
+// start starts cmd with the limits applied. Applying them after cmd starts
+// would let anything it forks right away escape them, so cmd is started
+// through a shell that waits for the limits to be applied to it before it
+// execs cmd. The limits carry over the exec.
+func (l *limiter) start(cmd *exec.Cmd) error {
+	if l == nil {
+		return cmd.Start()
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defer w.Close()
+
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	script := fmt.Sprintf(`read -r limits <&%d && [ "$limits" = applied ] && exec "$@" %d<&-; exit 126`, fd, fd)
+	cmd.Args = append([]string{"/bin/sh", "-c", script, "sh", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := l.attach(cmd.Process.Pid); err != nil {
+		// The shell exits without running the command once the pipe is
+		// closed, but make sure of it
+		killProcess(cmd.Process)
+		w.Close()
+		cmd.Wait()
+		return fmt.Errorf("failed to apply resource limits: %w", err)
+	}
+	if _, err := w.Write([]byte("applied\n")); err != nil {
+		killProcess(cmd.Process)
+		cmd.Wait()
+		return fmt.Errorf("failed to start the command: %w", err)
+	}
+	return nil
+}
+
+// attach applies the limits to a started process
+func (l *limiter) attach(pid int) error {
+	if l == nil {
+		return nil
+	}
+
+	rlimits := map[int]uint64{}
+	if l.limits.CPUSeconds != 0 {
+		rlimits[unix.RLIMIT_CPU] = l.limits.CPUSeconds
+	}
+	if l.limits.OpenFiles != 0 {
+		rlimits[unix.RLIMIT_NOFILE] = l.limits.OpenFiles
+	}
+	// Without a cgroup, fall back to the rlimits for memory and processes.
+	// They are weaker: RLIMIT_AS limits virtual memory rather than what is
+	// used, and RLIMIT_NPROC counts all the processes of the user.
+	if l.cgroup == "" {
+		if l.limits.MemoryBytes != 0 {
+			rlimits[unix.RLIMIT_AS] = l.limits.MemoryBytes
+		}
+		if l.limits.MaxProcesses != 0 {
+			rlimits[unix.RLIMIT_NPROC] = l.limits.MaxProcesses
+		}
+	}
+	for resource, value := range rlimits {
+		max := value
+		if resource == unix.RLIMIT_CPU {
+			// The process gets SIGXCPU at the soft limit and SIGKILL at
+			// the hard limit
+			max = value + 1
+		}
+		if err := prlimit(pid, resource, &unix.Rlimit{Cur: value, Max: max}); err != nil {
+			return fmt.Errorf("failed to set rlimit %d: %w", resource, err)
+		}
+	}
+
+	if l.cgroup != "" {
+		if err := ioutil.WriteFile(filepath.Join(l.cgroup, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("failed to add process to cgroup: %w", err)
+		}
+	}
+	return nil
+}
+
+// prlimit sets a resource limit of another process. The version of x/sys
+// used does not export it.
+func prlimit(pid int, resource int, rlim *unix.Rlimit) error {
+	_, _, errno := unix.RawSyscall6(unix.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(rlim)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// exceeded returns the reason a process that exited was stopped by a limit,
+// or an empty string if it was not
+func (l *limiter) exceeded(state *os.ProcessState) string {
+	if l == nil || state == nil {
+		return ""
+	}
+
+	if l.limits.CPUSeconds != 0 {
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			cpu := state.UserTime() + state.SystemTime()
+			if ws.Signal() == syscall.SIGXCPU ||
+				(ws.Signal() == syscall.SIGKILL && cpu >= time.Duration(l.limits.CPUSeconds)*time.Second) {
+				return models.ReasonCPULimitExceeded
+			}
+		}
+	}
+	if l.cgroup != "" {
+		if l.limits.MemoryBytes != 0 && l.event("memory.events", "oom_kill") > 0 {
+			return models.ReasonMemoryLimitExceeded
+		}
+		if l.limits.MaxProcesses != 0 && l.event("pids.events", "max") > 0 {
+			return models.ReasonProcessLimitExceeded
+		}
+	}
+	return ""
+}
+
+// event reads a counter from one of the cgroup's events files
+func (l *limiter) event(file string, name string) uint64 {
+	f, err := os.Open(filepath.Join(l.cgroup, file))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == name {
+			n, _ := strconv.ParseUint(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// close kills any processes left in the task's cgroup and removes it
+func (l *limiter) close() {
+	if l == nil || l.cgroup == "" {
+		return
+	}
+	// cgroup.kill is only available since Linux 5.14
+	ioutil.WriteFile(filepath.Join(l.cgroup, "cgroup.kill"), []byte("1"), 0644)
+	for i := 0; i < 10; i++ {
+		if err := os.Remove(l.cgroup); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Fprintf(os.Stderr, "[Error] failed to remove cgroup %s\n", l.cgroup)
+}
@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecRunnerLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "foodtruck-providers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	writeProvider := func(name string, script string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foodtruck-provider-"+name), []byte("#!/bin/sh\ncat > /dev/null\n"+script), 0755))
+	}
+	writeProvider("ulimit", "ulimit -n > "+out+"\n")
+	writeProvider("spin", "while :; do :; done\n")
+	writeProvider("alloc", "head -c 200000000 /dev/zero | tail > /dev/null\n")
+	allowed := WithAllowedProviders([]string{"ulimit", "spin", "alloc"})
+
+	t.Run("sets rlimits with task overrides", func(t *testing.T) {
+		r := NewExecRunner(WithProvidersPath(dir), allowed, WithLimits(models.ResourceLimits{OpenFiles: 64}))
+
+		_, err := r.Run(context.Background(), "ulimit", []byte(`{}`))
+		require.NoError(t, err)
+		data, err := ioutil.ReadFile(out)
+		require.NoError(t, err)
+		require.Equal(t, "64", strings.TrimSpace(string(data)))
+
+		_, err = r.Run(context.Background(), "ulimit", []byte(`{}`), WithTaskLimits(&models.ResourceLimits{OpenFiles: 32}))
+		require.NoError(t, err)
+		data, err = ioutil.ReadFile(out)
+		require.NoError(t, err)
+		require.Equal(t, "32", strings.TrimSpace(string(data)))
+	})
+
+	t.Run("reports providers killed for using too much cpu", func(t *testing.T) {
+		r := NewExecRunner(WithProvidersPath(dir), allowed, WithLimits(models.ResourceLimits{CPUSeconds: 1}))
+		_, err := r.Run(context.Background(), "spin", []byte(`{}`))
+
+		limitErr := &LimitError{}
+		require.True(t, errors.As(err, &limitErr), "%v", err)
+		require.Equal(t, models.ReasonCPULimitExceeded, limitErr.Reason)
+	})
+
+	t.Run("requires a cgroup for cpu_percent", func(t *testing.T) {
+		r := NewExecRunner(WithProvidersPath(dir), allowed, WithLimits(models.ResourceLimits{CPUPercent: 50}))
+		_, err := r.Run(context.Background(), "ulimit", []byte(`{}`))
+		require.Error(t, err)
+	})
+
+	t.Run("uses a cgroup for each task", func(t *testing.T) {
+		// The cgroup parent must be a delegated cgroup v2 directory with the
+		// memory and pids controllers enabled
+		parent := os.Getenv("FOODTRUCK_TEST_CGROUP_PARENT")
+		if parent == "" {
+			t.Skip("FOODTRUCK_TEST_CGROUP_PARENT is not set")
+		}
+
+		r := NewExecRunner(WithProvidersPath(dir), allowed, WithCgroupParent(parent),
+			WithLimits(models.ResourceLimits{MemoryBytes: 16 * 1024 * 1024}))
+		_, err := r.Run(context.Background(), "alloc", []byte(`{}`))
+
+		limitErr := &LimitError{}
+		require.True(t, errors.As(err, &limitErr), "%v", err)
+		require.Equal(t, models.ReasonMemoryLimitExceeded, limitErr.Reason)
+
+		entries, err := ioutil.ReadDir(parent)
+		require.NoError(t, err)
+		for _, e := range entries {
+			require.False(t, strings.HasPrefix(e.Name(), "task-"), "the task cgroup is removed")
+		}
+	})
+	t.Run("does not run commands the limits could not be applied to", func(t *testing.T) {
+		marker := filepath.Join(dir, "marker")
+		l := &limiter{limits: models.ResourceLimits{OpenFiles: 64}, cgroup: filepath.Join(dir, "missing-cgroup")}
+		cmd := exec.Command("/bin/sh", "-c", "touch "+marker)
+		setProcessGroup(cmd)
+
+		require.Error(t, l.start(cmd))
+		_, err := os.Stat(marker)
+		require.True(t, os.IsNotExist(err))
+	})
+}
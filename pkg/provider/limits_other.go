@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package provider
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+// limiter does nothing on platforms other than Linux, where resource limits
+// are not supported
+type limiter struct{}
+
+func newLimiter(opts ExecRunnerOpts, taskLimits *models.ResourceLimits) (*limiter, error) {
+	return nil, nil
+}
+
+func (l *limiter) start(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+func (l *limiter) exceeded(state *os.ProcessState) string {
+	return ""
+}
+
+func (l *limiter) close() {}
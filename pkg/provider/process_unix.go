@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package provider
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs cmd in its own process group, so signals sent to the
+// client from a terminal do not reach it and it can be terminated along with
+// the processes it starts
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// terminateProcess asks the process group of p to exit
+func terminateProcess(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGTERM)
+}
+
+// killProcess kills the process group of p
+func killProcess(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,18 @@
+package provider
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcess kills p because Windows has no way to ask a process to
+// exit
+func terminateProcess(p *os.Process) error {
+	return p.Kill()
+}
+
+func killProcess(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,144 @@
+package provider
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+// ProtocolVersion is the version of the provider protocol spoken by the
+// runner. It is passed to providers in EnvProtocolVersion.
+const ProtocolVersion = 1
+
+const (
+	// EnvProtocolVersion is the environment variable holding the version of
+	// the provider protocol
+	EnvProtocolVersion = "FOODTRUCK_PROTOCOL_VERSION"
+	// EnvProtocolFD is the environment variable holding the file descriptor
+	// providers write protocol messages to
+	EnvProtocolFD = "FOODTRUCK_PROTOCOL_FD"
+)
+
+// protocolFD is the file descriptor the protocol pipe is given to providers
+// on. 0, 1 and 2 are stdin, stdout and stderr.
+const protocolFD = 3
+
+// maxMessageSize is the longest protocol message that is accepted
+const maxMessageSize = 1024 * 1024
+
+type MessageType string
+
+const (
+	MessageTypeProgress MessageType = "progress"
+	MessageTypeLog      MessageType = "log"
+	MessageTypeResult   MessageType = "result"
+)
+
+// Message is a single line written by a provider to the protocol file
+// descriptor. For example:
+//
+//	{"type": "progress", "percent": 50, "message": "converging"}
+//	{"type": "log", "level": "info", "message": "downloaded policy"}
+//	{"type": "result", "data": {"resources_updated": 3}}
+type Message struct {
+	Type    MessageType     `json:"type"`
+	Percent int             `json:"percent,omitempty"`
+	Level   string          `json:"level,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Outputs are the outputs collected from a provider through the protocol
+type Outputs struct {
+	Progress int
+	Logs     []models.ProviderLog
+	Output   json.RawMessage
+}
+
+// Apply copies the outputs into a status result
+func (o *Outputs) Apply(result *models.NodeTaskStatusResult) {
+	if o == nil {
+		return
+	}
+	result.Progress = o.Progress
+	result.Logs = o.Logs
+	result.Output = o.Output
+}
+
+// ProgressFunc is called every time a provider reports progress
+type ProgressFunc func(percent int, message string)
+
+// readMessages reads protocol messages from r until it is closed, collecting
+// them into outputs. Lines that are not valid messages are logged as warnings
+// so a misbehaving provider can be debugged from its task status.
+func readMessages(r io.Reader, outputs *Outputs, onProgress ProgressFunc) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		msg := Message{}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			outputs.addLog("warn", fmt.Sprintf("invalid protocol message: %s", err))
+			continue
+		}
+		if err := outputs.handle(msg, onProgress); err != nil {
+			outputs.addLog("warn", err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+func (o *Outputs) handle(msg Message, onProgress ProgressFunc) error {
+	switch msg.Type {
+	case MessageTypeProgress:
+		if msg.Percent < 0 || msg.Percent > 100 {
+			return fmt.Errorf("invalid progress %d: must be between 0 and 100", msg.Percent)
+		}
+		o.Progress = msg.Percent
+		if onProgress != nil {
+			onProgress(msg.Percent, msg.Message)
+		}
+	case MessageTypeLog:
+		level := msg.Level
+		if level == "" {
+			level = "info"
+		}
+		o.addLog(level, msg.Message)
+	case MessageTypeResult:
+		if len(msg.Data) > models.MaxResultOutputSize {
+			return fmt.Errorf("result is %d bytes, larger than the limit of %d", len(msg.Data), models.MaxResultOutputSize)
+		}
+		o.Output = msg.Data
+	default:
+		return fmt.Errorf("unknown protocol message type %q", msg.Type)
+	}
+	return nil
+}
+
+// addLog records a log message, keeping only the most recent
+// models.MaxResultLogs messages
+func (o *Outputs) addLog(level string, message string) {
+	if len(message) > models.MaxResultLogMessageLen {
+		message = message[:models.MaxResultLogMessageLen]
+		for !utf8.ValidString(message) {
+			message = message[:len(message)-1]
+		}
+	}
+	o.Logs = append(o.Logs, models.ProviderLog{
+		Time:    time.Now().UTC(),
+		Level:   level,
+		Message: message,
+	})
+	if len(o.Logs) > models.MaxResultLogs {
+		o.Logs = o.Logs[len(o.Logs)-models.MaxResultLogs:]
+	}
+}
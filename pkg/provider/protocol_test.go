@@ -0,0 +1,68 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadMessages(t *testing.T) {
+	t.Run("collects progress, logs and the result", func(t *testing.T) {
+		input := strings.Join([]string{
+			`{"type": "progress", "percent": 10, "message": "downloading"}`,
+			`{"type": "log", "level": "debug", "message": "downloaded"}`,
+			``,
+			`{"type": "log", "message": "converging"}`,
+			`{"type": "progress", "percent": 100}`,
+			`{"type": "result", "data": {"resources_updated": 3}}`,
+		}, "\n")
+
+		var progress []int
+		outputs := &Outputs{}
+		err := readMessages(strings.NewReader(input), outputs, func(percent int, message string) {
+			progress = append(progress, percent)
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, []int{10, 100}, progress)
+		require.Equal(t, 100, outputs.Progress)
+		require.Len(t, outputs.Logs, 2)
+		require.Equal(t, "debug", outputs.Logs[0].Level)
+		require.Equal(t, "downloaded", outputs.Logs[0].Message)
+		require.Equal(t, "info", outputs.Logs[1].Level)
+		require.JSONEq(t, `{"resources_updated": 3}`, string(outputs.Output))
+	})
+
+	t.Run("logs invalid messages as warnings", func(t *testing.T) {
+		input := strings.Join([]string{
+			`not json`,
+			`{"type": "unknown"}`,
+			`{"type": "progress", "percent": 150}`,
+		}, "\n")
+
+		outputs := &Outputs{}
+		require.NoError(t, readMessages(strings.NewReader(input), outputs, nil))
+		require.Len(t, outputs.Logs, 3)
+		for _, l := range outputs.Logs {
+			require.Equal(t, "warn", l.Level)
+		}
+		require.Equal(t, 0, outputs.Progress)
+	})
+
+	t.Run("keeps only the most recent logs", func(t *testing.T) {
+		lines := []string{}
+		for i := 0; i < models.MaxResultLogs+10; i++ {
+			lines = append(lines, fmt.Sprintf(`{"type": "log", "message": "%d"}`, i))
+		}
+		lines = append(lines, fmt.Sprintf(`{"type": "log", "message": "%s"}`, strings.Repeat("a", 2*models.MaxResultLogMessageLen)))
+
+		outputs := &Outputs{}
+		require.NoError(t, readMessages(strings.NewReader(strings.Join(lines, "\n")), outputs, nil))
+		require.Len(t, outputs.Logs, models.MaxResultLogs)
+		require.Equal(t, "11", outputs.Logs[0].Message)
+		require.Len(t, outputs.Logs[len(outputs.Logs)-1].Message, models.MaxResultLogMessageLen)
+	})
+}
@@ -3,39 +3,232 @@ package provider
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
 )
 
+var ErrInvalidProviderName = errors.New("invalid provider name")
+var ErrProviderNotAllowed = errors.New("provider is not allowed")
+var ErrChecksumMismatch = errors.New("provider checksum mismatch")
+
 type Runner interface {
-	Run(ctx context.Context, providerName string, spec json.RawMessage) error
+	Run(ctx context.Context, providerName string, spec json.RawMessage, opts ...RunOpt) (*Outputs, error)
+}
+
+type RunOpts struct {
+	// OnProgress is called when the provider reports progress
+	OnProgress ProgressFunc
+	// Env are variables set for the provider in addition to those passed
+	// through from the client's environment
+	Env map[string]string
+	// RunAs is the user and group the task asks to be run as
+	RunAs *models.RunAs
+	// Limits lower the configured resource limits for the task
+	Limits *models.ResourceLimits
+}
+
+type RunOpt func(*RunOpts)
+
+func WithProgressFunc(f ProgressFunc) RunOpt {
+	return func(opts *RunOpts) {
+		opts.OnProgress = f
+	}
+}
+
+func WithEnv(env map[string]string) RunOpt {
+	return func(opts *RunOpts) {
+		opts.Env = env
+	}
+}
+
+func WithTaskRunAs(runAs *models.RunAs) RunOpt {
+	return func(opts *RunOpts) {
+		opts.RunAs = runAs
+	}
+}
+
+func WithTaskLimits(limits *models.ResourceLimits) RunOpt {
+	return func(opts *RunOpts) {
+		opts.Limits = limits
+	}
+}
+
+type ExecRunnerOpts struct {
+	// ProvidersPath is the directory provider executables are looked up in.
+	// If empty, no provider executables are run.
+	ProvidersPath string
+	// AllowedProviders is the list of providers that may be run. Provider
+	// executables must always be listed. If empty, only the builtin
+	// providers that are not explicit only may be run.
+	AllowedProviders []string
+	// Checksums maps provider names to the hex encoded sha256 of their
+	// executable. Providers with a checksum are only run if their executable
+	// matches it.
+	Checksums map[string]string
+	// CachePath is the directory builtin providers keep files in across
+	// runs. If empty, a directory in the user's cache directory is used.
+	CachePath string
+	// FileRoots are the directories builtin providers may write the files
+	// tasks ask for in. If empty, they may not write files anywhere.
+	FileRoots []string
+	// EnvPassthrough are the variables of the client's environment passed to
+	// providers. If nil, DefaultEnvPassthrough is used. "*" passes all of
+	// them.
+	EnvPassthrough []string
+	// WorkdirBase is the directory the working directory of each task is
+	// created in. If empty, the system temporary directory is used.
+	WorkdirBase string
+	// RunAs is the user and group providers run as by default. If empty,
+	// they run as the client's user.
+	RunAs models.RunAs
+	// AllowedUsers and AllowedGroups are the users and groups, other than
+	// RunAs, that tasks may ask to be run as
+	AllowedUsers  []string
+	AllowedGroups []string
+	// Limits are the resource limits providers run with. They are only
+	// supported on Linux.
+	Limits models.ResourceLimits
+	// CgroupParent is a cgroup v2 directory a group is created in for each
+	// task. If empty, only rlimits are used.
+	CgroupParent string
+	// HTTPClient is the client builtin providers download files with. If
+	// nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+	// Infra is how the builtin infra provider runs chef-client
+	Infra InfraConfig
+}
+
+type ExecRunnerOpt func(*ExecRunnerOpts)
+
+func WithProvidersPath(path string) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.ProvidersPath = path
+	}
+}
+
+func WithAllowedProviders(providerNames []string) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.AllowedProviders = providerNames
+	}
+}
+
+func WithChecksums(checksums map[string]string) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.Checksums = checksums
+	}
+}
+
+func WithCachePath(path string) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.CachePath = path
+	}
+}
+
+func WithFileRoots(roots []string) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.FileRoots = roots
+	}
+}
+
+func WithEnvPassthrough(names []string) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.EnvPassthrough = names
+	}
+}
+
+func WithWorkdirBase(dir string) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.WorkdirBase = dir
+	}
+}
+
+func WithRunAs(user string, group string) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.RunAs = models.RunAs{User: user, Group: group}
+	}
+}
+
+func WithAllowedRunAs(users []string, groups []string) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.AllowedUsers = users
+		opts.AllowedGroups = groups
+	}
+}
+
+func WithLimits(limits models.ResourceLimits) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.Limits = limits
+	}
+}
+
+func WithCgroupParent(path string) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.CgroupParent = path
+	}
+}
+
+func WithHTTPClient(client *http.Client) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.HTTPClient = client
+	}
+}
+
+func WithInfraConfig(config InfraConfig) ExecRunnerOpt {
+	return func(opts *ExecRunnerOpts) {
+		opts.Infra = config
+	}
 }
 
 type ExecRunner struct {
+	opts ExecRunnerOpts
 }
 
-func NewExecRunner() *ExecRunner {
-	return &ExecRunner{}
+func NewExecRunner(opts ...ExecRunnerOpt) *ExecRunner {
+	eopts := ExecRunnerOpts{}
+	for _, o := range opts {
+		o(&eopts)
+	}
+	return &ExecRunner{opts: eopts}
 }
 
-func (p *ExecRunner) Run(ctx context.Context, providerName string, spec json.RawMessage) error {
-	if err := validateProviderName(providerName); err != nil {
-		return err
+// Run runs a provider with spec on its stdin, in a working directory created
+// for the task. The outputs the provider reported through the provider
+// protocol are returned even if the provider fails.
+func (p *ExecRunner) Run(ctx context.Context, providerName string, spec json.RawMessage, opts ...RunOpt) (*Outputs, error) {
+	ropts := RunOpts{}
+	for _, o := range opts {
+		o(&ropts)
 	}
 
-	execPath, err := exec.LookPath(fmt.Sprintf("foodtruck-provider-%s", providerName))
+	execPath, err := p.lookup(providerName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	e, cleanup, err := newExecEnv(p.opts, ropts)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
 	cmd := exec.Command(execPath)
+	e.apply(cmd)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	go func() {
@@ -45,14 +238,121 @@ func (p *ExecRunner) Run(ctx context.Context, providerName string, spec json.Raw
 
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", EnvProtocolVersion, ProtocolVersion))
 
-	if err := cmd.Run(); err != nil {
-		return err
+	outputs := &Outputs{}
+
+	// Windows cannot pass extra file descriptors to a child process, so
+	// providers there only report an exit code
+	if runtime.GOOS == "windows" {
+		if err := e.start(cmd); err != nil {
+			return nil, err
+		}
+		return outputs, e.wait(ctx, cmd)
 	}
 
-	return nil
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", EnvProtocolFD, protocolFD))
+
+	if err := e.start(cmd); err != nil {
+		w.Close()
+		return nil, err
+	}
+	// Only the provider should hold the write end open so that the reader
+	// sees EOF when it exits
+	w.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := readMessages(r, outputs, ropts.OnProgress); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			fmt.Fprintf(os.Stderr, "[Error] failed to read provider messages: %s\n", err)
+		}
+	}()
+
+	err = e.wait(ctx, cmd)
+
+	// A process started by the provider may have inherited the pipe and keep
+	// it open after the provider exits. Give the reader a moment to drain
+	// what was written and then stop waiting for it.
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	<-done
+
+	return outputs, err
+}
+
+// lookup finds the executable for a provider, making sure the provider is
+// allowed to run and its executable matches any pinned checksum
+func (p *ExecRunner) lookup(providerName string) (string, error) {
+	if err := validateProviderName(providerName); err != nil {
+		return "", err
+	}
+
+	if !p.isAllowed(providerName) {
+		return "", fmt.Errorf("%w: %q", ErrProviderNotAllowed, providerName)
+	}
+
+	if p.opts.ProvidersPath == "" {
+		return "", fmt.Errorf("%w: %q: no providers path is set", ErrProviderNotFound, providerName)
+	}
+	execPath, err := exec.LookPath(filepath.Join(p.opts.ProvidersPath, execPrefix+providerName))
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%w: %s", ErrProviderNotFound, err)
+		}
+		return "", err
+	}
+
+	if checksum, ok := p.opts.Checksums[providerName]; ok {
+		if err := verifyChecksum(execPath, checksum); err != nil {
+			return "", err
+		}
+	}
+
+	return execPath, nil
+}
+
+func (p *ExecRunner) isAllowed(providerName string) bool {
+	return isAllowed(p.opts.AllowedProviders, providerName)
+}
+
+func isAllowed(allowedProviders []string, providerName string) bool {
+	for _, allowed := range allowedProviders {
+		if allowed == providerName {
+			return true
+		}
+	}
+	return false
 }
 
 func validateProviderName(providerName string) error {
+	if !models.IsValidProviderName(providerName) {
+		return fmt.Errorf("%w: %q", ErrInvalidProviderName, providerName)
+	}
+	return nil
+}
+
+func verifyChecksum(execPath string, expected string) error {
+	f, err := os.Open(execPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != strings.ToLower(expected) {
+		return fmt.Errorf("%w: %s has sha256 %s", ErrChecksumMismatch, execPath, actual)
+	}
 	return nil
 }
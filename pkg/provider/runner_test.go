@@ -0,0 +1,186 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateProviderName(t *testing.T) {
+	for _, name := range []string{"infra", "file-download", "script_2"} {
+		require.NoError(t, validateProviderName(name), name)
+	}
+
+	for _, name := range []string{"", "../infra", "infra/../../bin/sh", "-infra", "Infra", "infra.exe", "in fra"} {
+		require.True(t, errors.Is(validateProviderName(name), ErrInvalidProviderName), name)
+	}
+}
+
+func TestExecRunnerLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "foodtruck-providers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("#!/bin/sh\nexit 0\n")
+	execPath := filepath.Join(dir, "foodtruck-provider-infra")
+	require.NoError(t, ioutil.WriteFile(execPath, content, 0755))
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	allowed := WithAllowedProviders([]string{"infra", "shell"})
+
+	t.Run("finds providers in the providers path", func(t *testing.T) {
+		r := NewExecRunner(WithProvidersPath(dir), allowed)
+		p, err := r.lookup("infra")
+		require.NoError(t, err)
+		require.Equal(t, execPath, p)
+
+		_, err = r.lookup("shell")
+		require.True(t, errors.Is(err, ErrProviderNotFound))
+	})
+
+	t.Run("requires a providers path", func(t *testing.T) {
+		r := NewExecRunner(allowed)
+		_, err := r.lookup("infra")
+		require.True(t, errors.Is(err, ErrProviderNotFound))
+
+		providers, err := r.Providers()
+		require.NoError(t, err)
+		require.Empty(t, providers)
+	})
+
+	t.Run("only allows providers in the allowlist", func(t *testing.T) {
+		r := NewExecRunner(WithProvidersPath(dir))
+		_, err := r.lookup("infra")
+		require.True(t, errors.Is(err, ErrProviderNotAllowed), "no provider is allowed by default")
+
+		r = NewExecRunner(WithProvidersPath(dir), WithAllowedProviders([]string{"shell"}))
+		_, err = r.lookup("infra")
+		require.True(t, errors.Is(err, ErrProviderNotAllowed))
+
+		r = NewExecRunner(WithProvidersPath(dir), WithAllowedProviders([]string{"shell", "infra"}))
+		_, err = r.lookup("infra")
+		require.NoError(t, err)
+	})
+
+	t.Run("verifies pinned checksums", func(t *testing.T) {
+		r := NewExecRunner(WithProvidersPath(dir), allowed, WithChecksums(map[string]string{"infra": checksum}))
+		_, err := r.lookup("infra")
+		require.NoError(t, err)
+
+		r = NewExecRunner(WithProvidersPath(dir), allowed, WithChecksums(map[string]string{"infra": checksum[1:] + "0"}))
+		_, err = r.lookup("infra")
+		require.True(t, errors.Is(err, ErrChecksumMismatch))
+	})
+}
+
+func TestExecRunnerProviders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "foodtruck-providers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name string, content string, mode os.FileMode) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), mode))
+	}
+	writeFile("foodtruck-provider-infra", "#!/bin/sh\n", 0755)
+	writeFile("foodtruck-provider-infra.version", "1.2.3\n", 0644)
+	writeFile("foodtruck-provider-shell", "#!/bin/sh\n", 0755)
+	writeFile("foodtruck-provider-notexec", "#!/bin/sh\n", 0644)
+	writeFile("foodtruck-provider-Invalid", "#!/bin/sh\n", 0755)
+	writeFile("some-other-binary", "#!/bin/sh\n", 0755)
+
+	t.Run("lists executable providers with their versions", func(t *testing.T) {
+		providers, err := NewExecRunner(WithProvidersPath(dir),
+			WithAllowedProviders([]string{"infra", "shell", "notexec", "Invalid"})).Providers()
+		require.NoError(t, err)
+		require.Equal(t, []models.NodeProvider{
+			{Name: "infra", Version: "1.2.3"},
+			{Name: "shell"},
+		}, providers)
+	})
+
+	t.Run("only lists allowed providers", func(t *testing.T) {
+		providers, err := NewExecRunner(WithProvidersPath(dir), WithAllowedProviders([]string{"shell"})).Providers()
+		require.NoError(t, err)
+		require.Equal(t, []models.NodeProvider{{Name: "shell"}}, providers)
+	})
+}
+
+func TestExecRunnerRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the provider protocol is not supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "foodtruck-providers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	script := `#!/bin/sh
+test "$FOODTRUCK_PROTOCOL_VERSION" = "1" || exit 3
+cat > /dev/null
+echo '{"type": "progress", "percent": 50}' >&$FOODTRUCK_PROTOCOL_FD
+echo '{"type": "log", "message": "halfway"}' >&$FOODTRUCK_PROTOCOL_FD
+echo '{"type": "result", "data": {"ok": true}}' >&$FOODTRUCK_PROTOCOL_FD
+exit 2
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foodtruck-provider-infra"), []byte(script), 0755))
+
+	var progress []int
+	r := NewExecRunner(WithProvidersPath(dir), WithAllowedProviders([]string{"infra"}))
+	outputs, err := r.Run(context.Background(), "infra", []byte(`{}`),
+		WithProgressFunc(func(percent int, message string) {
+			progress = append(progress, percent)
+		}))
+
+	exitErr := &exec.ExitError{}
+	require.True(t, errors.As(err, &exitErr))
+	require.Equal(t, 2, exitErr.ExitCode())
+
+	require.Equal(t, []int{50}, progress)
+	require.Equal(t, 50, outputs.Progress)
+	require.Len(t, outputs.Logs, 1)
+	require.Equal(t, "halfway", outputs.Logs[0].Message)
+	require.JSONEq(t, `{"ok": true}`, string(outputs.Output))
+}
+
+func TestExecRunnerRunCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("providers cannot be asked to exit on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "foodtruck-providers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	script := `#!/bin/sh
+cat > /dev/null
+trap 'echo terminated > ` + out + `; exit 1' TERM
+echo '{"type": "progress", "percent": 10}' >&$FOODTRUCK_PROTOCOL_FD
+while :; do sleep 0.1; done
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foodtruck-provider-custom"), []byte(script), 0755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := NewExecRunner(WithProvidersPath(dir), WithAllowedProviders([]string{"custom"}))
+	_, err = r.Run(ctx, "custom", []byte(`{}`),
+		WithProgressFunc(func(percent int, message string) {
+			cancel()
+		}))
+	require.True(t, errors.Is(err, context.Canceled), "%v", err)
+
+	data, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "terminated\n", string(data))
+}
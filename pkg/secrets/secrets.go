@@ -0,0 +1,253 @@
+// Package secrets handles spec fields that are marked as secret. A job
+// submitter marks a field as secret by wrapping its value:
+//
+//	{"url": "https://example.com/policy.tar.gz", "token": {"$secret": "abc123"}}
+//
+// The server seals secrets before storing the job, so they are encrypted at
+// rest, and redacts them when the job is returned to admins. Only the node
+// a task is sent to gets the secrets back, still wrapped, and the client
+// unwraps them before handing the spec to the provider.
+package secrets
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	secretField    = "$secret"
+	encryptedField = "$encrypted"
+
+	// Redacted replaces secrets in specs shown to admins
+	Redacted = "[REDACTED]"
+
+	keySize = 32
+)
+
+var ErrNoKeyring = errors.New("no secrets key configured")
+var ErrReservedField = fmt.Errorf("%q is reserved for encrypted secrets", encryptedField)
+var ErrInvalidKey = fmt.Errorf("secrets key must be %d bytes", keySize)
+
+var errSecretFound = errors.New("secret found")
+
+// Keyring seals and opens the secrets in specs using envelope encryption:
+// each spec gets a random data key that encrypts its secrets, and the data key
+// is itself encrypted with the server key.
+type Keyring struct {
+	key []byte
+}
+
+func NewKeyring(key []byte) (*Keyring, error) {
+	if len(key) != keySize {
+		return nil, ErrInvalidKey
+	}
+	return &Keyring{key: key}, nil
+}
+
+// LoadKeyring reads a base64 encoded 32 byte key from path. A key can be
+// created with:
+//
+//	openssl rand -base64 32
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secrets key: %w", err)
+	}
+	return NewKeyring(key)
+}
+
+// Seal encrypts every secret in spec. It returns the sealed spec along with
+// the encrypted data key needed to open it.
+func (k *Keyring) Seal(spec json.RawMessage) (json.RawMessage, []byte, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, err
+	}
+
+	sealed, err := transform(spec, func(field string, value interface{}) (interface{}, error) {
+		if field == encryptedField {
+			return nil, ErrReservedField
+		}
+		plaintext, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		ciphertext, err := encrypt(dataKey, plaintext)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{encryptedField: base64.StdEncoding.EncodeToString(ciphertext)}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrappedKey, err := encrypt(k.key, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sealed, wrappedKey, nil
+}
+
+// Open decrypts every secret in a sealed spec. The secrets are left wrapped
+// so that the spec matches what the job submitter sent.
+func (k *Keyring) Open(spec json.RawMessage, wrappedKey []byte) (json.RawMessage, error) {
+	if !ContainsSecrets(spec) {
+		return spec, nil
+	}
+
+	dataKey, err := decrypt(k.key, wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+
+	return transform(spec, func(field string, value interface{}) (interface{}, error) {
+		if field != encryptedField {
+			return map[string]interface{}{field: value}, nil
+		}
+		encoded, ok := value.(string)
+		if !ok {
+			return nil, errors.New("encrypted secret is not a string")
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := decrypt(dataKey, ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt secret: %w", err)
+		}
+		return map[string]interface{}{secretField: json.RawMessage(plaintext)}, nil
+	})
+}
+
+// Redact replaces every secret in spec, sealed or not, with Redacted
+func Redact(spec json.RawMessage) (json.RawMessage, error) {
+	if !ContainsSecrets(spec) {
+		return spec, nil
+	}
+	return transform(spec, func(field string, value interface{}) (interface{}, error) {
+		return Redacted, nil
+	})
+}
+
+// Unwrap replaces every secret in spec with its value. It is used by the
+// client before passing the spec to a provider.
+func Unwrap(spec json.RawMessage) (json.RawMessage, error) {
+	if !ContainsSecrets(spec) {
+		return spec, nil
+	}
+	return transform(spec, func(field string, value interface{}) (interface{}, error) {
+		if field == encryptedField {
+			return nil, errors.New("spec contains a secret that was not decrypted")
+		}
+		return value, nil
+	})
+}
+
+// ContainsSecrets reports whether spec contains a secret, that is an object
+// with a single $secret or $encrypted field. Specs that only mention those
+// names elsewhere, for example in a string or alongside other fields, do not
+// contain secrets.
+func ContainsSecrets(spec json.RawMessage) bool {
+	_, err := transform(spec, func(field string, value interface{}) (interface{}, error) {
+		return nil, errSecretFound
+	})
+	// Err on the side of treating specs that can't be parsed as secret
+	return err != nil
+}
+
+// transform calls f for every secret in spec, replacing it with the value f
+// returns. A secret is an object with a single $secret or $encrypted field.
+func transform(spec json.RawMessage, f func(field string, value interface{}) (interface{}, error)) (json.RawMessage, error) {
+	if len(spec) == 0 {
+		return spec, nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(spec))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	v, err := walk(v, f)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func walk(v interface{}, f func(field string, value interface{}) (interface{}, error)) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 1 {
+			for _, field := range []string{secretField, encryptedField} {
+				if value, ok := t[field]; ok {
+					return f(field, value)
+				}
+			}
+		}
+		for key, value := range t {
+			newValue, err := walk(value, f)
+			if err != nil {
+				return nil, err
+			}
+			t[key] = newValue
+		}
+	case []interface{}:
+		for i := range t {
+			newValue, err := walk(t[i], f)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = newValue
+		}
+	}
+	return v, nil
+}
+
+func encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,108 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(bytes.Repeat([]byte{1}, keySize))
+	require.NoError(t, err)
+	return k
+}
+
+func TestSealAndOpen(t *testing.T) {
+	k := newTestKeyring(t)
+	spec := json.RawMessage(`{
+		"url": "https://example.com/policy.tar.gz",
+		"token": {"$secret": "abc123"},
+		"headers": [{"name": "auth", "value": {"$secret": {"user": "u", "password": "p"}}}]
+	}`)
+
+	sealed, secretsKey, err := k.Seal(spec)
+	require.NoError(t, err)
+	require.NotContains(t, string(sealed), "abc123")
+	require.NotContains(t, string(sealed), "password")
+	require.Contains(t, string(sealed), "https://example.com/policy.tar.gz")
+
+	t.Run("open returns the wrapped secrets", func(t *testing.T) {
+		opened, err := k.Open(sealed, secretsKey)
+		require.NoError(t, err)
+		require.JSONEq(t, string(spec), string(opened))
+	})
+
+	t.Run("open fails with a different key", func(t *testing.T) {
+		other, err := NewKeyring(bytes.Repeat([]byte{2}, keySize))
+		require.NoError(t, err)
+		_, err = other.Open(sealed, secretsKey)
+		require.Error(t, err)
+	})
+
+	t.Run("redact hides sealed secrets", func(t *testing.T) {
+		redacted, err := Redact(sealed)
+		require.NoError(t, err)
+		require.JSONEq(t, `{
+			"url": "https://example.com/policy.tar.gz",
+			"token": "[REDACTED]",
+			"headers": [{"name": "auth", "value": "[REDACTED]"}]
+		}`, string(redacted))
+	})
+
+	t.Run("unwrap returns the plain spec", func(t *testing.T) {
+		opened, err := k.Open(sealed, secretsKey)
+		require.NoError(t, err)
+		unwrapped, err := Unwrap(opened)
+		require.NoError(t, err)
+		require.JSONEq(t, `{
+			"url": "https://example.com/policy.tar.gz",
+			"token": "abc123",
+			"headers": [{"name": "auth", "value": {"user": "u", "password": "p"}}]
+		}`, string(unwrapped))
+	})
+
+	t.Run("unwrap refuses sealed secrets", func(t *testing.T) {
+		_, err := Unwrap(sealed)
+		require.Error(t, err)
+	})
+}
+
+func TestSealRejectsEncryptedField(t *testing.T) {
+	k := newTestKeyring(t)
+	_, _, err := k.Seal(json.RawMessage(`{"token": {"$encrypted": "abc"}}`))
+	require.True(t, errors.Is(err, ErrReservedField))
+}
+
+func TestSpecsWithoutSecretsAreUnchanged(t *testing.T) {
+	spec := json.RawMessage(`{"b": 1, "a": {"$other": 2.50}}`)
+
+	redacted, err := Redact(spec)
+	require.NoError(t, err)
+	require.Equal(t, spec, redacted)
+
+	unwrapped, err := Unwrap(spec)
+	require.NoError(t, err)
+	require.Equal(t, spec, unwrapped)
+}
+
+func TestContainsSecrets(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected bool
+	}{
+		{`{"token": {"$secret": "abc"}}`, true},
+		{`{"tokens": [{"$encrypted": "abc"}]}`, true},
+		{`{"token": {"\u0024secret": "abc"}}`, true},
+		{`{"note": "wrap values in {\"$secret\": ...}"}`, false},
+		{`{"token": {"$secret": "abc", "other": 1}}`, false},
+		{`{"$secret": {"a": 1}, "b": 2}`, false},
+		{``, false},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, ContainsSecrets(json.RawMessage(test.spec)), test.spec)
+	}
+}
@@ -7,26 +7,38 @@ import (
 	"time"
 
 	"github.com/chef/foodtruck/pkg/models"
+	"github.com/chef/foodtruck/pkg/secrets"
 	"github.com/chef/foodtruck/pkg/storage"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 )
 
-func initAdminRouter(e *echo.Echo, db storage.Driver, adminAPIKey string) {
+func initAdminRouter(e *echo.Echo, db storage.Driver, adminKeys *KeySet, notifier *taskNotifier, opts SetupOpts) {
 	handler := &AdminRoutesHandler{
-		db: db,
+		db:                         db,
+		notifier:                   notifier,
+		keyring:                    opts.SecretsKeyring,
+		allowUnregisteredProviders: opts.AllowUnregisteredProviders,
 	}
 	adminRoutes := e.Group("/admin")
-	adminRoutes.Use(middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
-		// Probably not ok: this isn't a constant time compare
-		return key == adminAPIKey, nil
-	}))
+	adminRoutes.Use(keyAuth("admin", adminKeys))
+	if opts.AdminRateLimit.enabled() {
+		adminRoutes.Use(rateLimit("admin", opts.AdminRateLimit, nil))
+	}
 	adminRoutes.POST("/jobs", handler.AddJob)
 	adminRoutes.GET("/jobs/:job_id", handler.GetJob)
+	adminRoutes.GET("/jobs/:job_id/nodes/:org/:name", handler.GetNodeTaskStatus)
+	adminRoutes.POST("/jobs/:job_id/cancel", handler.CancelJob)
+	adminRoutes.GET("/providers", handler.ListProviders)
+	adminRoutes.PUT("/providers/:name", handler.PutProvider)
+	adminRoutes.GET("/providers/:name", handler.GetProvider)
+	adminRoutes.DELETE("/providers/:name", handler.DeleteProvider)
 }
 
 type AdminRoutesHandler struct {
-	db storage.Driver
+	db                         storage.Driver
+	notifier                   *taskNotifier
+	keyring                    *secrets.Keyring
+	allowUnregisteredProviders bool
 }
 
 type AddJobResult struct {
@@ -63,17 +75,60 @@ func (h *AdminRoutesHandler) AddJob(c echo.Context) error {
 		return &echo.HTTPError{Code: http.StatusBadRequest, Message: "task provider must be provided"}
 	}
 
+	if !models.IsValidProviderName(job.Task.Provider) {
+		return &echo.HTTPError{Code: http.StatusBadRequest, Message: "task provider is not a valid provider name"}
+	}
+
 	for i, n := range job.Nodes {
 		if n.Name == "" || n.Organization == "" {
 			return &echo.HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("nodes[%d] is not a valid node", i)}
 		}
 	}
 
+	if err := models.ValidateTaskEnv(job.Task.Env); err != nil {
+		return &echo.HTTPError{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+
+	if job.Task.Signature != nil && (job.ID == "" || job.Task.Signature.KeyID == "" || len(job.Task.Signature.Signature) == 0) {
+		return &echo.HTTPError{Code: http.StatusBadRequest, Message: "signed tasks must provide an id, key_id and signature"}
+	}
+
+	if err := h.validateTaskProvider(c, job.Task); err != nil {
+		return err
+	}
+
+	if secrets.ContainsSecrets(job.Task.Spec) {
+		if h.keyring == nil {
+			return &echo.HTTPError{Code: http.StatusBadRequest, Message: "secrets are not enabled on this server"}
+		}
+		spec, secretsKey, err := h.keyring.Seal(job.Task.Spec)
+		if err != nil {
+			if errors.Is(err, secrets.ErrReservedField) {
+				return &echo.HTTPError{Code: http.StatusBadRequest, Message: err.Error()}
+			}
+			return &echo.HTTPError{Code: http.StatusInternalServerError, Message: "failed to encrypt secrets in spec", Internal: err}
+		}
+		job.Task.Spec = spec
+		job.Task.SecretsKey = secretsKey
+	}
+
 	jobID, err := h.db.AddJob(c.Request().Context(), job)
 	if err != nil {
+		if errors.Is(err, models.ErrInvalidJobID) {
+			return &echo.HTTPError{Code: http.StatusBadRequest, Message: "id is not a valid job id"}
+		}
+		if errors.Is(err, models.ErrJobExists) {
+			return &echo.HTTPError{Code: http.StatusConflict, Message: "job already exists"}
+		}
 		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
 	}
 
+	nodeNames := make([]string, len(job.Nodes))
+	for i := range job.Nodes {
+		nodeNames[i] = job.Nodes[i].String()
+	}
+	h.notifier.notify(nodeNames...)
+
 	return c.JSON(200, AddJobResult{JobID: jobID})
 }
 
@@ -94,5 +149,53 @@ func (h *AdminRoutesHandler) GetJob(c echo.Context) error {
 		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
 	}
 
+	job.Job.Task.Spec, err = secrets.Redact(job.Job.Task.Spec)
+	if err != nil {
+		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
+	}
+
 	return c.JSON(200, job)
 }
+
+// GetNodeTaskStatus returns the status of a job's task on a single node,
+// along with every status the task went through
+func (h *AdminRoutesHandler) GetNodeTaskStatus(c echo.Context) error {
+	jobID := c.Param("job_id")
+	node := models.Node{
+		Organization: c.Param("org"),
+		Name:         c.Param("name"),
+	}
+
+	status, err := h.db.GetNodeTaskStatus(c.Request().Context(), jobID, node)
+	if err != nil {
+		if errors.Is(err, models.ErrJobNotForNode) {
+			return &echo.HTTPError{Code: http.StatusNotFound, Message: "job does not target this node"}
+		}
+		if errors.Is(err, models.ErrNotFound) {
+			return &echo.HTTPError{Code: http.StatusNotFound, Message: "node has not received the task yet"}
+		}
+		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
+	}
+
+	return c.JSON(200, status)
+}
+
+// CancelJob cancels the tasks of a job the nodes have not finished. The nodes
+// running it are asked to stop through their events stream.
+func (h *AdminRoutesHandler) CancelJob(c echo.Context) error {
+	jobID := c.Param("job_id")
+
+	result, err := h.db.CancelJob(c.Request().Context(), jobID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return &echo.HTTPError{Code: http.StatusNotFound, Message: "job not found"}
+		}
+		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
+	}
+
+	for _, node := range result.Running {
+		h.notifier.cancel(node.String(), jobID)
+	}
+
+	return c.JSON(200, result)
+}
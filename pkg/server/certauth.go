@@ -0,0 +1,70 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/labstack/echo/v4"
+)
+
+// ContextCertNode is the echo context key holding the node identified by the
+// client certificate presented with the request
+const ContextCertNode = "foodtruck_cert_node"
+
+var ErrInvalidCertificateSubject = errors.New("certificate subject does not identify a node")
+
+// NodeFromCertificate maps the subject of a client certificate to a node. The
+// common name is the name of the node, and the first organization is the org
+// of the node.
+func NodeFromCertificate(cert *x509.Certificate) (models.Node, error) {
+	if cert.Subject.CommonName == "" || len(cert.Subject.Organization) == 0 || cert.Subject.Organization[0] == "" {
+		return models.Node{}, ErrInvalidCertificateSubject
+	}
+	return models.Node{
+		Organization: cert.Subject.Organization[0],
+		Name:         cert.Subject.CommonName,
+	}, nil
+}
+
+// nodeAuth returns middleware authenticating requests to the nodes routes. If
+// certAuth is enabled and the request was made with a verified client
+// certificate, the node in the certificate must match the node in the path.
+// Otherwise, the request must carry a key in keys.
+func nodeAuth(keys *KeySet, certAuth bool) echo.MiddlewareFunc {
+	keyAuthMiddleware := keyAuth("nodes", keys)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		keyAuthHandler := keyAuthMiddleware(next)
+		return func(c echo.Context) error {
+			if !certAuth {
+				return keyAuthHandler(c)
+			}
+			cert := verifiedClientCertificate(c.Request())
+			if cert == nil {
+				return keyAuthHandler(c)
+			}
+
+			certNode, err := NodeFromCertificate(cert)
+			if err != nil {
+				return &echo.HTTPError{Code: http.StatusUnauthorized, Message: "Unauthorized", Internal: err}
+			}
+			node, err := nodeFromContext(c)
+			if err != nil {
+				return err
+			}
+			if certNode != node {
+				return &echo.HTTPError{Code: http.StatusForbidden, Message: "certificate does not match node"}
+			}
+			c.Set(ContextCertNode, certNode)
+			return next(c)
+		}
+	}
+}
+
+func verifiedClientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeFromCertificate(t *testing.T) {
+	node, err := NodeFromCertificate(&x509.Certificate{
+		Subject: pkix.Name{CommonName: "node1", Organization: []string{"org1"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, models.Node{Organization: "org1", Name: "node1"}, node)
+
+	_, err = NodeFromCertificate(&x509.Certificate{
+		Subject: pkix.Name{CommonName: "node1"},
+	})
+	require.Error(t, err)
+}
+
+func TestNodeAuth(t *testing.T) {
+	keys, err := NewStaticKeySet("nodes-key")
+	require.NoError(t, err)
+
+	e := echo.New()
+	g := e.Group("/organizations/:org/foodtruck/nodes/:name")
+	g.Use(nodeAuth(keys, true))
+	g.POST("/tasks/next", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	certFor := func(org string, name string) *tls.ConnectionState {
+		return &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{
+				{Subject: pkix.Name{CommonName: name, Organization: []string{org}}},
+			}},
+		}
+	}
+
+	do := func(state *tls.ConnectionState, key string) int {
+		req := httptest.NewRequest("POST", "/organizations/org1/foodtruck/nodes/node1/tasks/next", nil)
+		req.TLS = state
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("accepts a certificate for the node", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, do(certFor("org1", "node1"), ""))
+	})
+
+	t.Run("rejects a certificate for another node", func(t *testing.T) {
+		require.Equal(t, http.StatusForbidden, do(certFor("org1", "node2"), ""))
+		require.Equal(t, http.StatusForbidden, do(certFor("org2", "node1"), "nodes-key"))
+	})
+
+	t.Run("falls back to api keys without a certificate", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, do(nil, "nodes-key"))
+		require.Equal(t, http.StatusUnauthorized, do(nil, "wrong-key"))
+		require.Equal(t, http.StatusBadRequest, do(nil, ""))
+	})
+}
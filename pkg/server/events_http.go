@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/labstack/echo/v4"
+)
+
+// Events streams events to the node as server-sent events until it
+// disconnects. A task_available event is sent first, along with the tasks
+// cancelled while the node was not connected, so that nothing that happened
+// in between is missed.
+func (h *NodeRoutesHandler) Events(c echo.Context) error {
+	node, err := nodeFromContext(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+
+	// Subscribing first, so events sent while looking for the cancelled
+	// tasks are not missed
+	events, done := h.notifier.subscribe(node.String())
+	defer done()
+
+	cancelled, err := h.db.GetCancelledTasks(ctx, node)
+	if err != nil {
+		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.Header().Set(models.HeartbeatHeader, strconv.FormatFloat(h.eventsHeartbeat.Seconds(), 'f', -1, 64))
+	res.WriteHeader(http.StatusOK)
+
+	initial := []models.NodeEvent{{Type: models.NodeEventTaskAvailable}}
+	for _, jobID := range cancelled {
+		initial = append(initial, models.NodeEvent{Type: models.NodeEventCancel, JobID: jobID})
+	}
+	for _, event := range initial {
+		if err := writeEvent(res, event); err != nil {
+			return nil
+		}
+	}
+
+	releaseConcurrency(c)
+	heartbeat := time.NewTicker(h.eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var event models.NodeEvent
+		select {
+		case <-ctx.Done():
+			return nil
+		case event = <-events:
+		case <-heartbeat.C:
+			event = models.NodeEvent{Type: models.NodeEventHeartbeat}
+		}
+		if err := writeEvent(res, event); err != nil {
+			// The node is gone
+			return nil
+		}
+	}
+}
+
+func writeEvent(res *echo.Response, event models.NodeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
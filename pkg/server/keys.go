@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultKeyID is the id given to a key that was not loaded from a key file
+const DefaultKeyID = "default"
+
+// ContextKeyID is the echo context key holding the id of the api key used
+// to authenticate the request
+const ContextKeyID = "foodtruck_api_key_id"
+
+var ErrNoKeys = errors.New("no api keys provided")
+
+var apiKeyRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "foodtruck",
+	Name:      "api_key_requests_total",
+	Help:      "Number of requests authenticated by each api key.",
+}, []string{"scope", "key_id"})
+
+func init() {
+	prometheus.MustRegister(apiKeyRequestsTotal)
+}
+
+type apiKey struct {
+	id   string
+	hash [sha256.Size]byte
+}
+
+// KeySet is a set of api keys that are accepted for a group of routes. Having
+// more than one active key allows keys to be rotated: the next key is added,
+// clients are moved over to it, and the old key is removed once the metrics
+// show it is no longer used.
+type KeySet struct {
+	path string
+
+	mu   sync.RWMutex
+	keys []apiKey
+}
+
+// NewStaticKeySet returns a KeySet containing the single key provided. The
+// key is given the id DefaultKeyID.
+func NewStaticKeySet(key string) (*KeySet, error) {
+	ks := &KeySet{}
+	if err := ks.set(map[string]string{DefaultKeyID: key}); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// LoadKeySet reads a KeySet from a json file mapping key ids to keys. For
+// example:
+//
+//	{"2021-01": "1ffd0e1090f0842e0cd2", "2021-02": "cfc69ed63341dd2403ed"}
+//
+// The file can be read again with Reload.
+func LoadKeySet(path string) (*KeySet, error) {
+	ks := &KeySet{path: path}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Reload rereads the key file the KeySet was loaded from. If the file cannot
+// be read or is invalid, the current keys are kept. Reload does nothing for a
+// static KeySet.
+func (ks *KeySet) Reload() error {
+	if ks.path == "" {
+		return nil
+	}
+
+	d, err := ioutil.ReadFile(ks.path)
+	if err != nil {
+		return fmt.Errorf("failed to read key file %s: %w", ks.path, err)
+	}
+
+	keys := map[string]string{}
+	if err := json.Unmarshal(d, &keys); err != nil {
+		return fmt.Errorf("failed to parse key file %s: %w", ks.path, err)
+	}
+
+	return ks.set(keys)
+}
+
+func (ks *KeySet) set(keys map[string]string) error {
+	hashed := make([]apiKey, 0, len(keys))
+	for id, key := range keys {
+		if key == "" {
+			return fmt.Errorf("api key %q is empty", id)
+		}
+		hashed = append(hashed, apiKey{id: id, hash: sha256.Sum256([]byte(key))})
+	}
+
+	if len(hashed) == 0 {
+		return ErrNoKeys
+	}
+
+	ks.mu.Lock()
+	ks.keys = hashed
+	ks.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the id of the key matching the one provided. The provided key
+// is compared against every key in the set in constant time.
+func (ks *KeySet) Lookup(key string) (string, bool) {
+	h := sha256.Sum256([]byte(key))
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	matchedID := ""
+	found := 0
+	for i := range ks.keys {
+		match := subtle.ConstantTimeCompare(h[:], ks.keys[i].hash[:])
+		if match == 1 {
+			matchedID = ks.keys[i].id
+		}
+		found |= match
+	}
+	return matchedID, found == 1
+}
+
+// keyAuth returns middleware that only allows requests carrying a key in ks.
+// The id of the key used is stored in the context under ContextKeyID.
+func keyAuth(scope string, ks *KeySet) echo.MiddlewareFunc {
+	return middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		id, ok := ks.Lookup(key)
+		if !ok {
+			return false, nil
+		}
+		apiKeyRequestsTotal.WithLabelValues(scope, id).Inc()
+		c.Set(ContextKeyID, id)
+		return true, nil
+	})
+}
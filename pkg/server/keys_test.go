@@ -0,0 +1,83 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySetLookup(t *testing.T) {
+	ks, err := NewStaticKeySet("secret")
+	require.NoError(t, err)
+
+	id, ok := ks.Lookup("secret")
+	require.True(t, ok)
+	require.Equal(t, DefaultKeyID, id)
+
+	_, ok = ks.Lookup("secre")
+	require.False(t, ok)
+
+	_, ok = ks.Lookup("")
+	require.False(t, ok)
+}
+
+func TestKeySetEmpty(t *testing.T) {
+	_, err := NewStaticKeySet("")
+	require.Error(t, err)
+}
+
+func TestKeySetReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "foodtruck-keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "keys.json")
+	writeFile(t, keyFile, `{"current": "key1", "next": "key2"}`)
+
+	ks, err := LoadKeySet(keyFile)
+	require.NoError(t, err)
+
+	id, ok := ks.Lookup("key1")
+	require.True(t, ok)
+	require.Equal(t, "current", id)
+
+	id, ok = ks.Lookup("key2")
+	require.True(t, ok)
+	require.Equal(t, "next", id)
+
+	t.Run("retires old keys", func(t *testing.T) {
+		writeFile(t, keyFile, `{"current": "key2"}`)
+		require.NoError(t, ks.Reload())
+
+		_, ok := ks.Lookup("key1")
+		require.False(t, ok)
+
+		id, ok := ks.Lookup("key2")
+		require.True(t, ok)
+		require.Equal(t, "current", id)
+	})
+
+	t.Run("keeps keys when the file is invalid", func(t *testing.T) {
+		writeFile(t, keyFile, `{"current": `)
+		require.Error(t, ks.Reload())
+
+		_, ok := ks.Lookup("key2")
+		require.True(t, ok)
+	})
+
+	t.Run("keeps keys when the file is empty", func(t *testing.T) {
+		writeFile(t, keyFile, `{}`)
+		require.Error(t, ks.Reload())
+
+		_, ok := ks.Lookup("key2")
+		require.True(t, ok)
+	})
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+}
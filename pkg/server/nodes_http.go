@@ -1,52 +1,185 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chef/foodtruck/pkg/models"
+	"github.com/chef/foodtruck/pkg/secrets"
 	"github.com/chef/foodtruck/pkg/storage"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 )
 
-func initNodesRouter(e *echo.Echo, db storage.Driver, nodesAPIKey string) {
+func initNodesRouter(e *echo.Echo, db storage.Driver, nodesKeys *KeySet, notifier *taskNotifier, opts SetupOpts) {
 	handler := &NodeRoutesHandler{
-		db: db,
+		db:              db,
+		keyring:         opts.SecretsKeyring,
+		notifier:        notifier,
+		longPollMaxWait: opts.LongPollMaxWait,
+		eventsHeartbeat: opts.EventsHeartbeat,
+		pollHints: &pollHints{
+			interval:    opts.PollInterval,
+			maxInterval: opts.PollMaxInterval,
+			targetRate:  opts.PollTargetRate,
+		},
 	}
 	nodesRoutes := e.Group("/organizations/:org/foodtruck/nodes/:name")
-	nodesRoutes.Use(middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
-		// Probably not ok: this isn't a constant time compare
-		return key == nodesAPIKey, nil
-	}))
+	nodesRoutes.Use(nodeAuth(nodesKeys, opts.NodeCertificateAuth))
+	if opts.NodesRateLimit.enabled() {
+		nodesRoutes.Use(rateLimit("nodes", opts.NodesRateLimit, func(c echo.Context) string {
+			return c.Param("org") + "/" + c.Param("name")
+		}))
+	}
 
 	nodesRoutes.POST("/tasks/next", handler.GetNextTask)
+	nodesRoutes.POST("/tasks/peek", handler.PeekNextTask)
 	nodesRoutes.POST("/tasks/status", handler.UpdateNodeTaskStatus)
+	nodesRoutes.POST("/tasks/events", handler.Events)
 }
 
 type NodeRoutesHandler struct {
-	db storage.Driver
+	db              storage.Driver
+	keyring         *secrets.Keyring
+	notifier        *taskNotifier
+	longPollMaxWait time.Duration
+	eventsHeartbeat time.Duration
+	pollHints       *pollHints
 }
 
+// GetNextTask dequeues the next task of the node. If there is none and the
+// node asked to wait, the request is held until a task is added for the node
+// or the wait is over. If there is still none, the node may be told how long
+// to wait before asking again with the Retry-After header.
 func (h *NodeRoutesHandler) GetNextTask(c echo.Context) error {
+	return h.nextTask(c, true)
+}
+
+// PeekNextTask returns the task GetNextTask would return without dequeuing
+// it, so a node can show what it would run next
+func (h *NodeRoutesHandler) PeekNextTask(c echo.Context) error {
+	return h.nextTask(c, false, storage.WithPeek())
+}
+
+func (h *NodeRoutesHandler) nextTask(c echo.Context, longPoll bool, opts ...storage.NextNodeTaskOpt) error {
 	node, err := nodeFromContext(c)
 	if err != nil {
 		return err
 	}
-	task, err := h.db.NextNodeTask(c.Request().Context(), node)
+	req := models.NextTaskRequest{}
+	if err := c.Bind(&req); err != nil {
+		return &echo.HTTPError{Code: http.StatusBadRequest, Message: "invalid request json"}
+	}
+
+	if req.Providers != nil {
+		providers := make([]string, len(req.Providers))
+		for i := range req.Providers {
+			providers[i] = req.Providers[i].Name
+		}
+		opts = append(opts, storage.WithAvailableProviders(providers))
+	}
+	if len(req.BusyProviders) > 0 {
+		opts = append(opts, storage.WithBusyProviders(req.BusyProviders))
+	}
+
+	if longPoll {
+		h.pollHints.requests.mark(time.Now())
+	}
+
+	wait := time.Duration(0)
+	if longPoll && h.longPollMaxWait > 0 {
+		c.Response().Header().Set(models.LongPollHeader, strconv.Itoa(int(h.longPollMaxWait.Seconds())))
+		wait = time.Duration(req.Wait) * time.Second
+		if wait > h.longPollMaxWait {
+			wait = h.longPollMaxWait
+		}
+	}
+
+	task, err := h.waitForTask(c, node, wait, opts...)
 	if err != nil {
 		if errors.Is(err, models.ErrNoTasks) {
+			if longPoll {
+				setRetryAfter(c, h.retryAfter(err, wait > 0))
+			}
 			return &echo.HTTPError{Code: http.StatusNotFound, Message: "no tasks available"}
 		}
 		fmt.Printf("ERROR: %s\n", err)
 		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
 	}
 
+	if len(task.SecretsKey) > 0 {
+		if h.keyring == nil {
+			return &echo.HTTPError{Code: http.StatusInternalServerError, Message: "task contains secrets but secrets are not enabled"}
+		}
+		task.Spec, err = h.keyring.Open(task.Spec, task.SecretsKey)
+		if err != nil {
+			return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
+		}
+	}
+
 	return c.JSON(http.StatusOK, task)
 }
 
+// waitForTask returns the next task of the node, waiting up to wait for tasks
+// to be added if there is none. The request's slot under the concurrency limit
+// is given up while waiting, and taken again before looking for tasks.
+func (h *NodeRoutesHandler) waitForTask(c echo.Context, node models.Node, wait time.Duration,
+	opts ...storage.NextNodeTaskOpt) (models.NodeTask, error) {
+	ctx := c.Request().Context()
+	if wait <= 0 {
+		return h.db.NextNodeTask(ctx, node, opts...)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	for {
+		// Waiting starts before looking, so tasks added in between are not
+		// missed
+		added, done := h.notifier.wait(node.String())
+		task, err := h.db.NextNodeTask(ctx, node, opts...)
+		if !errors.Is(err, models.ErrNoTasks) {
+			done()
+			return task, err
+		}
+
+		releaseConcurrency(c)
+		select {
+		case <-added:
+		case <-waitCtx.Done():
+			done()
+			return models.NodeTask{}, models.ErrNoTasks
+		}
+		if err := acquireConcurrency(waitCtx, c); err != nil {
+			return models.NodeTask{}, models.ErrNoTasks
+		}
+	}
+}
+
+// retryAfter returns how long the node should wait before asking for tasks
+// again after it was told it has none with err
+func (h *NodeRoutesHandler) retryAfter(err error, longPoll bool) time.Duration {
+	nextWindowStart := time.Time{}
+	noTasksErr := &models.NoTasksError{}
+	if errors.As(err, &noTasksErr) {
+		nextWindowStart = noTasksErr.NextWindowStart
+	}
+	return h.pollHints.hint(time.Now(), nextWindowStart, longPoll)
+}
+
+// setRetryAfter sets the Retry-After header to d rounded up to the second, if
+// d is not 0
+func setRetryAfter(c echo.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	secs := int((d + time.Second - 1) / time.Second)
+	c.Response().Header().Set("Retry-After", strconv.Itoa(secs))
+}
+
 func (h *NodeRoutesHandler) UpdateNodeTaskStatus(c echo.Context) error {
 	node, err := nodeFromContext(c)
 	if err != nil {
@@ -63,8 +196,26 @@ func (h *NodeRoutesHandler) UpdateNodeTaskStatus(c echo.Context) error {
 	if !models.IsValidTaskStatus(string(body.Status)) {
 		return &echo.HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("status must be one of (%s)", strings.Join(models.ValidTaskStatuses, ","))}
 	}
+	if body.Result != nil {
+		if err := validateResult(body.Result); err != nil {
+			return &echo.HTTPError{Code: http.StatusBadRequest, Message: err.Error()}
+		}
+	}
 	err = h.db.UpdateNodeTaskStatus(c.Request().Context(), node, body)
 	if err != nil {
+		if errors.Is(err, models.ErrTaskNotSent) {
+			return &echo.HTTPError{Code: http.StatusConflict, Message: "the task has not been sent to this node"}
+		}
+		transitionErr := &models.StatusTransitionError{}
+		if errors.As(err, &transitionErr) {
+			return &echo.HTTPError{Code: http.StatusConflict, Message: echo.Map{
+				"message": fmt.Sprintf("status cannot change from %s to %s", transitionErr.Current.Status, body.Status),
+				"current": transitionErr.Current,
+			}}
+		}
+		if errors.Is(err, models.ErrJobNotForNode) {
+			return &echo.HTTPError{Code: http.StatusNotFound, Message: "job does not target this node"}
+		}
 		if errors.Is(err, models.ErrNoTasks) {
 			return &echo.HTTPError{Code: http.StatusNotFound, Message: "no tasks available"}
 		}
@@ -74,6 +225,27 @@ func (h *NodeRoutesHandler) UpdateNodeTaskStatus(c echo.Context) error {
 	return c.JSONBlob(http.StatusOK, []byte("{}"))
 }
 
+// validateResult makes sure the provider outputs in a result are within the
+// limits the client enforces, so a misbehaving client cannot store
+// arbitrarily large documents
+func validateResult(result *models.NodeTaskStatusResult) error {
+	if result.Progress < 0 || result.Progress > 100 {
+		return errors.New("progress must be between 0 and 100")
+	}
+	if len(result.Logs) > models.MaxResultLogs {
+		return fmt.Errorf("at most %d logs may be provided", models.MaxResultLogs)
+	}
+	for i := range result.Logs {
+		if len(result.Logs[i].Message) > models.MaxResultLogMessageLen {
+			return fmt.Errorf("log messages may be at most %d bytes", models.MaxResultLogMessageLen)
+		}
+	}
+	if len(result.Output) > models.MaxResultOutputSize {
+		return fmt.Errorf("output may be at most %d bytes", models.MaxResultOutputSize)
+	}
+	return nil
+}
+
 func nodeFromContext(c echo.Context) (models.Node, error) {
 	org := c.Param("org")
 	name := c.Param("name")
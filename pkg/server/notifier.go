@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/chef/foodtruck/pkg/storage"
+)
+
+const (
+	// notifierPollInterval is how often the notifier checks storage for
+	// tasks added through other replicas
+	notifierPollInterval = time.Second
+	// notifierClockSkew is how far the clocks of the replicas may be apart.
+	// Updates are looked for this far in the past so none is missed.
+	notifierClockSkew = 5 * time.Second
+	// subscriberBuffer is how many events a node's events stream may fall
+	// behind before events for it are dropped
+	subscriberBuffer = 64
+)
+
+// taskNotifier wakes up the requests waiting for the next task of a node
+// when tasks are added for it, and sends events to the nodes connected to
+// their events stream
+type taskNotifier struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+	// seen is the last update of each node's tasks found by watch
+	seen        map[string]time.Time
+	subscribers map[string]map[chan models.NodeEvent]struct{}
+}
+
+func newTaskNotifier() *taskNotifier {
+	return &taskNotifier{
+		waiters:     map[string]map[chan struct{}]struct{}{},
+		seen:        map[string]time.Time{},
+		subscribers: map[string]map[chan models.NodeEvent]struct{}{},
+	}
+}
+
+// subscribe returns a channel receiving the events for the node, and a
+// function to call once the channel is no longer needed
+func (n *taskNotifier) subscribe(nodeName string) (<-chan models.NodeEvent, func()) {
+	ch := make(chan models.NodeEvent, subscriberBuffer)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subscribers[nodeName] == nil {
+		n.subscribers[nodeName] = map[chan models.NodeEvent]struct{}{}
+	}
+	n.subscribers[nodeName][ch] = struct{}{}
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.subscribers[nodeName], ch)
+		if len(n.subscribers[nodeName]) == 0 {
+			delete(n.subscribers, nodeName)
+		}
+	}
+}
+
+// publish sends an event to the node's subscribers. n.mu must be held. An
+// event is dropped for a subscriber that fell too far behind rather than
+// holding up the others.
+func (n *taskNotifier) publish(nodeName string, event models.NodeEvent) {
+	for ch := range n.subscribers[nodeName] {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("dropped %s event for %s", event.Type, nodeName)
+		}
+	}
+}
+
+// cancel lets the node know its task for the job was cancelled
+func (n *taskNotifier) cancel(nodeName string, jobID models.JobID) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.publish(nodeName, models.NodeEvent{Type: models.NodeEventCancel, JobID: jobID})
+}
+
+// wait returns a channel closed the next time tasks are added for the node,
+// and a function to call once the channel is no longer needed
+func (n *taskNotifier) wait(nodeName string) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.waiters[nodeName] == nil {
+		n.waiters[nodeName] = map[chan struct{}]struct{}{}
+	}
+	n.waiters[nodeName][ch] = struct{}{}
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if _, ok := n.waiters[nodeName][ch]; !ok {
+			return
+		}
+		delete(n.waiters[nodeName], ch)
+		if len(n.waiters[nodeName]) == 0 {
+			delete(n.waiters, nodeName)
+		}
+	}
+}
+
+// notify wakes up the requests waiting for the given nodes, and lets their
+// subscribers know tasks are available
+func (n *taskNotifier) notify(nodeNames ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, nodeName := range nodeNames {
+		for ch := range n.waiters[nodeName] {
+			close(ch)
+		}
+		delete(n.waiters, nodeName)
+		n.publish(nodeName, models.NodeEvent{Type: models.NodeEventTaskAvailable})
+	}
+}
+
+// watch notifies the nodes whose tasks were updated in storage until ctx is
+// done, so that jobs added or cancelled through another replica reach the
+// nodes waiting on this one
+func (n *taskNotifier) watch(ctx context.Context, updatedSince func(ctx context.Context,
+	since time.Time) ([]storage.NodeTasksUpdate, error), interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.poll(ctx, updatedSince, time.Now().Add(-notifierClockSkew)); err != nil {
+			log.Printf("failed to check for new tasks: %s", err)
+		}
+	}
+}
+
+// poll notifies the nodes whose tasks were updated after since and were not
+// notified for that update yet. Their subscribers are sent the cancelled
+// tasks again, which they ignore if they already stopped them.
+func (n *taskNotifier) poll(ctx context.Context, updatedSince func(ctx context.Context,
+	since time.Time) ([]storage.NodeTasksUpdate, error), since time.Time) error {
+	updates, err := updatedSince(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	var nodeNames []string
+	n.mu.Lock()
+	for _, u := range updates {
+		if u.Updated.After(n.seen[u.NodeName]) {
+			n.seen[u.NodeName] = u.Updated
+			nodeNames = append(nodeNames, u.NodeName)
+			for _, jobID := range u.Cancelled {
+				n.publish(u.NodeName, models.NodeEvent{Type: models.NodeEventCancel, JobID: jobID})
+			}
+		}
+	}
+	for nodeName, updated := range n.seen {
+		if !updated.After(since) {
+			delete(n.seen, nodeName)
+		}
+	}
+	n.mu.Unlock()
+
+	n.notify(nodeNames...)
+	return nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/chef/foodtruck/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskNotifier(t *testing.T) {
+	t.Run("wakes up the waiters of a node", func(t *testing.T) {
+		n := newTaskNotifier()
+		first, _ := n.wait("org/node")
+		second, _ := n.wait("org/node")
+		other, _ := n.wait("org/other")
+
+		n.notify("org/node")
+		requireClosed(t, first)
+		requireClosed(t, second)
+		requireOpen(t, other)
+	})
+
+	t.Run("forgets waiters that are done", func(t *testing.T) {
+		n := newTaskNotifier()
+		_, done := n.wait("org/node")
+		done()
+		require.Empty(t, n.waiters)
+		n.notify("org/node")
+	})
+
+	t.Run("notifies the nodes updated in storage once", func(t *testing.T) {
+		n := newTaskNotifier()
+		updated := time.Now()
+		updatedSince := func(ctx context.Context, since time.Time) ([]storage.NodeTasksUpdate, error) {
+			return []storage.NodeTasksUpdate{{NodeName: "org/node", Updated: updated}}, nil
+		}
+
+		added, _ := n.wait("org/node")
+		require.NoError(t, n.poll(context.Background(), updatedSince, updated.Add(-time.Second)))
+		requireClosed(t, added)
+
+		added, _ = n.wait("org/node")
+		require.NoError(t, n.poll(context.Background(), updatedSince, updated.Add(-time.Second)))
+		requireOpen(t, added)
+
+		updated = updated.Add(time.Millisecond)
+		require.NoError(t, n.poll(context.Background(), updatedSince, updated.Add(-time.Second)))
+		requireClosed(t, added)
+	})
+
+	t.Run("sends events to the subscribers of a node", func(t *testing.T) {
+		n := newTaskNotifier()
+		events, done := n.subscribe("org/node")
+		other, _ := n.subscribe("org/other")
+
+		n.notify("org/node")
+		n.cancel("org/node", "job1")
+		require.Equal(t, models.NodeEvent{Type: models.NodeEventTaskAvailable}, <-events)
+		require.Equal(t, models.NodeEvent{Type: models.NodeEventCancel, JobID: "job1"}, <-events)
+		require.Empty(t, other)
+
+		done()
+		require.NotContains(t, n.subscribers, "org/node")
+	})
+
+	t.Run("drops events for subscribers that fell behind", func(t *testing.T) {
+		n := newTaskNotifier()
+		events, _ := n.subscribe("org/node")
+		for i := 0; i < subscriberBuffer+1; i++ {
+			n.notify("org/node")
+		}
+		require.Len(t, events, subscriberBuffer)
+	})
+
+	t.Run("sends the cancelled tasks found in storage", func(t *testing.T) {
+		n := newTaskNotifier()
+		updated := time.Now()
+		updatedSince := func(ctx context.Context, since time.Time) ([]storage.NodeTasksUpdate, error) {
+			return []storage.NodeTasksUpdate{{NodeName: "org/node", Updated: updated, Cancelled: []models.JobID{"job1"}}}, nil
+		}
+
+		events, _ := n.subscribe("org/node")
+		require.NoError(t, n.poll(context.Background(), updatedSince, updated.Add(-time.Second)))
+		require.Equal(t, models.NodeEvent{Type: models.NodeEventCancel, JobID: "job1"}, <-events)
+		require.Equal(t, models.NodeEvent{Type: models.NodeEventTaskAvailable}, <-events)
+		require.Empty(t, events)
+	})
+}
+
+func requireClosed(t *testing.T, ch <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+	default:
+		t.Fatal("the waiter was not woken up")
+	}
+}
+
+func requireOpen(t *testing.T, ch <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+		t.Fatal("the waiter was woken up")
+	default:
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// rateMeter measures how many requests per second the server handles
+type rateMeter struct {
+	mu sync.Mutex
+	// current counts the requests since start, and previous the ones in the
+	// second before
+	current  int
+	previous int
+	start    time.Time
+}
+
+// mark counts a request made at now
+func (m *rateMeter) mark(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+	m.current++
+}
+
+// rate returns the requests per second over the last second at now. The
+// requests of the second before are weighted by how much of it is still in
+// the last second.
+func (m *rateMeter) rate(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+	elapsed := now.Sub(m.start).Seconds()
+	return float64(m.previous)*(1-elapsed) + float64(m.current)
+}
+
+func (m *rateMeter) advance(now time.Time) {
+	switch elapsed := now.Sub(m.start); {
+	case elapsed < time.Second:
+	case elapsed < 2*time.Second:
+		m.previous = m.current
+		m.current = 0
+		m.start = m.start.Add(time.Second)
+	default:
+		m.previous = 0
+		m.current = 0
+		m.start = now
+	}
+}
+
+// pollHints tells nodes how long to wait before asking for tasks again
+type pollHints struct {
+	// interval is how long nodes wait when the server is not busy. 0 leaves
+	// it to the nodes unless the server is busy.
+	interval time.Duration
+	// maxInterval caps the interval when the server is busy
+	maxInterval time.Duration
+	// targetRate is how many requests for tasks per second the server
+	// handles before it stretches the interval, in proportion to the excess.
+	// 0 never stretches it.
+	targetRate float64
+	requests   rateMeter
+}
+
+// hint returns how long a node should wait before asking for tasks again
+// after it was told it has none, or 0 to leave it to the node.
+// nextWindowStart is when the window of the node's next task starts, if it
+// has one. It only shortens the wait: a node told to wait until then would
+// not see tasks added in the meantime. A node that waited for tasks with long
+// polling may ask again right away unless the server is busy.
+func (p *pollHints) hint(now time.Time, nextWindowStart time.Time, longPoll bool) time.Duration {
+	load := 1.0
+	if p.targetRate > 0 {
+		if rate := p.requests.rate(now); rate > p.targetRate {
+			load = rate / p.targetRate
+		}
+	}
+
+	hint := time.Duration(0)
+	if p.interval > 0 && (!longPoll || load > 1) {
+		hint = time.Duration(float64(p.interval) * load)
+		if p.maxInterval > 0 && hint > p.maxInterval {
+			hint = p.maxInterval
+		}
+	}
+	if !longPoll && hint > 0 && !nextWindowStart.IsZero() {
+		if untilWindow := nextWindowStart.Sub(now); untilWindow > 0 && untilWindow < hint {
+			hint = untilWindow
+		}
+	}
+	return hint
+}
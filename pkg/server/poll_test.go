@@ -0,0 +1,62 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateMeter(t *testing.T) {
+	start := time.Now()
+	m := &rateMeter{start: start}
+	for i := 0; i < 10; i++ {
+		m.mark(start.Add(time.Duration(i) * 50 * time.Millisecond))
+	}
+	require.Equal(t, 10.0, m.rate(start.Add(900*time.Millisecond)))
+	require.InDelta(t, 5.0, m.rate(start.Add(1500*time.Millisecond)), 0.001)
+	require.Equal(t, 0.0, m.rate(start.Add(3*time.Second)))
+}
+
+func TestPollHints(t *testing.T) {
+	now := time.Now()
+
+	t.Run("leaves it to the node without an interval", func(t *testing.T) {
+		p := &pollHints{}
+		require.Equal(t, time.Duration(0), p.hint(now, time.Time{}, false))
+		require.Equal(t, time.Duration(0), p.hint(now, now.Add(10*time.Second), false))
+		require.Equal(t, time.Duration(0), p.hint(now, now.Add(time.Hour), false))
+	})
+
+	t.Run("tells the node when its next task starts", func(t *testing.T) {
+		p := &pollHints{interval: time.Minute}
+		require.Equal(t, 10*time.Second, p.hint(now, now.Add(10*time.Second), false))
+		require.Equal(t, time.Minute, p.hint(now, now.Add(time.Hour), false))
+		require.Equal(t, time.Minute, p.hint(now, now.Add(-time.Second), false))
+	})
+
+	t.Run("stretches the interval when the server is busy", func(t *testing.T) {
+		p := &pollHints{interval: time.Minute, maxInterval: 5 * time.Minute, targetRate: 2}
+		p.requests.start = now
+		for i := 0; i < 6; i++ {
+			p.requests.mark(now)
+		}
+		require.Equal(t, 3*time.Minute, p.hint(now, time.Time{}, false))
+
+		for i := 0; i < 10; i++ {
+			p.requests.mark(now)
+		}
+		require.Equal(t, 5*time.Minute, p.hint(now, time.Time{}, false))
+	})
+
+	t.Run("lets long polling nodes ask again right away unless busy", func(t *testing.T) {
+		p := &pollHints{interval: time.Minute, targetRate: 2}
+		p.requests.start = now
+		require.Equal(t, time.Duration(0), p.hint(now, now.Add(10*time.Second), true))
+
+		for i := 0; i < 4; i++ {
+			p.requests.mark(now)
+		}
+		require.Equal(t, 2*time.Minute, p.hint(now, time.Time{}, true))
+	})
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/chef/foodtruck/pkg/secrets"
+	"github.com/labstack/echo/v4"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// SpecError describes a field in a spec that does not match the schema of
+// its provider
+type SpecError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type specValidationError struct {
+	Message string      `json:"message"`
+	Errors  []SpecError `json:"errors"`
+}
+
+func (h *AdminRoutesHandler) PutProvider(c echo.Context) error {
+	name := c.Param("name")
+	if !models.IsValidProviderName(name) {
+		return &echo.HTTPError{Code: http.StatusBadRequest, Message: "invalid provider name"}
+	}
+
+	provider := models.Provider{}
+	if err := c.Bind(&provider); err != nil {
+		return &echo.HTTPError{Code: http.StatusBadRequest, Message: "invalid request json"}
+	}
+	provider.Name = name
+
+	if len(provider.Schema) == 0 {
+		return &echo.HTTPError{Code: http.StatusBadRequest, Message: "schema must be provided"}
+	}
+	if _, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(provider.Schema)); err != nil {
+		return &echo.HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("invalid schema: %s", err)}
+	}
+
+	if err := h.db.PutProvider(c.Request().Context(), provider); err != nil {
+		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
+	}
+
+	return c.JSONBlob(http.StatusOK, []byte("{}"))
+}
+
+func (h *AdminRoutesHandler) GetProvider(c echo.Context) error {
+	provider, err := h.db.GetProvider(c.Request().Context(), c.Param("name"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return &echo.HTTPError{Code: http.StatusNotFound, Message: "provider not found"}
+		}
+		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
+	}
+	return c.JSON(http.StatusOK, provider)
+}
+
+func (h *AdminRoutesHandler) ListProviders(c echo.Context) error {
+	providers, err := h.db.ListProviders(c.Request().Context())
+	if err != nil {
+		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
+	}
+	return c.JSON(http.StatusOK, providers)
+}
+
+func (h *AdminRoutesHandler) DeleteProvider(c echo.Context) error {
+	err := h.db.DeleteProvider(c.Request().Context(), c.Param("name"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return &echo.HTTPError{Code: http.StatusNotFound, Message: "provider not found"}
+		}
+		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
+	}
+	return c.JSONBlob(http.StatusOK, []byte("{}"))
+}
+
+// validateTaskProvider checks the task against the registered provider. If
+// the provider is not registered, the task is rejected unless unregistered
+// providers are allowed.
+func (h *AdminRoutesHandler) validateTaskProvider(c echo.Context, task models.NodeTask) error {
+	provider, err := h.db.GetProvider(c.Request().Context(), task.Provider)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			if h.allowUnregisteredProviders {
+				return nil
+			}
+			return &echo.HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("unknown provider %q", task.Provider)}
+		}
+		return &echo.HTTPError{Code: http.StatusInternalServerError, Internal: err}
+	}
+
+	specErrors, err := validateSpec(provider.Schema, task.Spec)
+	if err != nil {
+		return &echo.HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("failed to validate spec: %s", err)}
+	}
+	if len(specErrors) > 0 {
+		return &echo.HTTPError{Code: http.StatusBadRequest, Message: specValidationError{
+			Message: fmt.Sprintf("spec does not match the schema for provider %q", task.Provider),
+			Errors:  specErrors,
+		}}
+	}
+	return nil
+}
+
+// validateSpec validates spec against a JSON Schema. Secrets in the spec are
+// validated as their value.
+func validateSpec(schema json.RawMessage, spec json.RawMessage) ([]SpecError, error) {
+	spec, err := secrets.Unwrap(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(spec) == 0 {
+		spec = json.RawMessage("null")
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schema), gojsonschema.NewBytesLoader(spec))
+	if err != nil {
+		return nil, err
+	}
+
+	specErrors := make([]SpecError, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		specErrors = append(specErrors, SpecError{
+			Field:   e.Field(),
+			Message: e.Description(),
+		})
+	}
+	return specErrors, nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateSpec(t *testing.T) {
+	schema := json.RawMessage(`{
+		"type": "object",
+		"required": ["url"],
+		"properties": {
+			"url": {"type": "string", "format": "uri"},
+			"json_params": {"type": "object"}
+		},
+		"additionalProperties": false
+	}`)
+
+	t.Run("accepts a valid spec", func(t *testing.T) {
+		specErrors, err := validateSpec(schema, json.RawMessage(`{"url": "https://example.com/policy.tar.gz"}`))
+		require.NoError(t, err)
+		require.Empty(t, specErrors)
+	})
+
+	t.Run("validates secrets as their value", func(t *testing.T) {
+		specErrors, err := validateSpec(schema, json.RawMessage(`{"url": {"$secret": "https://example.com/policy.tar.gz"}}`))
+		require.NoError(t, err)
+		require.Empty(t, specErrors)
+	})
+
+	t.Run("reports each invalid field", func(t *testing.T) {
+		specErrors, err := validateSpec(schema, json.RawMessage(`{"json_params": [], "urll": "typo"}`))
+		require.NoError(t, err)
+
+		fields := map[string]bool{}
+		for _, e := range specErrors {
+			fields[e.Field] = true
+			require.NotEmpty(t, e.Message)
+		}
+		require.Equal(t, map[string]bool{"(root)": true, "json_params": true}, fields)
+	})
+
+	t.Run("rejects a missing spec", func(t *testing.T) {
+		specErrors, err := validateSpec(schema, nil)
+		require.NoError(t, err)
+		require.Len(t, specErrors, 1)
+	})
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// contextConcurrencySlot is the echo context key holding the request's slot
+// under the concurrency limit
+const contextConcurrencySlot = "foodtruck_concurrency_slot"
+
+// limiterSweepInterval is how often the token buckets that are full again are
+// forgotten, so that nodes that stopped making requests do not use memory
+const limiterSweepInterval = time.Minute
+
+var throttledRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "foodtruck",
+	Name:      "throttled_requests_total",
+	Help:      "Number of requests rejected by a rate or concurrency limit.",
+}, []string{"scope", "limit"})
+
+var concurrentRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "foodtruck",
+	Name:      "concurrent_requests",
+	Help:      "Number of requests counted against the concurrency limit.",
+}, []string{"scope"})
+
+func init() {
+	prometheus.MustRegister(throttledRequestsTotal, concurrentRequests)
+}
+
+// RateLimit limits the requests made to a group of routes. A limit of 0 is
+// not enforced. Requests over a limit are rejected with 429 Too Many Requests
+// and a Retry-After header.
+type RateLimit struct {
+	// PerNode is how many requests per second each node may make. It only
+	// applies to the nodes routes.
+	PerNode float64 `json:"per_node"`
+	// PerCredential is how many requests per second may be made with each
+	// api key, or each client certificate
+	PerCredential float64 `json:"per_credential"`
+	// Burst is how many requests may be made at once before the rates
+	// apply. Defaults to one second's worth of requests.
+	Burst int `json:"burst"`
+	// MaxConcurrent is how many requests are handled at the same time.
+	// Requests held waiting, such as long polls and events streams, stop
+	// counting once they wait, and long polls count again once woken up.
+	MaxConcurrent int `json:"max_concurrent"`
+}
+
+func (l RateLimit) enabled() bool {
+	return l.PerNode > 0 || l.PerCredential > 0 || l.MaxConcurrent > 0
+}
+
+func (l RateLimit) burst(rate float64) int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return int(math.Max(1, math.Ceil(rate)))
+}
+
+// rateLimit returns middleware enforcing limit on the routes of scope. It
+// must run after authentication, which tells the credential used. nodeKey
+// returns the node a request is made by, or is nil if the routes are not
+// made by nodes.
+func rateLimit(scope string, limit RateLimit, nodeKey func(c echo.Context) string) echo.MiddlewareFunc {
+	var perNode, perCredential *limiterSet
+	if limit.PerNode > 0 && nodeKey != nil {
+		perNode = newLimiterSet(limit.PerNode, limit.burst(limit.PerNode))
+	}
+	if limit.PerCredential > 0 {
+		perCredential = newLimiterSet(limit.PerCredential, limit.burst(limit.PerCredential))
+	}
+	var slots chan struct{}
+	if limit.MaxConcurrent > 0 {
+		slots = make(chan struct{}, limit.MaxConcurrent)
+	}
+	inFlight := concurrentRequests.WithLabelValues(scope)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			now := time.Now()
+			if perNode != nil {
+				if ok, wait := perNode.allow(nodeKey(c), now); !ok {
+					return throttled(c, scope, "node", wait)
+				}
+			}
+			if perCredential != nil {
+				if ok, wait := perCredential.allow(credential(c), now); !ok {
+					return throttled(c, scope, "credential", wait)
+				}
+			}
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+				default:
+					return throttled(c, scope, "concurrency", time.Second)
+				}
+				slot := &concurrencySlot{slots: slots, inFlight: inFlight, held: true}
+				inFlight.Inc()
+				c.Set(contextConcurrencySlot, slot)
+				defer slot.release()
+			}
+			return next(c)
+		}
+	}
+}
+
+func throttled(c echo.Context, scope string, limit string, retryAfter time.Duration) error {
+	throttledRequestsTotal.WithLabelValues(scope, limit).Inc()
+	setRetryAfter(c, retryAfter)
+	return &echo.HTTPError{Code: http.StatusTooManyRequests, Message: "too many requests"}
+}
+
+// releaseConcurrency gives up the request's slot under the concurrency limit,
+// once the request waits without doing any work
+func releaseConcurrency(c echo.Context) {
+	if slot, ok := c.Get(contextConcurrencySlot).(*concurrencySlot); ok {
+		slot.release()
+	}
+}
+
+// acquireConcurrency takes a slot under the concurrency limit again for a
+// request that gave it up with releaseConcurrency, once it has work to do. It
+// waits for a slot to free up, until ctx is done.
+func acquireConcurrency(ctx context.Context, c echo.Context) error {
+	if slot, ok := c.Get(contextConcurrencySlot).(*concurrencySlot); ok {
+		return slot.acquire(ctx)
+	}
+	return nil
+}
+
+// concurrencySlot is a request's slot under the concurrency limit
+type concurrencySlot struct {
+	slots    chan struct{}
+	inFlight prometheus.Gauge
+
+	mu   sync.Mutex
+	held bool
+}
+
+func (s *concurrencySlot) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held {
+		s.held = false
+		s.inFlight.Dec()
+		<-s.slots
+	}
+}
+
+func (s *concurrencySlot) acquire(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.held = true
+	s.inFlight.Inc()
+	return nil
+}
+
+// credential returns what the request was authenticated with: a client
+// certificate or the id of an api key
+func credential(c echo.Context) string {
+	if node, ok := c.Get(ContextCertNode).(models.Node); ok {
+		return "cert:" + node.String()
+	}
+	if id, ok := c.Get(ContextKeyID).(string); ok {
+		return "key:" + id
+	}
+	return ""
+}
+
+// limiterSet is a token bucket for each key, such as each node
+type limiterSet struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiterSet(rate float64, burst int) *limiterSet {
+	return &limiterSet{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// allow takes a token from key's bucket at now. If there is none, it returns
+// false and how long until there is one.
+func (s *limiterSet) allow(key string, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= limiterSweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: s.burst, last: now}
+		s.buckets[key] = b
+	}
+	s.refill(b, now)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / s.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (s *limiterSet) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(s.burst, b.tokens+elapsed*s.rate)
+		b.last = now
+	}
+}
+
+// sweep forgets the buckets that are full, which behave the same as new ones
+func (s *limiterSet) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		s.refill(b, now)
+		if b.tokens >= s.burst {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
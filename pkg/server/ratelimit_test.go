@@ -0,0 +1,155 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterSet(t *testing.T) {
+	now := time.Now()
+	s := newLimiterSet(2, 3)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := s.allow("node", now)
+		require.True(t, ok, "the burst is allowed")
+	}
+	ok, wait := s.allow("node", now)
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _ = s.allow("other", now)
+	require.True(t, ok, "each key has its own bucket")
+
+	ok, _ = s.allow("node", now.Add(500*time.Millisecond))
+	require.True(t, ok, "tokens are added at the rate")
+
+	s.allow("node", now.Add(2*limiterSweepInterval))
+	require.Len(t, s.buckets, 1, "full buckets are forgotten")
+}
+
+func TestRateLimit(t *testing.T) {
+	keys, err := NewStaticKeySet("nodes-key")
+	require.NoError(t, err)
+
+	setup := func(limit RateLimit, handler echo.HandlerFunc) *echo.Echo {
+		e := echo.New()
+		g := e.Group("/organizations/:org/foodtruck/nodes/:name")
+		g.Use(nodeAuth(keys, false))
+		g.Use(rateLimit("test", limit, func(c echo.Context) string {
+			return c.Param("org") + "/" + c.Param("name")
+		}))
+		g.POST("/tasks/next", handler)
+		return e
+	}
+	ok := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	do := func(e *echo.Echo, node string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/organizations/org/foodtruck/nodes/"+node+"/tasks/next", nil)
+		req.Header.Set("Authorization", "Bearer nodes-key")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("limits each node", func(t *testing.T) {
+		throttled := testutil.ToFloat64(throttledRequestsTotal.WithLabelValues("test", "node"))
+		e := setup(RateLimit{PerNode: 0.1}, ok)
+
+		require.Equal(t, http.StatusOK, do(e, "node1").Code)
+		rec := do(e, "node1")
+		require.Equal(t, http.StatusTooManyRequests, rec.Code)
+		require.Equal(t, "10", rec.Header().Get("Retry-After"))
+		require.Equal(t, http.StatusOK, do(e, "node2").Code)
+		require.Equal(t, throttled+1, testutil.ToFloat64(throttledRequestsTotal.WithLabelValues("test", "node")))
+	})
+
+	t.Run("limits each credential", func(t *testing.T) {
+		e := setup(RateLimit{PerCredential: 0.1, Burst: 2}, ok)
+
+		require.Equal(t, http.StatusOK, do(e, "node1").Code)
+		require.Equal(t, http.StatusOK, do(e, "node2").Code)
+		require.Equal(t, http.StatusTooManyRequests, do(e, "node3").Code)
+	})
+
+	t.Run("limits the requests handled at the same time", func(t *testing.T) {
+		started, finish := make(chan struct{}), make(chan struct{})
+		e := setup(RateLimit{MaxConcurrent: 1}, func(c echo.Context) error {
+			if c.Param("name") == "waiting" {
+				releaseConcurrency(c)
+			}
+			started <- struct{}{}
+			<-finish
+			return c.NoContent(http.StatusOK)
+		})
+
+		done := make(chan int)
+		go func() { done <- do(e, "waiting").Code }()
+		<-started
+		go func() { done <- do(e, "busy").Code }()
+		<-started
+		require.Equal(t, http.StatusTooManyRequests, do(e, "other").Code)
+
+		close(finish)
+		require.Equal(t, http.StatusOK, <-done)
+		require.Equal(t, http.StatusOK, <-done)
+		require.Equal(t, 0.0, testutil.ToFloat64(concurrentRequests.WithLabelValues("test")))
+	})
+
+	t.Run("takes the slot again before waiters do any work", func(t *testing.T) {
+		waiting, wake, finish := make(chan struct{}), make(chan struct{}), make(chan struct{})
+		var working, maxWorking int32
+		e := setup(RateLimit{MaxConcurrent: 1}, func(c echo.Context) error {
+			if c.Param("name") == "busy" {
+				<-finish
+				return c.NoContent(http.StatusOK)
+			}
+			releaseConcurrency(c)
+			waiting <- struct{}{}
+			<-wake
+			if err := acquireConcurrency(c.Request().Context(), c); err != nil {
+				return err
+			}
+			n := atomic.AddInt32(&working, 1)
+			for {
+				max := atomic.LoadInt32(&maxWorking)
+				if n <= max || atomic.CompareAndSwapInt32(&maxWorking, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&working, -1)
+			return c.NoContent(http.StatusOK)
+		})
+
+		done := make(chan int)
+		for _, node := range []string{"waiter1", "waiter2", "waiter3"} {
+			node := node
+			go func() { done <- do(e, node).Code }()
+			<-waiting
+		}
+		go func() { done <- do(e, "busy").Code }()
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(concurrentRequests.WithLabelValues("test")) == 1
+		}, time.Second, time.Millisecond)
+
+		close(wake)
+		time.Sleep(50 * time.Millisecond)
+		require.Equal(t, int32(0), atomic.LoadInt32(&maxWorking), "waiters wait for the busy request")
+		require.Equal(t, 1.0, testutil.ToFloat64(concurrentRequests.WithLabelValues("test")))
+
+		close(finish)
+		for i := 0; i < 4; i++ {
+			require.Equal(t, http.StatusOK, <-done)
+		}
+		require.Equal(t, int32(1), atomic.LoadInt32(&maxWorking), "waiters take turns")
+		require.Equal(t, 0.0, testutil.ToFloat64(concurrentRequests.WithLabelValues("test")))
+	})
+}
@@ -1,16 +1,150 @@
 package server
 
 import (
+	"context"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/secrets"
 	"github.com/chef/foodtruck/pkg/storage"
 	"github.com/labstack/echo/v4"
 )
 
+type SetupOpts struct {
+	// Context stops the work the server does in the background, such as
+	// watching storage for new tasks, when it is done
+	Context             context.Context
+	NodeCertificateAuth bool
+	SecretsKeyring      *secrets.Keyring
+	// AllowUnregisteredProviders accepts jobs for providers that have not
+	// been registered
+	AllowUnregisteredProviders bool
+	// LongPollMaxWait is the longest a request for a node's next task is
+	// held waiting for a task. 0 disables long polling.
+	LongPollMaxWait time.Duration
+	// EventsHeartbeat is how often a heartbeat is sent on the nodes' events
+	// streams
+	EventsHeartbeat time.Duration
+	// PollInterval, PollMaxInterval and PollTargetRate decide how long nodes
+	// are told to wait before asking for tasks again, see WithPollHints
+	PollInterval    time.Duration
+	PollMaxInterval time.Duration
+	PollTargetRate  float64
+	// AdminRateLimit and NodesRateLimit limit the requests to the admin and
+	// nodes routes
+	AdminRateLimit RateLimit
+	NodesRateLimit RateLimit
+}
+
+type SetupOpt func(*SetupOpts)
+
+// WithContext stops the work the server does in the background, such as
+// watching storage for new tasks, when ctx is done. The work also stops when
+// the echo server is shut down.
+func WithContext(ctx context.Context) SetupOpt {
+	return func(opts *SetupOpts) {
+		opts.Context = ctx
+	}
+}
+
+// WithNodeCertificateAuth allows nodes to authenticate with a verified TLS
+// client certificate instead of an api key. The server must be configured to
+// request and verify client certificates for this to have any effect.
+func WithNodeCertificateAuth(enabled bool) SetupOpt {
+	return func(opts *SetupOpts) {
+		opts.NodeCertificateAuth = enabled
+	}
+}
+
+// WithSecretsKeyring sets the keyring used to encrypt secrets in task specs.
+// Without it, jobs containing secrets are rejected.
+func WithSecretsKeyring(keyring *secrets.Keyring) SetupOpt {
+	return func(opts *SetupOpts) {
+		opts.SecretsKeyring = keyring
+	}
+}
+
+// WithAllowUnregisteredProviders accepts jobs whose provider has not been
+// registered through the admin api, without validating their spec. By
+// default they are rejected. Jobs for registered providers always have their
+// spec validated.
+func WithAllowUnregisteredProviders(allowed bool) SetupOpt {
+	return func(opts *SetupOpts) {
+		opts.AllowUnregisteredProviders = allowed
+	}
+}
+
+// WithLongPoll lets nodes ask the server to hold their request for the next
+// task for up to maxWait, until a task is available
+func WithLongPoll(maxWait time.Duration) SetupOpt {
+	return func(opts *SetupOpts) {
+		opts.LongPollMaxWait = maxWait
+	}
+}
+
+// WithEventsHeartbeat sets how often a heartbeat is sent on the nodes'
+// events streams. It defaults to 15 seconds. An interval of 0 or less is
+// ignored, since the streams always need a heartbeat.
+func WithEventsHeartbeat(interval time.Duration) SetupOpt {
+	return func(opts *SetupOpts) {
+		if interval > 0 {
+			opts.EventsHeartbeat = interval
+		}
+	}
+}
+
+// WithPollHints tells nodes that have no task to wait interval before asking
+// again. Once nodes ask for tasks more than targetRate times per second, the
+// interval is stretched in proportion, up to maxInterval, so the server is
+// not overwhelmed, for example when the whole fleet comes back after an
+// outage. A targetRate of 0 never stretches the interval. Nodes whose next
+// task starts sooner than interval are told to come back when it starts.
+func WithPollHints(interval time.Duration, maxInterval time.Duration, targetRate float64) SetupOpt {
+	return func(opts *SetupOpts) {
+		opts.PollInterval = interval
+		opts.PollMaxInterval = maxInterval
+		opts.PollTargetRate = targetRate
+	}
+}
+
+// WithAdminRateLimit limits the requests to the admin routes, for example so
+// a script adding jobs in a loop cannot overwhelm the server
+func WithAdminRateLimit(limit RateLimit) SetupOpt {
+	return func(opts *SetupOpts) {
+		opts.AdminRateLimit = limit
+	}
+}
+
+// WithNodesRateLimit limits the requests to the nodes routes, for example so
+// a misbehaving fleet cannot overwhelm the server
+func WithNodesRateLimit(limit RateLimit) SetupOpt {
+	return func(opts *SetupOpts) {
+		opts.NodesRateLimit = limit
+	}
+}
+
+const defaultEventsHeartbeat = 15 * time.Second
+
 // Setup initializes an Echo server
-func Setup(db storage.Driver, adminAPIKey string, nodesAPIKey string) *echo.Echo {
+func Setup(db storage.Driver, adminKeys *KeySet, nodesKeys *KeySet, opts ...SetupOpt) *echo.Echo {
+	sopts := SetupOpts{
+		Context:         context.Background(),
+		EventsHeartbeat: defaultEventsHeartbeat,
+	}
+	for _, o := range opts {
+		o(&sopts)
+	}
+
 	e := echo.New()
 
-	initAdminRouter(e, db, adminAPIKey)
-	initNodesRouter(e, db, nodesAPIKey)
+	ctx, cancel := context.WithCancel(sopts.Context)
+	e.Server.RegisterOnShutdown(cancel)
+	e.TLSServer.RegisterOnShutdown(cancel)
+
+	notifier := newTaskNotifier()
+	go notifier.watch(ctx, db.NodeTasksUpdatedSince, notifierPollInterval)
+
+	initAdminRouter(e, db, adminKeys, notifier, sopts)
+	initNodesRouter(e, db, nodesKeys, notifier, sopts)
 
 	return e
 }
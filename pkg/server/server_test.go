@@ -0,0 +1,19 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithEventsHeartbeat(t *testing.T) {
+	opts := SetupOpts{EventsHeartbeat: defaultEventsHeartbeat}
+
+	WithEventsHeartbeat(0)(&opts)
+	WithEventsHeartbeat(-time.Second)(&opts)
+	require.Equal(t, defaultEventsHeartbeat, opts.EventsHeartbeat, "intervals of 0 or less are ignored")
+
+	WithEventsHeartbeat(time.Second)(&opts)
+	require.Equal(t, time.Second, opts.EventsHeartbeat)
+}
@@ -0,0 +1,177 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+)
+
+var ErrUnsigned = errors.New("task is not signed")
+var ErrUnknownKey = errors.New("task signed with an untrusted key")
+var ErrInvalidSignature = errors.New("task signature is invalid")
+
+// signedPayload is the part of a task covered by its signature. The field
+// order is fixed so the payload is the same wherever it is computed.
+type signedPayload struct {
+	JobID       models.JobID    `json:"job_id"`
+	Provider    string          `json:"provider"`
+	Spec        json.RawMessage `json:"spec"`
+	WindowStart string          `json:"window_start"`
+	WindowEnd   string          `json:"window_end"`
+	// Env, RunAs, Limits and Exclusive were added after the other fields.
+	// They are left out when empty so older signatures still verify.
+	Env       map[string]string      `json:"env,omitempty"`
+	RunAs     *models.RunAs          `json:"run_as,omitempty"`
+	Limits    *models.ResourceLimits `json:"limits,omitempty"`
+	Exclusive bool                   `json:"exclusive,omitempty"`
+}
+
+// Payload returns the bytes that are signed for a task, which include how the
+// task is run as well as what it runs. Window times are
+// truncated to the second in UTC and the spec is encoded with sorted keys so
+// the payload survives storage round trips and the server rewriting specs
+// that contain secrets.
+func Payload(task models.NodeTask) ([]byte, error) {
+	if task.JobID == "" {
+		return nil, errors.New("task must have a job id to be signed")
+	}
+	spec, err := canonicalJSON(task.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode spec: %w", err)
+	}
+	return json.Marshal(signedPayload{
+		JobID:       task.JobID,
+		Provider:    task.Provider,
+		Spec:        spec,
+		WindowStart: task.WindowStart.UTC().Format(time.RFC3339),
+		WindowEnd:   task.WindowEnd.UTC().Format(time.RFC3339),
+		Env:         task.Env,
+		RunAs:       task.RunAs,
+		Limits:      task.Limits,
+		Exclusive:   task.Exclusive,
+	})
+}
+
+func canonicalJSON(data json.RawMessage) (json.RawMessage, error) {
+	if len(data) == 0 {
+		return json.RawMessage("null"), nil
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// Sign signs the task with key and stores the signature on the task
+func Sign(task *models.NodeTask, keyID string, key ed25519.PrivateKey) error {
+	payload, err := Payload(*task)
+	if err != nil {
+		return err
+	}
+	task.Signature = &models.TaskSignature{
+		KeyID:     keyID,
+		Signature: ed25519.Sign(key, payload),
+	}
+	return nil
+}
+
+// TrustStore holds the public keys a node accepts task signatures from
+type TrustStore struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// LoadTrustStore reads every .pem file in dir as a PKIX encoded ed25519 public
+// key. The file name without the extension is the key id. A key pair can be
+// created with:
+//
+//	openssl genpkey -algorithm ed25519 -out signer.key
+//	openssl pkey -in signer.key -pubout -out signer.pem
+func LoadTrustStore(dir string) (*TrustStore, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &TrustStore{keys: make(map[string]ed25519.PublicKey, len(paths))}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trusted key: %w", err)
+		}
+		key, err := ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trusted key %s: %w", path, err)
+		}
+		keyID := strings.TrimSuffix(filepath.Base(path), ".pem")
+		ts.keys[keyID] = key
+	}
+
+	if len(ts.keys) == 0 {
+		return nil, fmt.Errorf("no trusted keys found in %s", dir)
+	}
+	return ts, nil
+}
+
+// Verify checks that the task carries a valid signature from a trusted key
+func (ts *TrustStore) Verify(task models.NodeTask) error {
+	if task.Signature == nil || len(task.Signature.Signature) == 0 {
+		return ErrUnsigned
+	}
+	key, ok := ts.keys[task.Signature.KeyID]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownKey, task.Signature.KeyID)
+	}
+	payload, err := Payload(task)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, payload, task.Signature.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("key is not an ed25519 public key")
+	}
+	return edKey, nil
+}
+
+func ParsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an ed25519 private key")
+	}
+	return edKey, nil
+}
@@ -0,0 +1,105 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "foodtruck-trust")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writePublicKey(t, filepath.Join(dir, "signer.pem"), pub)
+
+	ts, err := LoadTrustStore(dir)
+	require.NoError(t, err)
+
+	newTask := func() models.NodeTask {
+		return models.NodeTask{
+			JobID:       "5ff7686a91072739255a4a35",
+			WindowStart: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			WindowEnd:   time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+			Provider:    "infra",
+			Spec:        json.RawMessage(`{"url": "https://example.com/policy.tar.gz"}`),
+		}
+	}
+
+	t.Run("accepts a signed task", func(t *testing.T) {
+		task := newTask()
+		require.NoError(t, Sign(&task, "signer", priv))
+
+		// The server stores times with less precision and a different zone
+		task.WindowStart = task.WindowStart.In(time.FixedZone("x", 3600)).Add(123 * time.Microsecond)
+		require.NoError(t, ts.Verify(task))
+	})
+
+	t.Run("accepts a signed task with a reencoded spec", func(t *testing.T) {
+		task := newTask()
+		task.Spec = json.RawMessage(`{"url": "https://example.com/policy.tar.gz", "count": 1.50, "json_params": {"b": 1, "a": 2}}`)
+		require.NoError(t, Sign(&task, "signer", priv))
+
+		task.Spec = json.RawMessage(`{"count":1.50,"json_params":{"a":2,"b":1},"url":"https://example.com/policy.tar.gz"}`)
+		require.NoError(t, ts.Verify(task))
+	})
+
+	t.Run("refuses an unsigned task", func(t *testing.T) {
+		require.True(t, errors.Is(ts.Verify(newTask()), ErrUnsigned))
+	})
+
+	t.Run("refuses an unknown key", func(t *testing.T) {
+		task := newTask()
+		require.NoError(t, Sign(&task, "other", otherPriv))
+		require.True(t, errors.Is(ts.Verify(task), ErrUnknownKey))
+	})
+
+	t.Run("refuses a signature from the wrong key", func(t *testing.T) {
+		task := newTask()
+		require.NoError(t, Sign(&task, "signer", otherPriv))
+		require.True(t, errors.Is(ts.Verify(task), ErrInvalidSignature))
+	})
+
+	tamper := map[string]func(*models.NodeTask){
+		"job id":    func(task *models.NodeTask) { task.JobID = "5ff7686a91072739255a4a36" },
+		"provider":  func(task *models.NodeTask) { task.Provider = "shell" },
+		"spec":      func(task *models.NodeTask) { task.Spec = json.RawMessage(`{"url": "https://evil.example.com"}`) },
+		"window":    func(task *models.NodeTask) { task.WindowEnd = task.WindowEnd.Add(time.Hour) },
+		"env":       func(task *models.NodeTask) { task.Env = map[string]string{"LD_PRELOAD": "/tmp/evil.so"} },
+		"run as":    func(task *models.NodeTask) { task.RunAs = &models.RunAs{User: "root"} },
+		"limits":    func(task *models.NodeTask) { task.Limits = &models.ResourceLimits{MemoryBytes: 1 << 40} },
+		"exclusive": func(task *models.NodeTask) { task.Exclusive = true },
+	}
+	for name, f := range tamper {
+		f := f
+		t.Run("refuses a modified "+name, func(t *testing.T) {
+			task := newTask()
+			require.NoError(t, Sign(&task, "signer", priv))
+			f(&task)
+			require.True(t, errors.Is(ts.Verify(task), ErrInvalidSignature))
+		})
+	}
+}
+
+func writePublicKey(t *testing.T, path string, key ed25519.PublicKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+}
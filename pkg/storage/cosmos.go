@@ -18,11 +18,15 @@ type CosmosDB struct {
 	jobsCollection           *mongo.Collection
 	nodeTasksCollection      *mongo.Collection
 	nodeTaskStatusCollection *mongo.Collection
+	providersCollection      *mongo.Collection
 }
 
 type CosmosNodeTask struct {
 	NodeName string            `bson:"node_name"`
 	Tasks    []models.NodeTask `bson:"tasks"`
+	// Cancelled are the cancelled tasks the node received and has not
+	// finished yet
+	Cancelled []models.JobID `bson:"cancelled,omitempty"`
 }
 
 type createCollectionCommand struct {
@@ -41,7 +45,7 @@ func initialzeCollections(ctx context.Context, db *mongo.Database) error {
 		return fmt.Errorf("failed creating collection(jobs): %w", err)
 	}
 
-	err = createCollection(ctx, db, "node_tasks", "node_name", true)
+	err = createCollection(ctx, db, "node_tasks", "node_name", true, "updated")
 	if err != nil {
 		return fmt.Errorf("failed creating collection(node_tasks): %w", err)
 	}
@@ -50,6 +54,11 @@ func initialzeCollections(ctx context.Context, db *mongo.Database) error {
 	if err != nil {
 		return fmt.Errorf("failed creating collection(node_name): %w", err)
 	}
+
+	err = createCollection(ctx, db, "providers", "name", true)
+	if err != nil {
+		return fmt.Errorf("failed creating collection(providers): %w", err)
+	}
 	return nil
 }
 
@@ -76,7 +85,7 @@ func createCollection(ctx context.Context, db *mongo.Database, collectionName st
 	}
 
 	_, err := indexView.CreateOne(ctx, mongo.IndexModel{
-		Keys:    bson.D{{shardKey, 1}},
+		Keys:    bson.D{{Key: shardKey, Value: 1}},
 		Options: indexOpts,
 	})
 
@@ -89,7 +98,7 @@ func createCollection(ctx context.Context, db *mongo.Database, collectionName st
 
 	for i := range indexes {
 		_, err := indexView.CreateOne(ctx, mongo.IndexModel{
-			Keys: bson.D{{indexes[i], 1}},
+			Keys: bson.D{{Key: indexes[i], Value: 1}},
 		})
 
 		if err != nil {
@@ -114,8 +123,9 @@ func InitCosmosDB(ctx context.Context, c *mongo.Client, databaseName string) (*C
 	jobsCollection := db.Collection("jobs")
 	nodeTasksCollection := db.Collection("node_tasks")
 	nodeTaskStatusCollection := db.Collection("node_task_status")
+	providersCollection := db.Collection("providers")
 
-	return CosmosDBImpl(jobsCollection, nodeTasksCollection, nodeTaskStatusCollection), nil
+	return CosmosDBImpl(jobsCollection, nodeTasksCollection, nodeTaskStatusCollection, providersCollection), nil
 }
 
 func InitMongoDB(ctx context.Context, c *mongo.Client, databaseName string) (*CosmosDB, error) {
@@ -124,37 +134,67 @@ func InitMongoDB(ctx context.Context, c *mongo.Client, databaseName string) (*Co
 	jobsCollection := db.Collection("jobs")
 	nodeTasksCollection := db.Collection("node_tasks")
 	nodeTaskStatusCollection := db.Collection("node_task_status")
+	providersCollection := db.Collection("providers")
 
-	return CosmosDBImpl(jobsCollection, nodeTasksCollection, nodeTaskStatusCollection), nil
+	return CosmosDBImpl(jobsCollection, nodeTasksCollection, nodeTaskStatusCollection, providersCollection), nil
 }
 
-func CosmosDBImpl(jobsCollection *mongo.Collection, nodeTasksCollection *mongo.Collection, nodeTaskStatusCollection *mongo.Collection) *CosmosDB {
+func CosmosDBImpl(jobsCollection *mongo.Collection, nodeTasksCollection *mongo.Collection, nodeTaskStatusCollection *mongo.Collection,
+	providersCollection *mongo.Collection) *CosmosDB {
 	return &CosmosDB{
 		jobsCollection:           jobsCollection,
 		nodeTasksCollection:      nodeTasksCollection,
 		nodeTaskStatusCollection: nodeTaskStatusCollection,
+		providersCollection:      providersCollection,
 	}
 }
 
+const duplicateKeyErrCode = 11000
+
+// cosmosJob is a job with an id chosen by the submitter
+type cosmosJob struct {
+	ID    primitive.ObjectID `bson:"_id"`
+	Task  models.NodeTask    `bson:"task"`
+	Nodes []models.Node      `bson:"nodes,omitempty"`
+}
+
 func (c *CosmosDB) AddJob(ctx context.Context, job models.Job) (models.JobID, error) {
-	res, err := c.jobsCollection.InsertOne(ctx, job)
+	var doc interface{} = job
+	if job.ID != "" {
+		objID, err := primitive.ObjectIDFromHex(job.ID)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q", models.ErrInvalidJobID, job.ID)
+		}
+		doc = cosmosJob{ID: objID, Task: job.Task, Nodes: job.Nodes}
+	}
+
+	res, err := c.jobsCollection.InsertOne(ctx, doc)
 	if err != nil {
+		if isDuplicateKeyError(err) {
+			return "", fmt.Errorf("%w: %q", models.ErrJobExists, job.ID)
+		}
 		return "", fmt.Errorf("failed to insert job: %w", err)
 	}
 
 	job.Task.JobID = res.InsertedID.(primitive.ObjectID).Hex()
 
+	// updated lets the other replicas know about the new tasks, see
+	// NodeTasksUpdatedSince
+	updated := time.Now()
 	updates := make([]mongo.WriteModel, len(job.Nodes))
 	for i := range updates {
 		nodeName := fmt.Sprintf("%s/%s", job.Nodes[i].Organization, job.Nodes[i].Name)
 		updateModel := mongo.NewUpdateOneModel().SetFilter(
 			bson.D{
-				{"node_name", nodeName},
+				{Key: "node_name", Value: nodeName},
 			},
 		).SetUpdate(
 			bson.D{
-				{"$set", bson.D{{"node_name", nodeName}}},
-				{"$push", bson.D{{"tasks", job.Task}}},
+				{Key: "$set", Value: bson.D{
+					{Key: "node_name", Value: nodeName},
+					{Key: "updated", Value: updated},
+				}},
+				{Key: "$push", Value: bson.D{{Key: "tasks", Value: job.Task}}},
 			},
 		).SetUpsert(true)
 
@@ -170,6 +210,19 @@ func (c *CosmosDB) AddJob(ctx context.Context, job models.Job) (models.JobID, er
 	return job.Task.JobID, nil
 }
 
+func isDuplicateKeyError(err error) bool {
+	writeErr := mongo.WriteException{}
+	if !errors.As(err, &writeErr) {
+		return false
+	}
+	for _, e := range writeErr.WriteErrors {
+		if e.Code == duplicateKeyErrCode {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *CosmosDB) ListJobs(ctx context.Context) error {
 	return nil
 }
@@ -185,7 +238,7 @@ func (c *CosmosDB) GetJob(ctx context.Context, jobID models.JobID, opts ...GetJo
 		return JobWithStatus{}, models.ErrNotFound
 	}
 
-	cursor := c.jobsCollection.FindOne(ctx, bson.D{{"_id", objID}})
+	cursor := c.jobsCollection.FindOne(ctx, bson.D{{Key: "_id", Value: objID}})
 	if err := cursor.Err(); err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return JobWithStatus{}, models.ErrNotFound
@@ -200,7 +253,8 @@ func (c *CosmosDB) GetJob(ctx context.Context, jobID models.JobID, opts ...GetJo
 
 	var nodeStatuses []models.NodeTaskStatus
 	if gopts.FetchStatuses {
-		cursor, err := c.nodeTaskStatusCollection.Find(ctx, bson.D{{"job_id", jobID}})
+		cursor, err := c.nodeTaskStatusCollection.Find(ctx, bson.D{{Key: "job_id", Value: jobID}},
+			options.Find().SetProjection(bson.D{{Key: "history", Value: 0}}))
 		if err != nil {
 			if errors.Is(err, mongo.ErrNoDocuments) {
 				return JobWithStatus{}, models.ErrNotFound
@@ -219,7 +273,7 @@ func (c *CosmosDB) GetJob(ctx context.Context, jobID models.JobID, opts ...GetJo
 }
 
 func (c *CosmosDB) GetNodeTasks(ctx context.Context, node models.Node) ([]models.NodeTask, error) {
-	cursor := c.nodeTasksCollection.FindOne(ctx, bson.D{{"node_name", node.String()}})
+	cursor := c.nodeTasksCollection.FindOne(ctx, bson.D{{Key: "node_name", Value: node.String()}})
 	if err := cursor.Err(); err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return nil, models.ErrNoTasks
@@ -233,8 +287,13 @@ func (c *CosmosDB) GetNodeTasks(ctx context.Context, node models.Node) ([]models
 	return result.Tasks, nil
 }
 
-func (c *CosmosDB) NextNodeTask(ctx context.Context, node models.Node) (models.NodeTask, error) {
-	cursor := c.nodeTasksCollection.FindOne(ctx, bson.D{{"node_name", node.String()}})
+func (c *CosmosDB) NextNodeTask(ctx context.Context, node models.Node, opts ...NextNodeTaskOpt) (models.NodeTask, error) {
+	nopts := NextNodeTaskOpts{}
+	for _, o := range opts {
+		o(&nopts)
+	}
+
+	cursor := c.nodeTasksCollection.FindOne(ctx, bson.D{{Key: "node_name", Value: node.String()}})
 	if err := cursor.Err(); err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return models.NodeTask{}, models.ErrNoTasks
@@ -247,92 +306,408 @@ func (c *CosmosDB) NextNodeTask(ctx context.Context, node models.Node) (models.N
 	}
 
 	tasks := result.Tasks
+	// nextWindowStart is when the first task whose window has not started
+	// yet starts, if there is one
+	var nextWindowStart time.Time
 
 	for {
 		if len(tasks) == 0 {
+			if !nextWindowStart.IsZero() {
+				return models.NodeTask{}, &models.NoTasksError{NextWindowStart: nextWindowStart}
+			}
 			return models.NodeTask{}, models.ErrNoTasks
 		}
 
-		nextTask := tasks[0]
+		next := 0
 		for i := 1; i < len(tasks); i++ {
-			if tasks[i].WindowStart.Before(nextTask.WindowStart) {
-				nextTask = tasks[i]
+			if tasks[i].WindowStart.Before(tasks[next].WindowStart) {
+				next = i
 			}
 		}
+		nextTask := tasks[next]
 
-		if time.Now().After(nextTask.WindowStart) && time.Now().Before(nextTask.WindowEnd) {
-			if err := c.dequeueTask(ctx, node, nextTask.JobID, models.TaskStatusPending); err != nil {
-				return models.NodeTask{}, fmt.Errorf("failed to remove task: %w", err)
+		if nopts.isBusy(nextTask.Provider) && time.Now().Before(nextTask.WindowEnd) {
+			// Left in the queue until the node can run it
+		} else if nopts.Peek {
+			if time.Now().After(nextTask.WindowStart) && time.Now().Before(nextTask.WindowEnd) && nopts.hasProvider(nextTask.Provider) {
+				return nextTask, nil
+			}
+		} else if time.Now().After(nextTask.WindowStart) && time.Now().Before(nextTask.WindowEnd) {
+			if nopts.hasProvider(nextTask.Provider) {
+				err := c.dequeueTask(ctx, node, models.NodeTaskStatus{JobID: nextTask.JobID, Status: models.TaskStatusPending})
+				if err == nil {
+					return nextTask, nil
+				}
+				if !errors.Is(err, models.ErrInvalidStatusTransition) {
+					return models.NodeTask{}, fmt.Errorf("failed to remove task: %w", err)
+				}
+				// The task already has a status, so it is not sent and the
+				// next one is looked at instead
+				log.Printf("skipping task: %s", err)
+			} else {
+				err := c.dequeueTask(ctx, node, models.NodeTaskStatus{
+					JobID:  nextTask.JobID,
+					Status: models.TaskStatusFailed,
+					Result: &models.NodeTaskStatusResult{
+						ExitCode: -1,
+						Reason:   models.ReasonProviderMissing,
+					},
+				})
+				if err != nil && !errors.Is(err, models.ErrInvalidStatusTransition) {
+					return models.NodeTask{}, fmt.Errorf("failed to remove task: %w", err)
+				}
 			}
-			return nextTask, nil
 		} else if time.Now().After(nextTask.WindowEnd) {
 			log.Printf("EXPIRING THING")
-			if err := c.dequeueTask(ctx, node, nextTask.JobID, "expired"); err != nil {
+			err := c.dequeueTask(ctx, node, models.NodeTaskStatus{JobID: nextTask.JobID, Status: models.TaskStatusExpired})
+			if err != nil && !errors.Is(err, models.ErrInvalidStatusTransition) {
 				return models.NodeTask{}, fmt.Errorf("failed to remove task: %w", err)
 			}
+		} else if time.Now().Before(nextTask.WindowStart) && nextWindowStart.IsZero() {
+			// Tasks are looked at by window start, so this is the first
+			// one to start
+			nextWindowStart = nextTask.WindowStart
 		}
-		tasks = tasks[1:]
+		tasks = append(tasks[:next], tasks[next+1:]...)
 	}
 }
 
-func (c *CosmosDB) dequeueTask(ctx context.Context, node models.Node, jobID string, status models.TaskStatus) error {
+func (c *CosmosDB) dequeueTask(ctx context.Context, node models.Node, status models.NodeTaskStatus) error {
 	updates := make([]mongo.WriteModel, 1)
 	nodeName := fmt.Sprintf("%s/%s", node.Organization, node.Name)
 	updateNodeTasksModel := mongo.NewUpdateOneModel().SetFilter(
 		bson.D{
-			{"node_name", nodeName},
+			{Key: "node_name", Value: nodeName},
 		},
 	).SetUpdate(
 		bson.D{
-			{"$set", bson.D{{"node_name", nodeName}}},
-			{"$pull", bson.D{{"tasks", bson.D{{"job_id", jobID}}}}},
+			{Key: "$set", Value: bson.D{{Key: "node_name", Value: nodeName}}},
+			{Key: "$pull", Value: bson.D{{Key: "tasks", Value: bson.D{{Key: "job_id", Value: status.JobID}}}}},
 		},
 	).SetUpsert(true)
 
 	updates[0] = updateNodeTasksModel
 
+	// The status is set first so that a task is never removed from the
+	// queue without one. A task whose status cannot change, for example
+	// because it was cancelled in the meantime, is still removed, and the
+	// transition error returned so that it is not handed out.
+	statusErr := c.setNodeTaskStatus(ctx, node, status, false)
+	if statusErr != nil && !errors.Is(statusErr, models.ErrInvalidStatusTransition) {
+		return statusErr
+	}
+
 	opts := options.BulkWrite().SetOrdered(false)
-	_, err := c.nodeTasksCollection.BulkWrite(ctx, updates, opts)
+	if _, err := c.nodeTasksCollection.BulkWrite(ctx, updates, opts); err != nil {
+		return err
+	}
+	return statusErr
+}
+
+// UpdateNodeTaskStatus sets the status of a node's task as reported by the
+// node. The task must have been sent to the node, otherwise
+// models.ErrTaskNotSent is returned. See setNodeTaskStatus for the rest.
+func (c *CosmosDB) UpdateNodeTaskStatus(ctx context.Context, node models.Node, nodeTaskStatus models.NodeTaskStatus) error {
+	return c.setNodeTaskStatus(ctx, node, nodeTaskStatus, true)
+}
 
+// setNodeTaskStatus sets the status of a node's task, following the
+// transitions allowed by models.TaskStatus.CanTransitionTo. A
+// *models.StatusTransitionError with the current status is returned if the
+// status cannot change, and models.ErrJobNotForNode if the job does not
+// target the node. Setting a final status again changes nothing, so that a
+// node sending an update twice cannot undo the task's result. Each change of
+// status is added to the status history. fromNode is set for updates sent by
+// the node, which may only update tasks the node was sent.
+func (c *CosmosDB) setNodeTaskStatus(ctx context.Context, node models.Node, nodeTaskStatus models.NodeTaskStatus,
+	fromNode bool) error {
+	nodeName := node.String()
+	now := time.Now()
+	fields := bson.D{
+		{Key: "status", Value: nodeTaskStatus.Status},
+		{Key: "last_updated", Value: now},
+		{Key: "node_name", Value: nodeName},
+		{Key: "job_id", Value: nodeTaskStatus.JobID},
+		{Key: "result", Value: nodeTaskStatus.Result},
+	}
+	transition := models.StatusTransition{
+		Status: nodeTaskStatus.Status,
+		Time:   now,
+		Result: nodeTaskStatus.Result,
+	}
+	filter := bson.D{
+		{Key: "node_name", Value: nodeName},
+		{Key: "job_id", Value: nodeTaskStatus.JobID},
+	}
+
+	// The current status is checked and replaced only if it has not changed
+	// in between. There is no unique index on the node and job, so a status
+	// is only created with an upsert that changes nothing if one exists. If
+	// another update gets in first, try again.
+	for attempt := 0; attempt < 3; attempt++ {
+		current := models.NodeTaskStatus{}
+		err := c.nodeTaskStatusCollection.FindOne(ctx, filter).Decode(&current)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("failed to query node task status: %w", err)
+		}
+		exists := err == nil
+
+		if !exists {
+			if err := c.checkJobTargetsNode(ctx, nodeTaskStatus.JobID, node); err != nil {
+				return err
+			}
+			if fromNode {
+				return models.ErrTaskNotSent
+			}
+		}
+		if !current.Status.CanTransitionTo(nodeTaskStatus.Status) {
+			return &models.StatusTransitionError{Current: current, To: nodeTaskStatus.Status}
+		}
+		if current.Status.IsFinal() {
+			return nil
+		}
+
+		if exists {
+			update := bson.D{{Key: "$set", Value: fields}}
+			// Updates that only report progress are not a change of status
+			if current.Status != nodeTaskStatus.Status {
+				update = append(update, bson.E{Key: "$push", Value: bson.D{{Key: "history", Value: transition}}})
+			}
+			res, err := c.nodeTaskStatusCollection.UpdateOne(ctx,
+				append(filter, bson.E{Key: "status", Value: current.Status}),
+				update,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to update node task status: %w", err)
+			}
+			if res.MatchedCount > 0 {
+				return c.clearCancelled(ctx, nodeName, nodeTaskStatus)
+			}
+			continue
+		}
+
+		res, err := c.nodeTaskStatusCollection.UpdateOne(ctx, filter,
+			bson.D{{Key: "$setOnInsert", Value: append(fields,
+				bson.E{Key: "history", Value: []models.StatusTransition{transition}})}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update node task status: %w", err)
+		}
+		if res.UpsertedCount > 0 {
+			return c.clearCancelled(ctx, nodeName, nodeTaskStatus)
+		}
+	}
+	return errors.New("failed to update node task status: it was updated concurrently")
+}
+
+// clearCancelled forgets that a task was cancelled once the node finished it
+func (c *CosmosDB) clearCancelled(ctx context.Context, nodeName string, nodeTaskStatus models.NodeTaskStatus) error {
+	if !nodeTaskStatus.Status.IsFinal() {
+		return nil
+	}
+	_, err := c.nodeTasksCollection.UpdateOne(ctx,
+		bson.D{
+			{Key: "node_name", Value: nodeName},
+			{Key: "cancelled", Value: nodeTaskStatus.JobID},
+		},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "cancelled", Value: nodeTaskStatus.JobID}}}},
+	)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to update node tasks: %w", err)
 	}
+	return nil
+}
 
-	err = c.UpdateNodeTaskStatus(ctx, node, models.NodeTaskStatus{
-		JobID:  jobID,
-		Status: status,
-	})
+// CancelJob cancels the tasks of a job. A task still in a node's queue is
+// removed from it and gets the cancelled status. A task the node received and
+// has not finished is added to the node's cancelled tasks, and the node's
+// tasks are marked updated so that every replica lets the node know. It
+// returns models.ErrNotFound if the job does not exist.
+func (c *CosmosDB) CancelJob(ctx context.Context, jobID models.JobID) (CancelJobResult, error) {
+	job, err := c.GetJob(ctx, jobID)
 	if err != nil {
-		// TODO: logging
-		fmt.Printf("failed to create task status: %s\n", err)
+		return CancelJobResult{}, err
 	}
 
-	return nil
+	result := CancelJobResult{Cancelled: []models.Node{}, Running: []models.Node{}}
+	for _, node := range job.Job.Nodes {
+		nodeName := node.String()
+		res, err := c.nodeTasksCollection.UpdateOne(ctx,
+			bson.D{
+				{Key: "node_name", Value: nodeName},
+				{Key: "tasks.job_id", Value: jobID},
+			},
+			bson.D{{Key: "$pull", Value: bson.D{{Key: "tasks", Value: bson.D{{Key: "job_id", Value: jobID}}}}}},
+		)
+		if err != nil {
+			return CancelJobResult{}, fmt.Errorf("failed to remove task: %w", err)
+		}
+		if res.ModifiedCount > 0 {
+			err := c.setNodeTaskStatus(ctx, node, models.NodeTaskStatus{JobID: jobID, Status: models.TaskStatusCancelled}, false)
+			if err != nil {
+				return CancelJobResult{}, err
+			}
+			result.Cancelled = append(result.Cancelled, node)
+			continue
+		}
+
+		status, err := c.GetNodeTaskStatus(ctx, jobID, node)
+		if errors.Is(err, models.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return CancelJobResult{}, err
+		}
+		if status.Status.IsFinal() {
+			continue
+		}
+		_, err = c.nodeTasksCollection.UpdateOne(ctx,
+			bson.D{{Key: "node_name", Value: nodeName}},
+			bson.D{
+				{Key: "$addToSet", Value: bson.D{{Key: "cancelled", Value: jobID}}},
+				{Key: "$set", Value: bson.D{{Key: "updated", Value: time.Now()}}},
+			},
+		)
+		if err != nil {
+			return CancelJobResult{}, fmt.Errorf("failed to update node tasks: %w", err)
+		}
+		result.Running = append(result.Running, node)
+	}
+	return result, nil
 }
 
-func (c *CosmosDB) UpdateNodeTaskStatus(ctx context.Context, node models.Node, nodeTaskStatus models.NodeTaskStatus) error {
-	nodeName := node.String()
+func (c *CosmosDB) GetCancelledTasks(ctx context.Context, node models.Node) ([]models.JobID, error) {
+	result := CosmosNodeTask{}
+	err := c.nodeTasksCollection.FindOne(ctx, bson.D{{Key: "node_name", Value: node.String()}},
+		options.FindOne().SetProjection(bson.D{{Key: "cancelled", Value: 1}})).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for node tasks: %w", err)
+	}
+	return result.Cancelled, nil
+}
 
+func (c *CosmosDB) NodeTasksUpdatedSince(ctx context.Context, since time.Time) ([]NodeTasksUpdate, error) {
+	cursor, err := c.nodeTasksCollection.Find(ctx,
+		bson.D{{Key: "updated", Value: bson.D{{Key: "$gt", Value: since}}}},
+		options.Find().SetProjection(bson.D{
+			{Key: "node_name", Value: 1},
+			{Key: "updated", Value: 1},
+			{Key: "cancelled", Value: 1},
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for node tasks: %w", err)
+	}
+	updates := []NodeTasksUpdate{}
+	if err := cursor.All(ctx, &updates); err != nil {
+		return nil, fmt.Errorf("failed to decode node tasks: %w", err)
+	}
+	return updates, nil
+}
+
+// GetNodeTaskStatus returns the status of a node's task with its history. It
+// returns models.ErrJobNotForNode if the job does not target the node, and
+// models.ErrNotFound if the node has not received the task yet.
+func (c *CosmosDB) GetNodeTaskStatus(ctx context.Context, jobID models.JobID, node models.Node) (models.NodeTaskStatus, error) {
+	status := models.NodeTaskStatus{}
+	err := c.nodeTaskStatusCollection.FindOne(ctx, bson.D{
+		{Key: "node_name", Value: node.String()},
+		{Key: "job_id", Value: jobID},
+	}).Decode(&status)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if err := c.checkJobTargetsNode(ctx, jobID, node); err != nil {
+			return models.NodeTaskStatus{}, err
+		}
+		return models.NodeTaskStatus{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.NodeTaskStatus{}, fmt.Errorf("failed to query node task status: %w", err)
+	}
+	return status, nil
+}
+
+// checkJobTargetsNode returns models.ErrJobNotForNode if the job does not
+// exist or does not target the node
+func (c *CosmosDB) checkJobTargetsNode(ctx context.Context, jobID models.JobID, node models.Node) error {
+	objID, err := primitive.ObjectIDFromHex(jobID)
+	if err != nil {
+		return models.ErrJobNotForNode
+	}
+	err = c.jobsCollection.FindOne(ctx, bson.D{
+		{Key: "_id", Value: objID},
+		{Key: "nodes", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+			{Key: "org", Value: node.Organization},
+			{Key: "name", Value: node.Name},
+		}}}},
+	}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.ErrJobNotForNode
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query for jobs: %w", err)
+	}
+	return nil
+}
+
+func (c *CosmosDB) PutProvider(ctx context.Context, provider models.Provider) error {
 	opts := options.Update().SetUpsert(true)
-	_, err := c.nodeTaskStatusCollection.UpdateOne(
+	_, err := c.providersCollection.UpdateOne(
 		ctx,
 		bson.D{
-			{"node_name", nodeName},
-			{"job_id", nodeTaskStatus.JobID},
+			{Key: "name", Value: provider.Name},
 		},
 		bson.D{
-			{"$set", bson.D{
-				{"status", nodeTaskStatus.Status},
-				{"last_updated", time.Now()},
-				{"node_name", nodeName},
-				{"job_id", nodeTaskStatus.JobID},
-				{"result", nodeTaskStatus.Result},
+			{Key: "$set", Value: bson.D{
+				{Key: "name", Value: provider.Name},
+				{Key: "schema", Value: provider.Schema},
+				{Key: "last_updated", Value: time.Now()},
 			}},
 		},
 		opts,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to update node task status: %w", err)
+		return fmt.Errorf("failed to update provider: %w", err)
+	}
+	return nil
+}
+
+func (c *CosmosDB) GetProvider(ctx context.Context, name string) (models.Provider, error) {
+	cursor := c.providersCollection.FindOne(ctx, bson.D{{Key: "name", Value: name}})
+	if err := cursor.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.Provider{}, models.ErrNotFound
+		}
+		return models.Provider{}, fmt.Errorf("failed to query for provider: %w", err)
+	}
+	provider := models.Provider{}
+	if err := cursor.Decode(&provider); err != nil {
+		return models.Provider{}, fmt.Errorf("failed to decode provider: %w", err)
+	}
+	return provider, nil
+}
+
+func (c *CosmosDB) ListProviders(ctx context.Context) ([]models.Provider, error) {
+	cursor, err := c.providersCollection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for providers: %w", err)
+	}
+	providers := []models.Provider{}
+	if err := cursor.All(ctx, &providers); err != nil {
+		return nil, fmt.Errorf("failed to decode providers: %w", err)
+	}
+	return providers, nil
+}
+
+func (c *CosmosDB) DeleteProvider(ctx context.Context, name string) error {
+	res, err := c.providersCollection.DeleteOne(ctx, bson.D{{Key: "name", Value: name}})
+	if err != nil {
+		return fmt.Errorf("failed to delete provider: %w", err)
+	}
+	if res.DeletedCount == 0 {
+		return models.ErrNotFound
 	}
 	return nil
 }
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/chef/foodtruck/pkg/models"
 )
@@ -11,6 +12,25 @@ type JobWithStatus struct {
 	Statuses []models.NodeTaskStatus `json:"statuses,omitempty"`
 }
 
+// NodeTasksUpdate is when tasks were last added to a node's queue, or one of
+// its tasks was cancelled
+type NodeTasksUpdate struct {
+	NodeName string    `bson:"node_name"`
+	Updated  time.Time `bson:"updated"`
+	// Cancelled are the cancelled tasks the node received and has not
+	// finished yet
+	Cancelled []models.JobID `bson:"cancelled"`
+}
+
+// CancelJobResult is what cancelling a job did for each of its nodes
+type CancelJobResult struct {
+	// Cancelled are the nodes the task was removed from the queue of
+	Cancelled []models.Node `json:"cancelled"`
+	// Running are the nodes that received the task and have not finished
+	// it. They are asked to stop it.
+	Running []models.Node `json:"running"`
+}
+
 type GetJobOpts struct {
 	FetchStatuses bool
 }
@@ -23,11 +43,81 @@ func WithJobStatuses(fetchStatus bool) GetJobOpt {
 	}
 }
 
+type NextNodeTaskOpts struct {
+	FilterProviders bool
+	Providers       []string
+	BusyProviders   []string
+	Peek            bool
+}
+
+type NextNodeTaskOpt func(*NextNodeTaskOpts)
+
+// WithAvailableProviders limits the next task to tasks for the given
+// providers. Tasks for other providers are failed with the reason
+// models.ReasonProviderMissing instead of being sent to the node.
+func WithAvailableProviders(providers []string) NextNodeTaskOpt {
+	return func(opts *NextNodeTaskOpts) {
+		opts.FilterProviders = true
+		opts.Providers = providers
+	}
+}
+
+// WithBusyProviders leaves the tasks for the given providers in the queue,
+// because the node cannot run another one right now
+func WithBusyProviders(providers []string) NextNodeTaskOpt {
+	return func(opts *NextNodeTaskOpts) {
+		opts.BusyProviders = providers
+	}
+}
+
+// WithPeek returns the next task without dequeuing it. Tasks that would be
+// failed or expired are skipped and left as they are.
+func WithPeek() NextNodeTaskOpt {
+	return func(opts *NextNodeTaskOpts) {
+		opts.Peek = true
+	}
+}
+
+func (opts NextNodeTaskOpts) isBusy(provider string) bool {
+	for _, p := range opts.BusyProviders {
+		if p == provider {
+			return true
+		}
+	}
+	return false
+}
+
+func (opts NextNodeTaskOpts) hasProvider(provider string) bool {
+	if !opts.FilterProviders {
+		return true
+	}
+	for _, p := range opts.Providers {
+		if p == provider {
+			return true
+		}
+	}
+	return false
+}
+
 type Driver interface {
 	AddJob(ctx context.Context, job models.Job) (models.JobID, error)
 	ListJobs(ctx context.Context) error
 	GetJob(ctx context.Context, jobID models.JobID, opts ...GetJobOpt) (JobWithStatus, error)
 	GetNodeTasks(ctx context.Context, node models.Node) ([]models.NodeTask, error)
-	NextNodeTask(ctx context.Context, node models.Node) (models.NodeTask, error)
+	NextNodeTask(ctx context.Context, node models.Node, opts ...NextNodeTaskOpt) (models.NodeTask, error)
 	UpdateNodeTaskStatus(ctx context.Context, node models.Node, nodeTaskStatus models.NodeTaskStatus) error
+	GetNodeTaskStatus(ctx context.Context, jobID models.JobID, node models.Node) (models.NodeTaskStatus, error)
+	// NodeTasksUpdatedSince returns the nodes tasks were added for after
+	// since
+	NodeTasksUpdatedSince(ctx context.Context, since time.Time) ([]NodeTasksUpdate, error)
+	// CancelJob cancels the tasks of a job that the nodes have not finished
+	CancelJob(ctx context.Context, jobID models.JobID) (CancelJobResult, error)
+	// GetCancelledTasks returns the cancelled tasks the node received and
+	// has not finished yet
+	GetCancelledTasks(ctx context.Context, node models.Node) ([]models.JobID, error)
+
+	PutProvider(ctx context.Context, provider models.Provider) error
+	GetProvider(ctx context.Context, name string) (models.Provider, error)
+	ListProviders(ctx context.Context) ([]models.Provider, error)
+	DeleteProvider(ctx context.Context, name string) error
 }
@@ -11,7 +11,12 @@ import (
 
 func asAdmin(t *testing.T) *httpexpect.Expect {
 	t.Helper()
-	return defaultHTTPExpect(t).Builder(func(req *httpexpect.Request) {
+	return asAdminOn(t, foodtruckServerAddress)
+}
+
+func asAdminOn(t *testing.T, baseURL string) *httpexpect.Expect {
+	t.Helper()
+	return httpExpect(t, baseURL).Builder(func(req *httpexpect.Request) {
 		req.WithHeader("Authorization", fmt.Sprintf("Bearer %s", adminAPIKey))
 	})
 }
@@ -23,6 +28,20 @@ func asNode(t *testing.T) *httpexpect.Expect {
 	})
 }
 
+func asNodeOn(t *testing.T, baseURL string) *httpexpect.Expect {
+	t.Helper()
+	return httpExpect(t, baseURL).Builder(func(req *httpexpect.Request) {
+		req.WithHeader("Authorization", fmt.Sprintf("Bearer %s", nodesAPIKey))
+	})
+}
+
+func asNodeWithNextKey(t *testing.T) *httpexpect.Expect {
+	t.Helper()
+	return defaultHTTPExpect(t).Builder(func(req *httpexpect.Request) {
+		req.WithHeader("Authorization", fmt.Sprintf("Bearer %s", nextNodesAPIKey))
+	})
+}
+
 func asUnauthorized(t *testing.T) *httpexpect.Expect {
 	t.Helper()
 	return defaultHTTPExpect(t).Builder(func(req *httpexpect.Request) {
@@ -31,8 +50,12 @@ func asUnauthorized(t *testing.T) *httpexpect.Expect {
 }
 
 func defaultHTTPExpect(t *testing.T) *httpexpect.Expect {
+	return httpExpect(t, foodtruckServerAddress)
+}
+
+func httpExpect(t *testing.T, baseURL string) *httpexpect.Expect {
 	return httpexpect.WithConfig(httpexpect.Config{
-		BaseURL:  foodtruckServerAddress,
+		BaseURL:  baseURL,
 		Reporter: httpexpect.NewRequireReporter(t),
 		Printers: []httpexpect.Printer{
 			httpexpect.NewCurlPrinter(t),
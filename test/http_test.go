@@ -1,35 +1,63 @@
 package test
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"testing"
 	"time"
 
+	"github.com/chef/foodtruck/pkg/foodtruckhttp"
+	"github.com/chef/foodtruck/pkg/models"
+	"github.com/chef/foodtruck/pkg/server"
 	"github.com/labstack/gommon/random"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type newJobRequestNode struct {
 	Org  string `json:"org"`
 	Name string `json:"name"`
 }
+type newJobRequestTaskSignature struct {
+	KeyID     string `json:"key_id,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
 type newJobRequestTask struct {
-	WindowStart time.Time              `json:"window_start,omitempty"`
-	WindowEnd   time.Time              `json:"window_end,omitempty"`
-	Provider    string                 `json:"provider,omitempty"`
-	Spec        map[string]interface{} `json:"spec,omitempty"`
+	WindowStart time.Time                   `json:"window_start,omitempty"`
+	WindowEnd   time.Time                   `json:"window_end,omitempty"`
+	Provider    string                      `json:"provider,omitempty"`
+	Spec        map[string]interface{}      `json:"spec,omitempty"`
+	Signature   *newJobRequestTaskSignature `json:"signature,omitempty"`
+	Env         map[string]string           `json:"env,omitempty"`
+	RunAs       *newJobRequestTaskRunAs     `json:"run_as,omitempty"`
+}
+
+type newJobRequestTaskRunAs struct {
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
 }
 
 type newJobRequest struct {
+	ID    string              `json:"id,omitempty"`
 	Nodes []newJobRequestNode `json:"nodes,omitempty"`
 	Task  *newJobRequestTask  `json:"task,omitempty"`
 }
 
 type updateNodeTaskStatusResult struct {
-	ExitCode int    `json:"exit_code"`
-	Reason   string `json:"reason,omitempty"`
+	ExitCode int                       `json:"exit_code"`
+	Reason   string                    `json:"reason,omitempty"`
+	Progress int                       `json:"progress,omitempty"`
+	Logs     []updateNodeTaskStatusLog `json:"logs,omitempty"`
+	Output   interface{}               `json:"output,omitempty"`
+}
+type updateNodeTaskStatusLog struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
 }
 type updateNodeTaskStatusReq struct {
 	JobID  string                      `json:"job_id,omitempty"`
@@ -293,6 +321,286 @@ func Test_newJob_validation(t *testing.T) {
 	})
 }
 
+func Test_newJob_env(t *testing.T) {
+	t.Run("env and run_as are sent to the node", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		jobRequest.Task.Env = map[string]string{"APP_ENV": "production"}
+		jobRequest.Task.RunAs = &newJobRequestTaskRunAs{User: "app", Group: "app"}
+
+		asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK)
+
+		resp := asNode(t).POST(getNextTaskPath(jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name)).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+
+		resp.Path("$.env.APP_ENV").String().Equal("production")
+		resp.Path("$.run_as.user").String().Equal("app")
+		resp.Path("$.run_as.group").String().Equal("app")
+	})
+
+	for _, name := range []string{"FOODTRUCK_JOB_ID", "foodtruck_workdir", "NOT-VALID", "1ABC", ""} {
+		name := name
+		t.Run(fmt.Sprintf("rejects env %q", name), func(t *testing.T) {
+			jobRequest := validNewJobRequest(1)
+			jobRequest.Task.Env = map[string]string{name: "value"}
+
+			asAdmin(t).POST("/admin/jobs").
+				WithJSON(jobRequest).
+				Expect().
+				Status(http.StatusBadRequest)
+		})
+	}
+}
+
+func Test_newJob_signed(t *testing.T) {
+	signature := &newJobRequestTaskSignature{
+		KeyID:     "signer",
+		Signature: []byte("not-really-a-signature"),
+	}
+
+	t.Run("accepts a job id and signature", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		jobRequest.ID = primitive.NewObjectID().Hex()
+		jobRequest.Task.Signature = signature
+
+		asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Path("$.id").
+			String().
+			Equal(jobRequest.ID)
+
+		resp := asNode(t).POST(getNextTaskPath(jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name)).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object()
+
+		resp.Path("$.job_id").String().Equal(jobRequest.ID)
+		resp.Path("$.signature.key_id").String().Equal(signature.KeyID)
+		resp.Path("$.signature.signature").String().Equal(base64.StdEncoding.EncodeToString(signature.Signature))
+	})
+
+	t.Run("rejects a signature without a job id", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		jobRequest.Task.Signature = signature
+
+		asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().
+			Path("$.message").
+			String().
+			Equal("signed tasks must provide an id, key_id and signature")
+	})
+
+	t.Run("rejects an invalid job id", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		jobRequest.ID = "not-an-id"
+
+		asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().
+			Path("$.message").
+			String().
+			Equal("id is not a valid job id")
+	})
+
+	t.Run("rejects a job id that already exists", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		jobRequest.ID = primitive.NewObjectID().Hex()
+
+		asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK)
+
+		asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusConflict)
+	})
+}
+
+func Test_newJob_secrets(t *testing.T) {
+	jobRequest := validNewJobRequest(1)
+	jobRequest.Task.Spec = map[string]interface{}{
+		"url": "https://example.com/policy.tar.gz",
+		"token": map[string]interface{}{
+			"$secret": "a-download-token",
+		},
+	}
+
+	jobID := asAdmin(t).POST("/admin/jobs").
+		WithJSON(jobRequest).
+		Expect().
+		Status(http.StatusOK).
+		JSON().
+		Object().Path("$.id").String().Raw()
+
+	t.Run("secrets are redacted for admins", func(t *testing.T) {
+		asAdmin(t).GET("/admin/jobs/{jobID}", jobID).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Path("$.job.task.spec").
+			Object().
+			Equal(map[string]interface{}{
+				"url":   "https://example.com/policy.tar.gz",
+				"token": "[REDACTED]",
+			})
+	})
+
+	t.Run("secrets are sent to the node", func(t *testing.T) {
+		resp := asNode(t).POST(getNextTaskPath(jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name)).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object()
+
+		resp.Path("$.job_id").String().Equal(jobID)
+		resp.Path("$.spec").Object().Equal(jobRequest.Task.Spec)
+		resp.NotContainsKey("secrets_key")
+	})
+
+	t.Run("the encrypted field is reserved", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		jobRequest.Task.Spec = map[string]interface{}{
+			"token": map[string]interface{}{
+				"$encrypted": "abc",
+			},
+		}
+
+		asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusBadRequest)
+	})
+}
+
+func Test_providers(t *testing.T) {
+	providerName := random.String(8, random.Lowercase)
+	schema := map[string]interface{}{
+		"type":     "object",
+		"required": []string{"url"},
+		"properties": map[string]interface{}{
+			"url": map[string]interface{}{
+				"type": "string",
+			},
+		},
+	}
+
+	t.Run("rejects an invalid schema", func(t *testing.T) {
+		asAdmin(t).PUT("/admin/providers/{name}", providerName).
+			WithJSON(map[string]interface{}{
+				"schema": map[string]interface{}{"type": 5},
+			}).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().
+			Path("$.message").
+			String().
+			Contains("invalid schema")
+	})
+
+	t.Run("rejects an invalid provider name", func(t *testing.T) {
+		asAdmin(t).PUT("/admin/providers/{name}", "Not-Valid").
+			WithJSON(map[string]interface{}{"schema": schema}).
+			Expect().
+			Status(http.StatusBadRequest)
+	})
+
+	t.Run("registers a provider", func(t *testing.T) {
+		asAdmin(t).PUT("/admin/providers/{name}", providerName).
+			WithJSON(map[string]interface{}{"schema": schema}).
+			Expect().
+			Status(http.StatusOK)
+
+		resp := asAdmin(t).GET("/admin/providers/{name}", providerName).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object()
+		resp.Path("$.name").String().Equal(providerName)
+		resp.Path("$.schema").Object().Equal(schema)
+
+		asAdmin(t).GET("/admin/providers").
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Array().
+			Contains(resp.Raw())
+	})
+
+	t.Run("accepts jobs with a valid spec", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		jobRequest.Task.Provider = providerName
+		jobRequest.Task.Spec = map[string]interface{}{"url": "https://example.com/policy.tar.gz"}
+
+		asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK)
+	})
+
+	t.Run("rejects jobs with an invalid spec", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		jobRequest.Task.Provider = providerName
+		jobRequest.Task.Spec = map[string]interface{}{"url": 5}
+
+		resp := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().
+			Object()
+
+		resp.Path("$.message").String().Contains(providerName)
+		resp.Path("$.errors").Array().Length().Equal(1)
+		resp.Path("$.errors[0].field").String().Equal("url")
+	})
+
+	t.Run("rejects unknown providers by default", func(t *testing.T) {
+		serverURL := startTestServer(t, server.WithAllowUnregisteredProviders(false))
+
+		jobRequest := validNewJobRequest(1)
+		asAdminOn(t, serverURL).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().
+			Path("$.message").
+			String().
+			Equal(fmt.Sprintf("unknown provider %q", jobRequest.Task.Provider))
+
+		jobRequest.Task.Provider = providerName
+		jobRequest.Task.Spec = map[string]interface{}{"url": "https://example.com/policy.tar.gz"}
+		asAdminOn(t, serverURL).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK)
+	})
+
+	t.Run("deletes a provider", func(t *testing.T) {
+		asAdmin(t).DELETE("/admin/providers/{name}", providerName).
+			Expect().
+			Status(http.StatusOK)
+
+		asAdmin(t).GET("/admin/providers/{name}", providerName).
+			Expect().
+			Status(http.StatusNotFound)
+	})
+}
+
 func Test_getJob(t *testing.T) {
 	t.Run("returns not found if the job does not exist", func(t *testing.T) {
 		asAdmin(t).GET("/admin/jobs/jobid").
@@ -440,6 +748,14 @@ func Test_getNext_authorization(t *testing.T) {
 			JSON().
 			Object()
 	})
+
+	t.Run("authorized with next nodes token", func(t *testing.T) {
+		asNodeWithNextKey(t).POST(getNextTaskPath(randomorg(), randomnode())).
+			Expect().
+			Status(http.StatusNotFound).
+			JSON().
+			Object()
+	})
 }
 
 func Test_getNext(t *testing.T) {
@@ -577,77 +893,377 @@ func Test_getNext(t *testing.T) {
 	})
 }
 
-func Test_updateNodeStatus_authorization(t *testing.T) {
-	t.Run("unauthorized with random token", func(t *testing.T) {
-		asUnauthorized(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
+func Test_getNext_providers(t *testing.T) {
+	type nodeProvider struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	type nextTaskReq struct {
+		Providers     []nodeProvider `json:"providers"`
+		BusyProviders []string       `json:"busy_providers,omitempty"`
+	}
+
+	org := randomorg()
+	node := randomnode()
+
+	missingJob := validNewJobRequest(1)
+	missingJob.Nodes[0] = newJobRequestNode{Org: org, Name: node}
+	missingJob.Task.Provider = "missing"
+	missingJob.Task.WindowStart = time.Now().Add(-2 * time.Hour)
+
+	runnableJob := validNewJobRequest(1)
+	runnableJob.Nodes[0] = newJobRequestNode{Org: org, Name: node}
+	runnableJob.Task.Provider = "infra"
+	runnableJob.Task.WindowStart = time.Now().Add(-1 * time.Hour)
+
+	missingJobID := asAdmin(t).POST("/admin/jobs").
+		WithJSON(missingJob).
+		Expect().
+		Status(http.StatusOK).
+		JSON().
+		Object().Path("$.id").String().Raw()
+
+	runnableJobID := asAdmin(t).POST("/admin/jobs").
+		WithJSON(runnableJob).
+		Expect().
+		Status(http.StatusOK).
+		JSON().
+		Object().Path("$.id").String().Raw()
+
+	asNode(t).POST(getNextTaskPath(org, node)).
+		WithJSON(nextTaskReq{Providers: []nodeProvider{{Name: "infra", Version: "1.0.0"}}}).
+		Expect().
+		Status(http.StatusOK).
+		JSON().
+		Path("$.job_id").
+		String().
+		Equal(runnableJobID)
+
+	resp := asAdmin(t).GET("/admin/jobs/{jobID}", missingJobID).
+		WithQuery("fetchStatuses", "true").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+
+	resp.Path("$.statuses").Array().Length().Equal(1)
+	resp.Path("$.statuses[0].status").String().Equal("failed")
+	resp.Path("$.statuses[0].result.reason").String().Equal("provider_missing")
+
+	t.Run("nodes that send no providers get any task", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		jobRequest.Task.Provider = "missing"
+
+		asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
 			Expect().
-			JSON().
-			Path("$.message").
-			String().
-			Equal("Unauthorized")
-	})
+			Status(http.StatusOK)
 
-	t.Run("unauthorized with admin token", func(t *testing.T) {
-		asAdmin(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
+		asNode(t).POST(getNextTaskPath(jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name)).
 			Expect().
-			Status(http.StatusUnauthorized).
+			Status(http.StatusOK).
 			JSON().
-			Path("$.message").
+			Path("$.provider").
 			String().
-			Equal("Unauthorized")
+			Equal("missing")
 	})
 
-	t.Run("authorized with nodes token", func(t *testing.T) {
-		asNode(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
+	t.Run("tasks for busy providers are left in the queue", func(t *testing.T) {
+		org, node := randomorg(), randomnode()
+		providers := []nodeProvider{{Name: "infra"}, {Name: "shell"}}
+
+		busyJob := validNewJobRequest(1)
+		busyJob.Nodes[0] = newJobRequestNode{Org: org, Name: node}
+		busyJob.Task.Provider = "infra"
+		busyJob.Task.WindowStart = time.Now().Add(-2 * time.Hour)
+
+		otherJob := validNewJobRequest(1)
+		otherJob.Nodes[0] = newJobRequestNode{Org: org, Name: node}
+		otherJob.Task.Provider = "shell"
+		otherJob.Task.WindowStart = time.Now().Add(-1 * time.Hour)
+
+		busyJobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(busyJob).
 			Expect().
-			Status(http.StatusBadRequest).
+			Status(http.StatusOK).
 			JSON().
-			Object()
-	})
-}
+			Object().Path("$.id").String().Raw()
 
-func Test_updateNodeStatus_validation(t *testing.T) {
-	t.Run("requires job id", func(t *testing.T) {
-		asNode(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
-			WithJSON(updateNodeTaskStatusReq{
-				Status: "pending",
-			}).
+		otherJobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(otherJob).
 			Expect().
-			Status(http.StatusBadRequest).
+			Status(http.StatusOK).
 			JSON().
-			Path("$.message").
-			String().
-			Equal("job_id must be provided")
-	})
+			Object().Path("$.id").String().Raw()
 
-	t.Run("requires valid status", func(t *testing.T) {
-		asNode(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
-			WithJSON(updateNodeTaskStatusReq{
-				JobID: "some-job-id",
-			}).
+		asNode(t).POST(getNextTaskPath(org, node)).
+			WithJSON(nextTaskReq{Providers: providers, BusyProviders: []string{"infra"}}).
 			Expect().
-			Status(http.StatusBadRequest).
+			Status(http.StatusOK).
 			JSON().
-			Path("$.message").
+			Path("$.job_id").
 			String().
-			Contains("status must be one of")
+			Equal(otherJobID)
 
-		asNode(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
-			WithJSON(updateNodeTaskStatusReq{
-				JobID:  "some-job-id",
-				Status: "invalid",
-			}).
+		asNode(t).POST(getNextTaskPath(org, node)).
+			WithJSON(nextTaskReq{Providers: providers, BusyProviders: []string{"infra"}}).
 			Expect().
-			Status(http.StatusBadRequest).
+			Status(http.StatusNotFound)
+
+		asNode(t).POST(getNextTaskPath(org, node)).
+			WithJSON(nextTaskReq{Providers: providers}).
+			Expect().
+			Status(http.StatusOK).
 			JSON().
-			Path("$.message").
+			Path("$.job_id").
 			String().
-			Contains("status must be one of")
+			Equal(busyJobID)
 	})
-}
 
-func Test_updateNodeStatus(t *testing.T) {
-	validStatuses := []string{}
+	t.Run("nodes that send an empty list get no tasks", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+
+		asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK)
+
+		asNode(t).POST(getNextTaskPath(jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name)).
+			WithJSON(nextTaskReq{Providers: []nodeProvider{}}).
+			Expect().
+			Status(http.StatusNotFound)
+	})
+}
+
+func Test_getNext_longPoll(t *testing.T) {
+	type nextTaskReq struct {
+		Wait int `json:"wait"`
+	}
+
+	longPollServer := startTestServer(t, server.WithLongPoll(10*time.Second))
+
+	t.Run("servers without long polling answer right away", func(t *testing.T) {
+		asNode(t).POST(getNextTaskPath(randomorg(), randomnode())).
+			WithJSON(nextTaskReq{Wait: 10}).
+			Expect().
+			Status(http.StatusNotFound).
+			Header("Foodtruck-Long-Poll").Empty()
+	})
+
+	t.Run("waits up to the requested time", func(t *testing.T) {
+		start := time.Now()
+		asNodeOn(t, longPollServer).POST(getNextTaskPath(randomorg(), randomnode())).
+			WithJSON(nextTaskReq{Wait: 1}).
+			Expect().
+			Status(http.StatusNotFound).
+			Header("Foodtruck-Long-Poll").Equal("10")
+		require.True(t, time.Since(start) >= time.Second)
+	})
+
+	waitForJob := func(t *testing.T, nodeServer string, adminServer string) {
+		jobRequest := validNewJobRequest(1)
+		org, node := jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name
+
+		jobIDs := make(chan string, 1)
+		time.AfterFunc(500*time.Millisecond, func() {
+			jobIDs <- asAdminOn(t, adminServer).POST("/admin/jobs").
+				WithJSON(jobRequest).
+				Expect().
+				Status(http.StatusOK).
+				JSON().
+				Object().Path("$.id").String().Raw()
+		})
+
+		start := time.Now()
+		resp := asNodeOn(t, nodeServer).POST(getNextTaskPath(org, node)).
+			WithJSON(nextTaskReq{Wait: 10}).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		require.True(t, time.Since(start) < 10*time.Second)
+		resp.Path("$.job_id").String().Equal(<-jobIDs)
+	}
+
+	t.Run("returns a task as soon as it is added", func(t *testing.T) {
+		waitForJob(t, longPollServer, longPollServer)
+	})
+
+	t.Run("returns a task added through another server", func(t *testing.T) {
+		waitForJob(t, longPollServer, foodtruckServerAddress)
+	})
+}
+
+func Test_getNext_pollHints(t *testing.T) {
+	hintsServer := startTestServer(t, server.WithPollHints(time.Minute, 10*time.Minute, 0))
+
+	t.Run("tells nodes without tasks to wait the poll interval", func(t *testing.T) {
+		asNodeOn(t, hintsServer).POST(getNextTaskPath(randomorg(), randomnode())).
+			Expect().
+			Status(http.StatusNotFound).
+			Header("Retry-After").Equal("60")
+	})
+
+	t.Run("tells nodes to come back when their next task starts", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		jobRequest.Task.WindowStart = time.Now().Add(30 * time.Second)
+		org, node := jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name
+
+		asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK)
+
+		for _, serverURL := range []string{hintsServer, foodtruckServerAddress} {
+			asNodeOn(t, serverURL).POST(getNextTaskPath(org, node)).
+				Expect().
+				Status(http.StatusNotFound).
+				Header("Retry-After").Match("^(29|30)$")
+		}
+	})
+
+	t.Run("leaves it to the node without hints", func(t *testing.T) {
+		asNode(t).POST(getNextTaskPath(randomorg(), randomnode())).
+			Expect().
+			Status(http.StatusNotFound).
+			Header("Retry-After").Empty()
+	})
+}
+
+func Test_rateLimits(t *testing.T) {
+	t.Run("limits the requests of each node", func(t *testing.T) {
+		limitedServer := startTestServer(t, server.WithNodesRateLimit(server.RateLimit{PerNode: 0.1}))
+		org, node := randomorg(), randomnode()
+
+		asNodeOn(t, limitedServer).POST(getNextTaskPath(org, node)).
+			Expect().
+			Status(http.StatusNotFound)
+		asNodeOn(t, limitedServer).POST(getNextTaskPath(org, node)).
+			Expect().
+			Status(http.StatusTooManyRequests).
+			Header("Retry-After").Equal("10")
+		asNodeOn(t, limitedServer).POST(getNextTaskPath(org, randomnode())).
+			Expect().
+			Status(http.StatusNotFound)
+	})
+
+	t.Run("limits the requests made with each admin key", func(t *testing.T) {
+		limitedServer := startTestServer(t, server.WithAdminRateLimit(server.RateLimit{PerCredential: 0.1}))
+
+		asAdminOn(t, limitedServer).POST("/admin/jobs").
+			WithJSON(validNewJobRequest(1)).
+			Expect().
+			Status(http.StatusOK)
+		asAdminOn(t, limitedServer).POST("/admin/jobs").
+			WithJSON(validNewJobRequest(1)).
+			Expect().
+			Status(http.StatusTooManyRequests)
+	})
+}
+
+func Test_peekNext(t *testing.T) {
+	jobRequest := validNewJobRequest(1)
+	org, node := jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name
+
+	jobID := asAdmin(t).POST("/admin/jobs").
+		WithJSON(jobRequest).
+		Expect().
+		Status(http.StatusOK).
+		JSON().
+		Object().Path("$.id").String().Raw()
+
+	for i := 0; i < 2; i++ {
+		asNode(t).POST(peekNextTaskPath(org, node)).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Path("$.job_id").
+			String().
+			Equal(jobID)
+	}
+
+	asNode(t).POST(getNextTaskPath(org, node)).
+		Expect().
+		Status(http.StatusOK).
+		JSON().
+		Path("$.job_id").
+		String().
+		Equal(jobID)
+
+	asNode(t).POST(peekNextTaskPath(org, node)).
+		Expect().
+		Status(http.StatusNotFound)
+}
+
+func Test_updateNodeStatus_authorization(t *testing.T) {
+	t.Run("unauthorized with random token", func(t *testing.T) {
+		asUnauthorized(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
+			Expect().
+			JSON().
+			Path("$.message").
+			String().
+			Equal("Unauthorized")
+	})
+
+	t.Run("unauthorized with admin token", func(t *testing.T) {
+		asAdmin(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
+			Expect().
+			Status(http.StatusUnauthorized).
+			JSON().
+			Path("$.message").
+			String().
+			Equal("Unauthorized")
+	})
+
+	t.Run("authorized with nodes token", func(t *testing.T) {
+		asNode(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().
+			Object()
+	})
+}
+
+func Test_updateNodeStatus_validation(t *testing.T) {
+	t.Run("requires job id", func(t *testing.T) {
+		asNode(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
+			WithJSON(updateNodeTaskStatusReq{
+				Status: "pending",
+			}).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().
+			Path("$.message").
+			String().
+			Equal("job_id must be provided")
+	})
+
+	t.Run("requires valid status", func(t *testing.T) {
+		asNode(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
+			WithJSON(updateNodeTaskStatusReq{
+				JobID: "some-job-id",
+			}).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().
+			Path("$.message").
+			String().
+			Contains("status must be one of")
+
+		asNode(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
+			WithJSON(updateNodeTaskStatusReq{
+				JobID:  "some-job-id",
+				Status: "invalid",
+			}).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().
+			Path("$.message").
+			String().
+			Contains("status must be one of")
+	})
+}
+
+func Test_updateNodeStatus(t *testing.T) {
+	validStatuses := []string{}
 	for _, status := range validStatuses {
 		t.Run(fmt.Sprintf("accepts status %s", status), func(t *testing.T) {
 			jobRequest := validNewJobRequest(1)
@@ -728,12 +1344,479 @@ func Test_updateNodeStatus(t *testing.T) {
 		resp.Path("$.statuses[0].result.reason").String().Equal("a reason")
 	})
 
+	t.Run("does not change a final status", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		org, node := jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name
+
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+
+		asNode(t).POST(getNextTaskPath(org, node)).
+			Expect().
+			Status(http.StatusOK)
+
+		asNode(t).POST(updateTaskStatusPath(org, node)).
+			WithJSON(updateNodeTaskStatusReq{
+				JobID:  jobID,
+				Status: "timed_out",
+			}).
+			Expect().
+			Status(http.StatusOK)
+
+		asNode(t).POST(updateTaskStatusPath(org, node)).
+			WithJSON(updateNodeTaskStatusReq{
+				JobID:  jobID,
+				Status: "pending",
+			}).
+			Expect().
+			Status(http.StatusConflict).
+			JSON().
+			Path("$.current.status").
+			String().
+			Equal("timed_out")
+	})
+
+	t.Run("rejects updates for jobs that do not target the node", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+
+		asNode(t).POST(updateTaskStatusPath(randomorg(), randomnode())).
+			WithJSON(updateNodeTaskStatusReq{
+				JobID:  jobID,
+				Status: "success",
+			}).
+			Expect().
+			Status(http.StatusNotFound).
+			JSON().
+			Path("$.message").
+			String().
+			Equal("job does not target this node")
+
+		asNode(t).POST(updateTaskStatusPath(jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name)).
+			WithJSON(updateNodeTaskStatusReq{
+				JobID:  "5fd0f5b8c6b2a1e3f4a5b6c7",
+				Status: "success",
+			}).
+			Expect().
+			Status(http.StatusNotFound)
+	})
+
+	t.Run("rejects updates for tasks the node has not been sent", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		org, node := jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name
+
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+
+		for _, status := range []string{"running", "success"} {
+			asNode(t).POST(updateTaskStatusPath(org, node)).
+				WithJSON(updateNodeTaskStatusReq{
+					JobID:  jobID,
+					Status: status,
+				}).
+				Expect().
+				Status(http.StatusConflict).
+				JSON().
+				Path("$.message").
+				String().
+				Equal("the task has not been sent to this node")
+		}
+
+		asNode(t).POST(getNextTaskPath(org, node)).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Path("$.job_id").
+			String().
+			Equal(jobID)
+	})
+
+	t.Run("keeps a final status when updates are replayed", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		org, node := jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name
+
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+
+		asNode(t).POST(getNextTaskPath(org, node)).
+			Expect().
+			Status(http.StatusOK)
+
+		for _, status := range []string{"running", "success", "success"} {
+			asNode(t).POST(updateTaskStatusPath(org, node)).
+				WithJSON(updateNodeTaskStatusReq{
+					JobID:  jobID,
+					Status: status,
+					Result: &updateNodeTaskStatusResult{},
+				}).
+				Expect().
+				Status(http.StatusOK)
+		}
+
+		for _, status := range []string{"running", "failed"} {
+			conflict := asNode(t).POST(updateTaskStatusPath(org, node)).
+				WithJSON(updateNodeTaskStatusReq{
+					JobID:  jobID,
+					Status: status,
+				}).
+				Expect().
+				Status(http.StatusConflict).
+				JSON().Object()
+			conflict.Path("$.message").String().Equal(fmt.Sprintf("status cannot change from success to %s", status))
+			conflict.Path("$.current.status").String().Equal("success")
+		}
+
+		resp := asAdmin(t).GET("/admin/jobs/{jobID}", jobID).
+			WithQuery("fetchStatuses", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+
+		resp.Path("$.statuses").Array().Length().Equal(1)
+		resp.Path("$.statuses[0].status").String().Equal("success")
+	})
+
+	t.Run("can pass provider outputs", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+
+		asNode(t).POST(getNextTaskPath(jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name)).
+			Expect().
+			Status(http.StatusOK)
+
+		asNode(t).POST(updateTaskStatusPath(jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name)).
+			WithJSON(updateNodeTaskStatusReq{
+				JobID:  jobID,
+				Status: "success",
+				Result: &updateNodeTaskStatusResult{
+					Progress: 100,
+					Logs: []updateNodeTaskStatusLog{
+						{Time: time.Now(), Level: "info", Message: "converged"},
+					},
+					Output: map[string]interface{}{"resources_updated": 3},
+				},
+			}).
+			Expect().
+			Status(http.StatusOK)
+
+		resp := asAdmin(t).GET("/admin/jobs/{jobID}", jobID).
+			WithQuery("fetchStatuses", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+
+		resp.Path("$.statuses[0].result.progress").Number().Equal(100)
+		resp.Path("$.statuses[0].result.logs").Array().Length().Equal(1)
+		resp.Path("$.statuses[0].result.logs[0].message").String().Equal("converged")
+		resp.Path("$.statuses[0].result.output.resources_updated").Number().Equal(3)
+	})
+
+	t.Run("rejects invalid provider outputs", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+
+		asNode(t).POST(updateTaskStatusPath(jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name)).
+			WithJSON(updateNodeTaskStatusReq{
+				JobID:  jobID,
+				Status: "running",
+				Result: &updateNodeTaskStatusResult{
+					Progress: 101,
+				},
+			}).
+			Expect().
+			Status(http.StatusBadRequest)
+	})
+}
+
+func Test_getNodeTaskStatus(t *testing.T) {
+	t.Run("returns the status history", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		org, node := jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name
+
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+
+		asAdmin(t).GET("/admin/jobs/{jobID}/nodes/{org}/{name}", jobID, org, node).
+			Expect().
+			Status(http.StatusNotFound).
+			JSON().
+			Path("$.message").
+			String().
+			Equal("node has not received the task yet")
+
+		asNode(t).POST(getNextTaskPath(org, node)).
+			Expect().
+			Status(http.StatusOK)
+
+		updates := []updateNodeTaskStatusReq{
+			{JobID: jobID, Status: "running", Result: &updateNodeTaskStatusResult{Progress: 10}},
+			{JobID: jobID, Status: "running", Result: &updateNodeTaskStatusResult{Progress: 50}},
+			{JobID: jobID, Status: "success", Result: &updateNodeTaskStatusResult{Progress: 100}},
+		}
+		for _, update := range updates {
+			asNode(t).POST(updateTaskStatusPath(org, node)).
+				WithJSON(update).
+				Expect().
+				Status(http.StatusOK)
+		}
+
+		resp := asAdmin(t).GET("/admin/jobs/{jobID}/nodes/{org}/{name}", jobID, org, node).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+
+		resp.Path("$.status").String().Equal("success")
+		history := resp.Path("$.history").Array()
+		history.Length().Equal(3)
+		history.Element(0).Path("$.status").String().Equal("pending")
+		history.Element(1).Path("$.status").String().Equal("running")
+		history.Element(1).Path("$.result.progress").Number().Equal(10)
+		history.Element(2).Path("$.status").String().Equal("success")
+		history.Element(2).Path("$.result.progress").Number().Equal(100)
+
+		pending := history.Element(0).Path("$.time").String().DateTime(time.RFC3339Nano).Raw()
+		success := history.Element(2).Path("$.time").String().DateTime(time.RFC3339Nano).Raw()
+		require.False(t, success.Before(pending))
+
+		asAdmin(t).GET("/admin/jobs/{jobID}", jobID).
+			WithQuery("fetchStatuses", "true").
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object().
+			Path("$.statuses[0]").Object().NotContainsKey("history")
+	})
+
+	t.Run("rejects nodes the job does not target", func(t *testing.T) {
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(validNewJobRequest(1)).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+
+		asAdmin(t).GET("/admin/jobs/{jobID}/nodes/{org}/{name}", jobID, randomorg(), randomnode()).
+			Expect().
+			Status(http.StatusNotFound).
+			JSON().
+			Path("$.message").
+			String().
+			Equal("job does not target this node")
+	})
+
+	t.Run("requires the admin key", func(t *testing.T) {
+		asNode(t).GET("/admin/jobs/{jobID}/nodes/{org}/{name}", "5fd0f5b8c6b2a1e3f4a5b6c7", randomorg(), randomnode()).
+			Expect().
+			Status(http.StatusUnauthorized)
+	})
+}
+
+func Test_cancelJob(t *testing.T) {
+	t.Run("cancels tasks still in the queue", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		org, node := jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name
+
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+
+		resp := asAdmin(t).POST("/admin/jobs/{jobID}/cancel", jobID).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		resp.Path("$.cancelled").Array().Length().Equal(1)
+		resp.Path("$.running").Array().Empty()
+
+		asNode(t).POST(getNextTaskPath(org, node)).
+			Expect().
+			Status(http.StatusNotFound)
+
+		asAdmin(t).GET("/admin/jobs/{jobID}/nodes/{org}/{name}", jobID, org, node).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Path("$.status").
+			String().
+			Equal("cancelled")
+	})
+
+	t.Run("asks the nodes running the task to stop", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		org, node := jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name
+
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+
+		asNode(t).POST(getNextTaskPath(org, node)).
+			Expect().
+			Status(http.StatusOK)
+
+		resp := asAdmin(t).POST("/admin/jobs/{jobID}/cancel", jobID).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		resp.Path("$.cancelled").Array().Empty()
+		resp.Path("$.running").Array().Length().Equal(1)
+		resp.Path("$.running[0].name").String().Equal(node)
+
+		asNode(t).POST(updateTaskStatusPath(org, node)).
+			WithJSON(updateNodeTaskStatusReq{JobID: jobID, Status: "cancelled"}).
+			Expect().
+			Status(http.StatusOK)
+
+		resp = asAdmin(t).POST("/admin/jobs/{jobID}/cancel", jobID).
+			Expect().
+			Status(http.StatusOK).
+			JSON().Object()
+		resp.Path("$.cancelled").Array().Empty()
+		resp.Path("$.running").Array().Empty()
+	})
+
+	t.Run("returns not found for unknown jobs", func(t *testing.T) {
+		asAdmin(t).POST("/admin/jobs/{jobID}/cancel", "5fd0f5b8c6b2a1e3f4a5b6c7").
+			Expect().
+			Status(http.StatusNotFound)
+	})
+
+	t.Run("requires the admin key", func(t *testing.T) {
+		asNode(t).POST("/admin/jobs/{jobID}/cancel", "5fd0f5b8c6b2a1e3f4a5b6c7").
+			Expect().
+			Status(http.StatusUnauthorized)
+	})
+}
+
+func Test_events(t *testing.T) {
+	eventsServer := startTestServer(t, server.WithEventsHeartbeat(100*time.Millisecond))
+
+	// connect streams the node's events until the test is over
+	connect := func(t *testing.T, org string, node string) <-chan models.NodeEvent {
+		client := foodtruckhttp.NewClient(eventsServer, models.Node{Organization: org, Name: node},
+			&foodtruckhttp.ApiKeyAuthProvider{Key: nodesAPIKey})
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		events := make(chan models.NodeEvent, 10)
+		go client.Events(ctx, func(event models.NodeEvent) { // nolint: errcheck
+			events <- event
+		})
+		return events
+	}
+	next := func(t *testing.T, events <-chan models.NodeEvent) models.NodeEvent {
+		t.Helper()
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+			return models.NodeEvent{}
+		}
+	}
+
+	t.Run("sends the tasks added and cancelled", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		org, node := jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name
+
+		events := connect(t, org, node)
+		require.Equal(t, models.NodeEventTaskAvailable, next(t, events).Type)
+
+		// Jobs added through another server are seen too
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+		require.Equal(t, models.NodeEventTaskAvailable, next(t, events).Type)
+
+		asNode(t).POST(getNextTaskPath(org, node)).
+			Expect().
+			Status(http.StatusOK)
+		asAdminOn(t, eventsServer).POST("/admin/jobs/{jobID}/cancel", jobID).
+			Expect().
+			Status(http.StatusOK)
+		require.Equal(t, models.NodeEvent{Type: models.NodeEventCancel, JobID: jobID}, next(t, events))
+	})
+
+	t.Run("sends the cancellations missed while disconnected", func(t *testing.T) {
+		jobRequest := validNewJobRequest(1)
+		org, node := jobRequest.Nodes[0].Org, jobRequest.Nodes[0].Name
+
+		jobID := asAdmin(t).POST("/admin/jobs").
+			WithJSON(jobRequest).
+			Expect().
+			Status(http.StatusOK).
+			JSON().
+			Object().Path("$.id").String().Raw()
+		asNode(t).POST(getNextTaskPath(org, node)).
+			Expect().
+			Status(http.StatusOK)
+		asAdmin(t).POST("/admin/jobs/{jobID}/cancel", jobID).
+			Expect().
+			Status(http.StatusOK)
+
+		events := connect(t, org, node)
+		require.Equal(t, models.NodeEventTaskAvailable, next(t, events).Type)
+		require.Equal(t, models.NodeEvent{Type: models.NodeEventCancel, JobID: jobID}, next(t, events))
+	})
+
+	t.Run("requires the node key", func(t *testing.T) {
+		asUnauthorized(t).POST(eventsPath(randomorg(), randomnode())).
+			Expect().
+			Status(http.StatusUnauthorized)
+	})
 }
 
 func getNextTaskPath(org string, name string) string {
 	return fmt.Sprintf("/organizations/%s/foodtruck/nodes/%s/tasks/next", org, name)
 }
 
+func peekNextTaskPath(org string, name string) string {
+	return fmt.Sprintf("/organizations/%s/foodtruck/nodes/%s/tasks/peek", org, name)
+}
+
 func updateTaskStatusPath(org string, name string) string {
 	return fmt.Sprintf("/organizations/%s/foodtruck/nodes/%s/tasks/status", org, name)
 }
+
+func eventsPath(org string, name string) string {
+	return fmt.Sprintf("/organizations/%s/foodtruck/nodes/%s/tasks/events", org, name)
+}
@@ -2,14 +2,17 @@ package test
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/chef/foodtruck/pkg/secrets"
 	"github.com/chef/foodtruck/pkg/server"
 	"github.com/chef/foodtruck/pkg/storage"
 	"github.com/ory/dockertest/v3"
@@ -25,8 +28,11 @@ var pool *dockertest.Pool
 var resources = []*dockertest.Resource{}
 var dbBackend storage.Driver
 var foodtruckServerAddress string
+var testServerOpts []server.SetupOpt
 var adminAPIKey = "test-admin-api-key"
 var nodesAPIKey = "test-nodes-api-key"
+var nextNodesAPIKey = "test-nodes-api-key-next"
+var secretsKey = "test-secrets-key-0123456789abcde"
 
 type MongoConnInfo struct {
 	ConnectionString string
@@ -72,8 +78,6 @@ func TestMain(m *testing.M) {
 		Fatalf("failed to connect to mongo: %s", err)
 	}
 
-	var dbBackend storage.Driver
-
 	if *isCosmos {
 		dbBackend, err = storage.InitCosmosDB(context.Background(), c, connInfo.DatabaseName)
 	} else {
@@ -84,16 +88,72 @@ func TestMain(m *testing.M) {
 		Fatalf("failed to initialize backend: %s", err)
 	}
 
-	foodtruckServer := server.Setup(dbBackend, adminAPIKey, nodesAPIKey)
+	adminKeys, err := server.NewStaticKeySet(adminAPIKey)
+	if err != nil {
+		Fatalf("failed to create admin keys: %s", err)
+	}
+	nodesKeys, err := loadNodesKeySet()
+	if err != nil {
+		Fatalf("failed to create nodes keys: %s", err)
+	}
+
+	keyring, err := secrets.NewKeyring([]byte(secretsKey))
+	if err != nil {
+		Fatalf("failed to create secrets keyring: %s", err)
+	}
+
+	// Most tests use made up providers, see Test_providers for registration
+	testServerOpts = []server.SetupOpt{server.WithSecretsKeyring(keyring), server.WithAllowUnregisteredProviders(true)}
+	ctx, cancel := context.WithCancel(context.Background())
+	foodtruckServer := server.Setup(dbBackend, adminKeys, nodesKeys, append(testServerOpts, server.WithContext(ctx))...)
 	httpServer := httptest.NewServer(foodtruckServer)
 	foodtruckServerAddress = httpServer.URL
 
 	exitCode := m.Run()
 	httpServer.Close() // nolint: errcheck
+	cancel()
 	cleanup()
 	os.Exit(exitCode)
 }
 
+// startTestServer starts another foodtruck server using the same database as
+// the default one, with additional options. It is stopped when the test ends.
+func startTestServer(t *testing.T, opts ...server.SetupOpt) string {
+	t.Helper()
+	adminKeys, err := server.NewStaticKeySet(adminAPIKey)
+	if err != nil {
+		t.Fatalf("failed to create admin keys: %s", err)
+	}
+	nodesKeys, err := loadNodesKeySet()
+	if err != nil {
+		t.Fatalf("failed to create nodes keys: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	opts = append(append([]server.SetupOpt{server.WithContext(ctx)}, testServerOpts...), opts...)
+	httpServer := httptest.NewServer(server.Setup(dbBackend, adminKeys, nodesKeys, opts...))
+	t.Cleanup(httpServer.Close)
+	return httpServer.URL
+}
+
+// loadNodesKeySet creates a key set with both a current and next key, the way
+// it would look in the middle of a key rotation
+func loadNodesKeySet() (*server.KeySet, error) {
+	f, err := ioutil.TempFile("", "foodtruck-nodes-keys")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	defer f.Close()           // nolint: errcheck
+
+	keys := map[string]string{"current": nodesAPIKey, "next": nextNodesAPIKey}
+	if err := json.NewEncoder(f).Encode(keys); err != nil {
+		return nil, err
+	}
+	return server.LoadKeySet(f.Name())
+}
+
 func Fatalf(format string, v ...interface{}) {
 	log.Printf(format, v...)
 	cleanup()